@@ -5,6 +5,7 @@ import { ApiClient } from '@/api'
 import { Input } from "@/components/ui/input"
 import { Button } from "@/components/ui/button"
 import { chat_Message } from '@/api/models/chat_Message'
+import { WebSocketClient } from '@/lib/websocket'
 
 interface ChatRoomProps {
   userId: string
@@ -47,6 +48,22 @@ export const ChatRoom = ({ userId }: ChatRoomProps) => {
     fetchMessages()
   }, [userId, token])
 
+  useEffect(() => {
+    if (!userId || !token) return
+    const ws = new WebSocketClient()
+    const off = ws.on<chat_Message>('MESSAGE_CREATE', (message) => {
+      if (message.fromId !== userId && message.toId !== userId) return
+      setMessages((prev) =>
+        prev.some((m) => m.id === message.id) ? prev : [...prev, message]
+      )
+    })
+    ws.connect()
+    return () => {
+      off()
+      ws.disconnect()
+    }
+  }, [userId, token])
+
   const handleSendMessage = async () => {
     if (!newMessage.trim() || !token) return
 
@@ -1,21 +1,48 @@
 import { useAuthStore } from "@/lib/store/auth-store"
 
+// Every event the server pushes arrives as {"type", "data"}, e.g.
+// {"type": "MESSAGE_CREATE", "data": {...message}}.
+export interface GatewayEvent<T = unknown> {
+  type: string
+  data: T
+}
+
+type EventHandler = (data: any) => void
+
 export class WebSocketClient {
   private ws: WebSocket | null = null
+  private handlers = new Map<string, Set<EventHandler>>()
+  private closing = false
   private url: string
-  private token: string
   private reconnectAttempts = 0
   private maxReconnectAttempts = 5
   private reconnectTimeout = 1000 // Start with 1s, will increase exponentially
 
   constructor() {
     this.url = `ws://localhost:8080/api/chat/ws`  // Should come from env config
-    this.token = useAuthStore.getState().token ?? ''
+  }
+
+  // on calls handler with the data of every event of the given type, and
+  // returns a function that stops it.
+  on<T>(type: string, handler: (data: T) => void) {
+    if (!this.handlers.has(type)) {
+      this.handlers.set(type, new Set())
+    }
+    this.handlers.get(type)!.add(handler)
+    return () => {
+      this.handlers.get(type)?.delete(handler)
+    }
   }
 
   connect() {
+    this.closing = false
+    const token = useAuthStore.getState().token
+    if (!token) return null
     try {
-      this.ws = new WebSocket(this.url)
+      // Browsers cannot set Authorization on a websocket, so the token
+      // travels as a subprotocol after "bearer"; the server answers with
+      // "bearer" alone.
+      this.ws = new WebSocket(this.url, ['bearer', token])
       
       this.ws.onopen = () => {
         console.log('WebSocket connected')
@@ -25,7 +52,17 @@ export class WebSocketClient {
 
       this.ws.onclose = () => {
         console.log('WebSocket disconnected')
-        this.reconnect()
+        if (!this.closing) {
+          this.reconnect()
+        }
+      }
+
+      // The server packs events queued together into one frame, one per
+      // line.
+      this.ws.onmessage = (message) => {
+        for (const line of String(message.data).split('\n')) {
+          if (line) this.dispatch(line)
+        }
       }
 
       this.ws.onerror = (error) => {
@@ -40,6 +77,20 @@ export class WebSocketClient {
     }
   }
 
+  private dispatch(raw: string) {
+    let event: GatewayEvent
+    try {
+      event = JSON.parse(raw)
+    } catch (error) {
+      console.error('Invalid WebSocket event:', error)
+      return
+    }
+    if (!event || typeof event.type !== 'string') {
+      return
+    }
+    this.handlers.get(event.type)?.forEach((handler) => handler(event.data))
+  }
+
   private reconnect() {
     if (this.reconnectAttempts >= this.maxReconnectAttempts) {
       console.error('Max reconnection attempts reached')
@@ -47,6 +98,7 @@ export class WebSocketClient {
     }
 
     setTimeout(() => {
+      if (this.closing) return
       this.reconnectAttempts++
       this.reconnectTimeout *= 2 // Exponential backoff
       this.connect()
@@ -54,6 +106,7 @@ export class WebSocketClient {
   }
 
   disconnect() {
+    this.closing = true
     if (this.ws) {
       this.ws.close()
       this.ws = null
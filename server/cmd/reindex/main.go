@@ -0,0 +1,66 @@
+// Command reindex rebuilds the message search index from the database.
+// Run it from the server directory, with the same config as the server.
+// The bleve index can only be open in one process, so stop the server on
+// this node first.
+package main
+
+import (
+	"context"
+	"discord/internal/config"
+	"discord/internal/database"
+	"discord/internal/search"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func main() {
+	reset := flag.Bool("reset", false, "delete the index and build it from scratch")
+	flag.Parse()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logger := zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+	if cfg.Search.Backend == "postgres" {
+		logger.Info().Msg("the postgres search backend reads messages directly; there is nothing to rebuild")
+		return
+	}
+
+	db, err := database.New(&cfg.Database)
+	if err != nil {
+		log.Fatal("failed to connect to database")
+	}
+	defer db.Close()
+
+	if *reset {
+		if err := os.RemoveAll(cfg.Search.BlevePath); err != nil {
+			logger.Fatal().Err(err).Msg("failed to delete search index")
+		}
+	}
+
+	// Only this node's copy is rebuilt; the others are reindexed on their
+	// own nodes.
+	index, err := search.OpenBleve(cfg.Search.BlevePath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to open search index")
+	}
+	defer index.Close()
+
+	start := time.Now()
+	n, err := search.Reindex(context.Background(), db, index, func(n int) {
+		logger.Info().Int("messages", n).Msg("indexed")
+	})
+	if err != nil {
+		logger.Error().Err(err).Int("messages", n).Msg("reindex failed")
+		index.Close()
+		os.Exit(1)
+	}
+	logger.Info().Int("messages", n).Dur("took", time.Since(start)).Msg("reindex finished")
+}
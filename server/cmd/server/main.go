@@ -2,11 +2,23 @@ package main
 
 import (
 	"context"
+	"discord/internal/account"
+	"discord/internal/attachment"
 	"discord/internal/auth"
 	"discord/internal/chat"
 	"discord/internal/config"
 	"discord/internal/database"
+	"discord/internal/event"
+	"discord/internal/id"
+	"discord/internal/mail"
+	"discord/internal/presence"
+	"discord/internal/ratelimit"
+	"discord/internal/relationship"
+	"discord/internal/search"
+	"discord/internal/settings"
+	"discord/internal/storage"
 	"discord/internal/user"
+	"discord/internal/validation"
 	"fmt"
 	"log"
 	"net/http"
@@ -55,13 +67,67 @@ func main() {
 		logger.Fatal().Err(err).Msg("failed to connect to redis")
 	}
 
-	userService := user.NewService(db, &logger)
-	authService := auth.NewService(userService, []byte(cfg.JWT.Secret), &logger)
-	chatService := chat.NewService(db, redisClient, &logger)
+	worker := cfg.ID.WorkerID
+	if worker == -1 {
+		lease, err := id.LeaseWorker(context.Background(), redisClient, cfg.ID.LeaseTTL, &logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to lease worker id")
+		}
+		defer lease.Close()
 
-	userHandler := user.NewHandler(userService, &logger)
-	authHandler := auth.NewHandler(authService, &logger)
-	chatHandler := chat.NewHandler(chatService, &logger)
+		// Another node making IDs with the same worker ID could repeat
+		// ours, so stop rather than risk it.
+		go func() {
+			<-lease.Lost()
+			logger.Fatal().Int64("worker", lease.Worker()).Msg("lost worker id lease")
+		}()
+		worker = lease.Worker()
+		logger.Info().Int64("worker", worker).Msg("leased worker id")
+	}
+
+	ids, err := id.NewGenerator(worker)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up id generator")
+	}
+
+	blobs, err := storage.New(&cfg.Storage)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up blob storage")
+	}
+
+	index, err := search.New(context.Background(), &cfg.Search, db, redisClient, &logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up search index")
+	}
+	defer index.Close()
+
+	limiter := ratelimit.NewLimiter(redisClient, &cfg.RateLimit, &logger)
+	events := event.NewPublisher(redisClient, &logger)
+
+	validate, err := validation.New()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to set up validation")
+	}
+
+	userService := user.NewService(db, &logger)
+	authService := auth.NewService(userService, redisClient, []byte(cfg.JWT.Secret), &logger)
+	accountService := account.NewService(db, redisClient, userService, authService,
+		mail.New(&cfg.Mail, &logger), &cfg.Account, &logger)
+	settingsService := settings.NewService(db, &logger)
+	relationshipService := relationship.NewService(db, userService, events, &logger)
+	presenceService := presence.NewService(db, redisClient, events, &cfg.Presence, &logger)
+	attachmentService := attachment.NewService(db, blobs, ids, &cfg.Upload, &logger)
+	chatService := chat.NewService(db, redisClient, ids, events, userService, relationshipService,
+		settingsService, attachmentService, index, presenceService, limiter, validate, &logger)
+
+	userHandler := user.NewHandler(userService, attachmentService, validate, limiter, &logger)
+	authHandler := auth.NewHandler(authService, validate, &logger)
+	chatHandler := chat.NewHandler(chatService, validate, limiter, &logger)
+	accountHandler := account.NewHandler(accountService, validate, &logger)
+	relationshipHandler := relationship.NewHandler(relationshipService, validate, &logger)
+	settingsHandler := settings.NewHandler(settingsService, validate, &logger)
+	presenceHandler := presence.NewHandler(presenceService, validate, &logger)
+	attachmentHandler := attachment.NewHandler(attachmentService, &logger)
 
 	r := chi.NewRouter()
 
@@ -71,9 +137,9 @@ func main() {
 	r.Use(middleware.RealIP)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Request-ID"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Accept-Language", "Authorization", "Content-Type", "Idempotency-Key", "X-Request-ID"},
+		ExposedHeaders:   []string{"Idempotent-Replayed", "Link", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -84,11 +150,16 @@ func main() {
 
 	r.Route("/api", func(r chi.Router) {
 		r.Mount("/auth", authHandler.Routes())
+		r.Mount("/attachments", attachmentHandler.Routes())
 
 		r.Group(func(r chi.Router) {
 			r.Use(authService.Middleware)
 			r.Mount("/users", userHandler.Routes())
+			r.Mount("/account", accountHandler.Routes())
 			r.Mount("/chat", chatHandler.Routes())
+			r.Mount("/relationships", relationshipHandler.Routes())
+			r.Mount("/settings", settingsHandler.Routes())
+			r.Mount("/presence", presenceHandler.Routes())
 		})
 	})
 
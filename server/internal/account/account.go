@@ -0,0 +1,365 @@
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"discord/internal/auth"
+	"discord/internal/config"
+	"discord/internal/mail"
+	"discord/internal/user"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// Security event types recorded in the account security log.
+const (
+	EventPasswordChanged      = "password_changed"
+	EventEmailChangeRequested = "email_change_requested"
+	EventEmailChanged         = "email_changed"
+	EventUsernameChanged      = "username_changed"
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword" validate:"required,min=8,password,nefield=CurrentPassword"`
+}
+
+type ChangeEmailRequest struct {
+	Email    string `json:"email" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"required"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required,hexadecimal,len=64"`
+}
+
+type ChangeUsernameRequest struct {
+	Username string `json:"username" validate:"required,min=3,max=30,username"`
+}
+
+// SecurityEvent is one entry of the account security log.
+type SecurityEvent struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"userAgent"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// Meta describes where a change came from, for the security log.
+type Meta struct {
+	IP        string
+	UserAgent string
+}
+
+type Service struct {
+	db          *sql.DB
+	redis       *redis.Client
+	userService *user.Service
+	authService *auth.Service
+	mailer      mail.Mailer
+	cfg         *config.AccountConfig
+	log         *zerolog.Logger
+}
+
+var (
+	ErrWrongPassword    = errors.New("current password is incorrect")
+	ErrInvalidEmailCode = errors.New("invalid or expired verification token")
+	ErrEmailUnchanged   = errors.New("new email is the same as the current one")
+)
+
+// CooldownError is returned when a username change comes too soon after the
+// previous one.
+type CooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("username was changed recently, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// pendingEmail is what an email verification token resolves to.
+type pendingEmail struct {
+	UserID string `json:"userId"`
+	Email  string `json:"email"`
+}
+
+// claimEmailToken deletes a verification token and returns what it
+// resolves to, but only for the user it was issued to. Anyone else gets
+// nothing and the token stays usable.
+//
+// KEYS[1] token key
+// ARGV[1] user ID
+var claimEmailToken = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return false
+end
+local ok, pending = pcall(cjson.decode, data)
+if not ok or pending.userId ~= ARGV[1] then
+	return false
+end
+redis.call("DEL", KEYS[1])
+return data
+`)
+
+func NewService(
+	db *sql.DB,
+	redis *redis.Client,
+	userService *user.Service,
+	authService *auth.Service,
+	mailer mail.Mailer,
+	cfg *config.AccountConfig,
+	log *zerolog.Logger,
+) *Service {
+	return &Service{
+		db:          db,
+		redis:       redis,
+		userService: userService,
+		authService: authService,
+		mailer:      mailer,
+		cfg:         cfg,
+		log:         log,
+	}
+}
+
+// ChangePassword replaces the user's password and signs out every session
+// other than the one making the change.
+func (s *Service) ChangePassword(ctx context.Context, userID, sessionID string, req ChangePasswordRequest, meta Meta) error {
+	u, err := s.userService.GetByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+
+	if !auth.CheckPassword(u.PasswordHash, req.CurrentPassword) {
+		return ErrWrongPassword
+	}
+
+	hash, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	if err := s.userService.UpdatePasswordHash(ctx, userID, hash); err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+
+	if err := s.authService.RevokeOtherSessions(ctx, userID, sessionID); err != nil {
+		return fmt.Errorf("revoke sessions: %w", err)
+	}
+
+	s.record(ctx, userID, EventPasswordChanged, meta, nil)
+	return nil
+}
+
+// RequestEmailChange mails a verification token to the new address. The
+// email is only changed once that token comes back via VerifyEmailChange.
+func (s *Service) RequestEmailChange(ctx context.Context, userID string, req ChangeEmailRequest, meta Meta) error {
+	u, err := s.userService.GetByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+
+	if !auth.CheckPassword(u.PasswordHash, req.Password) {
+		return ErrWrongPassword
+	}
+	if req.Email == u.Email {
+		return ErrEmailUnchanged
+	}
+
+	if _, err := s.userService.GetByEmail(ctx, req.Email); err == nil {
+		return user.ErrEmailTaken
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("check email: %w", err)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return fmt.Errorf("generate token: %w", err)
+	}
+
+	pending, err := json.Marshal(pendingEmail{UserID: userID, Email: req.Email})
+	if err != nil {
+		return fmt.Errorf("marshal pending email: %w", err)
+	}
+	if err := s.redis.Set(ctx, emailTokenKey(token), pending, s.cfg.EmailTokenTTL).Err(); err != nil {
+		return fmt.Errorf("store token: %w", err)
+	}
+
+	link := s.cfg.VerifyEmailURL + "?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(ctx, mail.Message{
+		To:      req.Email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm this address for your account by opening:\n\n%s\n\n"+
+			"The link expires in %s. If you did not ask for this, ignore this email.\n",
+			u.Username, link, s.cfg.EmailTokenTTL),
+	})
+	if err != nil {
+		return fmt.Errorf("send verification: %w", err)
+	}
+
+	s.record(ctx, userID, EventEmailChangeRequested, meta, map[string]string{"email": req.Email})
+	return nil
+}
+
+// VerifyEmailChange applies a pending email change. The token is single use
+// and must belong to the signed-in user.
+func (s *Service) VerifyEmailChange(ctx context.Context, userID string, req VerifyEmailRequest, meta Meta) (*user.User, error) {
+	data, err := claimEmailToken.Run(ctx, s.redis, []string{emailTokenKey(req.Token)}, userID).Text()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrInvalidEmailCode
+		}
+		return nil, fmt.Errorf("claim token: %w", err)
+	}
+
+	var pending pendingEmail
+	if err := json.Unmarshal([]byte(data), &pending); err != nil {
+		return nil, fmt.Errorf("unmarshal pending email: %w", err)
+	}
+
+	old, err := s.userService.GetByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+
+	u, err := s.userService.UpdateEmail(ctx, userID, pending.Email)
+	if err != nil {
+		if err == user.ErrEmailTaken {
+			return nil, err
+		}
+		return nil, fmt.Errorf("update email: %w", err)
+	}
+
+	// Let the previous address know, in case the change was not the owner's.
+	err = s.mailer.Send(ctx, mail.Message{
+		To:      old.Email,
+		Subject: "Your email address was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email address on your account was changed to %s.\n",
+			u.Username, u.Email),
+	})
+	if err != nil {
+		s.log.Error().Err(err).Str("userId", userID).Msg("failed to send email change notice")
+	}
+
+	s.record(ctx, userID, EventEmailChanged, meta, map[string]string{"from": old.Email, "to": u.Email})
+	return u, nil
+}
+
+// ChangeUsername renames the user, at most once per configured cooldown.
+// Renaming to the current username is a no-op.
+func (s *Service) ChangeUsername(ctx context.Context, userID string, req ChangeUsernameRequest, meta Meta) (*user.User, error) {
+	old, err := s.userService.GetByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+
+	// Keeping the same name changes nothing, so it neither waits for nor
+	// starts a cooldown.
+	if req.Username == old.Username {
+		return old, nil
+	}
+
+	if old.UsernameChangedAt != nil {
+		if wait := s.cfg.UsernameCooldown - time.Since(*old.UsernameChangedAt); wait > 0 {
+			return nil, &CooldownError{RetryAfter: wait}
+		}
+	}
+
+	// The check above is only a shortcut; the update enforces the
+	// cooldown itself, so a rename racing this one makes it fail here.
+	u, err := s.userService.UpdateUsername(ctx, userID, req.Username, time.Now().Add(-s.cfg.UsernameCooldown))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &CooldownError{RetryAfter: s.cfg.UsernameCooldown}
+		}
+		if err == user.ErrUsernameTaken {
+			return nil, err
+		}
+		return nil, fmt.Errorf("update username: %w", err)
+	}
+
+	s.record(ctx, userID, EventUsernameChanged, meta, map[string]string{"from": old.Username, "to": u.Username})
+	return u, nil
+}
+
+// SecurityLog returns the user's security events, newest first, created
+// before the given time.
+func (s *Service) SecurityLog(ctx context.Context, userID string, before time.Time, limit int) ([]SecurityEvent, error) {
+	const q = `
+        SELECT id, type, ip, user_agent, metadata, created_at
+        FROM account_security_events
+        WHERE user_id = $1 AND created_at < $2
+        ORDER BY created_at DESC
+        LIMIT $3`
+
+	rows, err := s.db.QueryContext(ctx, q, userID, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query security log: %w", err)
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		var metadata []byte
+		if err := rows.Scan(&e.ID, &e.Type, &e.IP, &e.UserAgent, &metadata, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan security event: %w", err)
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode security event metadata: %w", err)
+		}
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating security log: %w", err)
+	}
+
+	return events, nil
+}
+
+// record appends to the security log. The change it describes has already
+// happened, so a failure here is logged rather than returned.
+func (s *Service) record(ctx context.Context, userID, eventType string, meta Meta, metadata map[string]string) {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		s.log.Error().Err(err).Msg("failed to marshal security event metadata")
+		return
+	}
+
+	const q = `
+        INSERT INTO account_security_events (user_id, type, ip, user_agent, metadata, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)`
+
+	if _, err := s.db.ExecContext(ctx, q, userID, eventType, meta.IP, meta.UserAgent, data, time.Now()); err != nil {
+		s.log.Error().Err(err).
+			Str("userId", userID).
+			Str("type", eventType).
+			Msg("failed to record security event")
+	}
+}
+
+func emailTokenKey(token string) string {
+	return fmt.Sprintf("email_change:%s", token)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,289 @@
+package account
+
+import (
+	"discord/internal/http/response"
+	"discord/internal/user"
+	"discord/internal/validation"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+type Handler struct {
+	svc      *Service
+	validate *validation.Validator
+	log      *zerolog.Logger
+}
+
+func NewHandler(svc *Service, validate *validation.Validator, log *zerolog.Logger) *Handler {
+	return &Handler{
+		svc:      svc,
+		validate: validate,
+		log:      log,
+	}
+}
+
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Put("/password", h.handleChangePassword)
+	r.Post("/email", h.handleChangeEmail)
+	r.Post("/email/verify", h.handleVerifyEmail)
+	r.Put("/username", h.handleChangeUsername)
+	r.Get("/security-log", h.handleSecurityLog)
+
+	return r
+}
+
+// @Summary Change password
+// @Description Change the signed-in user's password. Requires the current password and signs out all other sessions.
+// @Tags account
+// @Accept json
+// @Param Authorization header string true "Bearer token"
+// @Param request body ChangePasswordRequest true "Current and new password"
+// @Success 204 "Password changed"
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 403 {object} response.Problem "Current password is incorrect"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /account/password [put]
+func (h *Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+	sessionID, _ := r.Context().Value("sessionID").(string)
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	if err := h.svc.ChangePassword(r.Context(), userID.String(), sessionID, req, meta(r)); err != nil {
+		h.renderError(w, r, err, "failed to change password")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Change email
+// @Description Start changing the signed-in user's email. A verification token is mailed to the new address; the change applies once it is confirmed.
+// @Tags account
+// @Accept json
+// @Param Authorization header string true "Bearer token"
+// @Param request body ChangeEmailRequest true "New email and current password"
+// @Success 202 "Verification sent"
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 403 {object} response.Problem "Current password is incorrect"
+// @Failure 409 {object} response.Problem "Email already in use"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /account/email [post]
+func (h *Handler) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req ChangeEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	if err := h.svc.RequestEmailChange(r.Context(), userID.String(), req, meta(r)); err != nil {
+		h.renderError(w, r, err, "failed to request email change")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// @Summary Verify email change
+// @Description Confirm a pending email change with the token mailed to the new address
+// @Tags account
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param request body VerifyEmailRequest true "Verification token"
+// @Success 200 {object} user.User
+// @Failure 400 {object} response.Problem "Invalid or expired token"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 409 {object} response.Problem "Email already in use"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /account/email/verify [post]
+func (h *Handler) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	u, err := h.svc.VerifyEmailChange(r.Context(), userID.String(), req, meta(r))
+	if err != nil {
+		h.renderError(w, r, err, "failed to verify email change")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// @Summary Change username
+// @Description Change the signed-in user's username. Usernames can only be changed once per cooldown period.
+// @Tags account
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param request body ChangeUsernameRequest true "New username"
+// @Success 200 {object} user.User
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 409 {object} response.Problem "Username already taken"
+// @Failure 429 {object} response.Problem "Username changed too recently"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /account/username [put]
+func (h *Handler) handleChangeUsername(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req ChangeUsernameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	u, err := h.svc.ChangeUsername(r.Context(), userID.String(), req, meta(r))
+	if err != nil {
+		h.renderError(w, r, err, "failed to change username")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// @Summary Account security log
+// @Description List security-relevant changes to the signed-in user's account, newest first
+// @Tags account
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param before query string false "Only events before this RFC 3339 time"
+// @Param limit query int false "Maximum number of events (1-100, default 50)"
+// @Success 200 {array} SecurityEvent
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /account/security-log [get]
+func (h *Handler) handleSecurityLog(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	before := time.Now()
+	if v := r.URL.Query().Get("before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("before must be an RFC 3339 time"))
+			return
+		}
+		before = t
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			response.Render(w, r, response.ErrInvalidRequest("limit must be between 1 and 100"))
+			return
+		}
+		limit = n
+	}
+
+	events, err := h.svc.SecurityLog(r.Context(), userID.String(), before, limit)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to get security log")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func (h *Handler) renderError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	var cooldown *CooldownError
+	switch {
+	case errors.Is(err, ErrWrongPassword):
+		response.Render(w, r, response.New(http.StatusForbidden, response.CodeWrongPassword, err.Error()))
+	case errors.Is(err, ErrInvalidEmailCode):
+		response.Render(w, r, response.New(http.StatusBadRequest, response.CodeInvalidToken, err.Error()))
+	case errors.Is(err, ErrEmailUnchanged):
+		response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+	case errors.Is(err, user.ErrEmailTaken):
+		response.Render(w, r, response.ErrConflict(response.CodeEmailTaken, err.Error()))
+	case errors.Is(err, user.ErrUsernameTaken):
+		response.Render(w, r, response.ErrConflict(response.CodeUsernameTaken, err.Error()))
+	case errors.As(err, &cooldown):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(cooldown.RetryAfter.Seconds()))))
+		response.Render(w, r, response.New(http.StatusTooManyRequests, response.CodeUsernameCooldown, err.Error()))
+	default:
+		h.log.Error().Err(err).Msg(msg)
+		response.Render(w, r, response.ErrInternal())
+	}
+}
+
+func meta(r *http.Request) Meta {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return Meta{
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+}
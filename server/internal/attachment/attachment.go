@@ -0,0 +1,525 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"discord/internal/config"
+	"discord/internal/id"
+	"discord/internal/storage"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+// MaxPerMessage is how many attachments one message can carry.
+const MaxPerMessage = 10
+
+var (
+	ErrNotFound      = errors.New("attachment not found")
+	ErrTooLarge      = errors.New("file is too large")
+	ErrQuotaExceeded = errors.New("file would exceed your storage quota")
+	ErrUnavailable   = errors.New("attachments must be your own uploads and not already sent")
+	ErrInvalidLink   = errors.New("download link is invalid or has expired")
+)
+
+// Attachment is an uploaded file. Until it is sent with a message it is
+// only visible to its uploader. URL is a signed download link that expires.
+type Attachment struct {
+	ID          id.ID  `json:"id" swaggertype:"string" example:"1234567890123456789"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	// Checksum is the hex SHA-256 of the file as stored, after metadata
+	// was stripped from images.
+	Checksum string `json:"checksum"`
+	URL      string `json:"url"`
+	// Width and Height are set for images, as they are displayed.
+	Width  *int `json:"width,omitempty"`
+	Height *int `json:"height,omitempty"`
+	// Thumbnails are made in the background after upload, and only in
+	// sizes smaller than the image.
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+
+	key            string
+	thumbnailSizes []int64
+}
+
+// Usage is how much of their storage quota a user has used, in bytes. A
+// file counts once however many times the user uploaded it.
+type Usage struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"`
+}
+
+// columns are an attachment's fields, from attachments a joined with its
+// blob b, in the order scan reads them.
+const columns = `a.id, a.filename, b.size, b.content_type, b.checksum, b.storage_key,
+        b.width, b.height, b.thumbnail_sizes`
+
+// Thumbnail is a scaled-down copy of an image attachment that fits in a
+// Size x Size box.
+type Thumbnail struct {
+	Size   int    `json:"size" example:"256"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+type Service struct {
+	db        *sql.DB
+	store     storage.BlobStore
+	ids       *id.Generator
+	cfg       *config.UploadConfig
+	queue     chan string
+	processed chan id.ID
+	log       *zerolog.Logger
+}
+
+func NewService(db *sql.DB, store storage.BlobStore, ids *id.Generator, cfg *config.UploadConfig, log *zerolog.Logger) *Service {
+	svc := &Service{
+		db:        db,
+		store:     store,
+		ids:       ids,
+		cfg:       cfg,
+		queue:     make(chan string, 256),
+		processed: make(chan id.ID, 64),
+		log:       log,
+	}
+
+	for i := 0; i < cfg.ImageWorkers; i++ {
+		go svc.work()
+	}
+	go svc.sweep()
+
+	return svc
+}
+
+// MaxFileSize is the largest file Upload accepts, in bytes.
+func (s *Service) MaxFileSize() int64 {
+	return s.cfg.MaxFileSize
+}
+
+// Upload stores a file for userID to send later. The content type is
+// sniffed from the file itself rather than trusted from the client or the
+// file's extension. Images are stored without their metadata, and queued
+// for thumbnails. A file that is already stored is not stored again.
+func (s *Service) Upload(ctx context.Context, userID uuid.UUID, filename string, r io.ReadSeeker, size int64) (*Attachment, error) {
+	if size > s.cfg.MaxFileSize {
+		return nil, ErrTooLarge
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("rewind file: %w", err)
+	}
+
+	contentType := http.DetectContentType(head[:n])
+
+	var info imageInfo
+	if isImage(contentType) {
+		data, err := io.ReadAll(io.LimitReader(r, size))
+		if err != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+		data, info, err = inspectImage(contentType, data)
+		if err != nil {
+			return nil, err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, fmt.Errorf("hash file: %w", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("rewind file: %w", err)
+	}
+
+	a := &Attachment{
+		ID:          s.ids.Next(),
+		Filename:    cleanFilename(filename),
+		Size:        size,
+		ContentType: contentType,
+		Checksum:    hex.EncodeToString(h.Sum(nil)),
+	}
+	a.key = "blobs/" + a.Checksum
+	if info.width > 0 {
+		a.Width, a.Height = &info.width, &info.height
+	}
+
+	if err := s.record(ctx, userID, a); err != nil {
+		return nil, err
+	}
+
+	// The blob is written after its row is committed, so it cannot be
+	// collected while this upload is in flight. Writing the same content
+	// again is harmless.
+	if err := s.store.Put(ctx, a.key, r, size, a.ContentType); err != nil {
+		if _, delErr := s.db.ExecContext(ctx, `DELETE FROM attachments WHERE id = $1`, a.ID); delErr != nil {
+			s.log.Error().Err(delErr).Str("attachmentId", a.ID.String()).Msg("failed to delete unstored attachment")
+		}
+		return nil, fmt.Errorf("store file: %w", err)
+	}
+
+	if a.Width != nil && a.thumbnailSizes == nil {
+		s.enqueue(a.Checksum)
+	}
+
+	s.sign(a)
+	return a, nil
+}
+
+// record saves a as an upload of userID's, and its blob if it is new,
+// provided it fits in their quota. When the blob already exists, a takes
+// on its thumbnails.
+func (s *Service) record(ctx context.Context, userID uuid.UUID, a *Attachment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Serialize a user's uploads so the quota holds.
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, "quota:"+userID.String()); err != nil {
+		return fmt.Errorf("lock quota: %w", err)
+	}
+
+	const usage = `
+        SELECT COALESCE(SUM(b.size), 0), COALESCE(bool_or(b.checksum = $2), false)
+        FROM blobs b
+        WHERE b.checksum IN (SELECT checksum FROM attachments WHERE uploader_id = $1)`
+
+	var used int64
+	var owned bool
+	if err := tx.QueryRowContext(ctx, usage, userID, a.Checksum).Scan(&used, &owned); err != nil {
+		return fmt.Errorf("get storage usage: %w", err)
+	}
+	if !owned && used+a.Size > s.cfg.Quota {
+		return ErrQuotaExceeded
+	}
+
+	// The no-op update locks an existing blob and returns its row.
+	const blob = `
+        INSERT INTO blobs (checksum, size, content_type, storage_key, width, height, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (checksum) DO UPDATE SET checksum = EXCLUDED.checksum
+        RETURNING thumbnail_sizes`
+
+	err = tx.QueryRowContext(ctx, blob, a.Checksum, a.Size, a.ContentType, a.key, a.Width, a.Height, time.Now()).
+		Scan(pq.Array(&a.thumbnailSizes))
+	if err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+
+	const q = `
+        INSERT INTO attachments (id, uploader_id, filename, checksum, created_at)
+        VALUES ($1, $2, $3, $4, $5)`
+
+	if _, err := tx.ExecContext(ctx, q, a.ID, userID, a.Filename, a.Checksum, time.Now()); err != nil {
+		return fmt.Errorf("failed to store attachment: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Usage reports userID's storage use against their quota. Uploads count
+// from the moment they are made, sent or not.
+func (s *Service) Usage(ctx context.Context, userID uuid.UUID) (*Usage, error) {
+	const q = `
+        SELECT COALESCE(SUM(size), 0) FROM blobs
+        WHERE checksum IN (SELECT checksum FROM attachments WHERE uploader_id = $1)`
+
+	u := &Usage{Quota: s.cfg.Quota}
+	if err := s.db.QueryRowContext(ctx, q, userID).Scan(&u.Used); err != nil {
+		return nil, fmt.Errorf("get storage usage: %w", err)
+	}
+	return u, nil
+}
+
+// Link attaches userID's uploads to messageID as part of tx. Every upload
+// must belong to userID and not be attached to anything yet.
+func (s *Service) Link(ctx context.Context, tx *sql.Tx, userID uuid.UUID, messageID id.ID, ids []id.ID) ([]Attachment, error) {
+	raw := make([]int64, len(ids))
+	for i, v := range ids {
+		raw[i] = int64(v)
+	}
+
+	const q = `
+        WITH a AS (
+            UPDATE attachments SET message_id = $1
+            WHERE id = ANY($2) AND uploader_id = $3 AND message_id IS NULL
+            RETURNING id, filename, checksum
+        )
+        SELECT ` + columns + `
+        FROM a JOIN blobs b ON b.checksum = a.checksum`
+
+	rows, err := tx.QueryContext(ctx, q, messageID, pq.Array(raw), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link attachments: %w", err)
+	}
+	defer rows.Close()
+
+	byID := make(map[id.ID]Attachment, len(ids))
+	for rows.Next() {
+		a, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		s.sign(&a)
+		byID[a.ID] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating attachments: %w", err)
+	}
+
+	// Keep the order the sender gave.
+	linked := make([]Attachment, 0, len(ids))
+	for _, v := range ids {
+		a, ok := byID[v]
+		if !ok {
+			return nil, ErrUnavailable
+		}
+		delete(byID, v)
+		linked = append(linked, a)
+	}
+	return linked, nil
+}
+
+// ForMessages returns the attachments of each of messageIDs that has any,
+// in upload order.
+func (s *Service) ForMessages(ctx context.Context, messageIDs []id.ID) (map[id.ID][]Attachment, error) {
+	result := make(map[id.ID][]Attachment)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	raw := make([]int64, len(messageIDs))
+	for i, v := range messageIDs {
+		raw[i] = int64(v)
+	}
+
+	const q = `
+        SELECT a.message_id, ` + columns + `
+        FROM attachments a JOIN blobs b ON b.checksum = a.checksum
+        WHERE a.message_id = ANY($1)
+        ORDER BY a.id`
+
+	rows, err := s.db.QueryContext(ctx, q, pq.Array(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attachments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID id.ID
+		a, err := scan(rows, &messageID)
+		if err != nil {
+			return nil, err
+		}
+		s.sign(&a)
+		result[messageID] = append(result[messageID], a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating attachments: %w", err)
+	}
+	return result, nil
+}
+
+// Open checks a signed download link and opens the file it points to.
+func (s *Service) Open(ctx context.Context, attachmentID id.ID, filename, expires, signature string) (*Attachment, io.ReadCloser, error) {
+	if err := s.verify(attachmentID, filename, expires, signature); err != nil {
+		return nil, nil, err
+	}
+
+	a, err := s.get(ctx, attachmentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := s.store.Get(ctx, a.key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("open file: %w", err)
+	}
+	return &a, body, nil
+}
+
+// OpenThumbnail checks a signed thumbnail link and opens the thumbnail it
+// points to. name is the size and extension, as in 256.jpg.
+func (s *Service) OpenThumbnail(ctx context.Context, attachmentID id.ID, name, expires, signature string) (string, io.ReadCloser, error) {
+	if err := s.verify(attachmentID, "thumbnails/"+name, expires, signature); err != nil {
+		return "", nil, err
+	}
+
+	a, err := s.get(ctx, attachmentID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	contentType, ext := thumbnailType(a.ContentType)
+	for _, size := range a.thumbnailSizes {
+		if name != fmt.Sprintf("%d.%s", size, ext) {
+			continue
+		}
+
+		body, err := s.store.Get(ctx, thumbnailKey(a.Checksum, int(size)))
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return "", nil, ErrNotFound
+			}
+			return "", nil, fmt.Errorf("open thumbnail: %w", err)
+		}
+		return contentType, body, nil
+	}
+	return "", nil, ErrNotFound
+}
+
+func (s *Service) get(ctx context.Context, attachmentID id.ID) (Attachment, error) {
+	const q = `
+        SELECT ` + columns + `
+        FROM attachments a JOIN blobs b ON b.checksum = a.checksum
+        WHERE a.id = $1`
+
+	a, err := scan(s.db.QueryRowContext(ctx, q, attachmentID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return a, ErrNotFound
+		}
+		return a, err
+	}
+	return a, nil
+}
+
+// verify checks the expiry and signature of a link to name.
+func (s *Service) verify(attachmentID id.ID, name, expires, signature string) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return ErrInvalidLink
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, s.mac(attachmentID, name, exp)) {
+		return ErrInvalidLink
+	}
+	return nil
+}
+
+// sign sets a.URL, and the URLs of its thumbnails, to download links valid
+// for the configured TTL.
+func (s *Service) sign(a *Attachment) {
+	a.URL = s.link(a.ID, a.Filename)
+
+	a.Thumbnails = nil
+	if a.Width == nil || a.Height == nil {
+		return
+	}
+	_, ext := thumbnailType(a.ContentType)
+	for _, size := range a.thumbnailSizes {
+		w, h := fit(*a.Width, *a.Height, int(size))
+		a.Thumbnails = append(a.Thumbnails, Thumbnail{
+			Size:   int(size),
+			Width:  w,
+			Height: h,
+			URL:    s.link(a.ID, fmt.Sprintf("thumbnails/%d.%s", size, ext)),
+		})
+	}
+}
+
+// link is a signed URL for name under the attachment's path.
+func (s *Service) link(attachmentID id.ID, name string) string {
+	exp := time.Now().Add(s.cfg.URLTTL).Unix()
+
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(exp, 10))
+	q.Set("signature", base64.RawURLEncoding.EncodeToString(s.mac(attachmentID, name, exp)))
+
+	// Filenames never contain a slash, so they cannot be confused with a
+	// thumbnail.
+	escaped := url.PathEscape(name)
+	if rest, ok := strings.CutPrefix(name, "thumbnails/"); ok {
+		escaped = "thumbnails/" + url.PathEscape(rest)
+	}
+
+	return fmt.Sprintf("%s/api/attachments/%s/%s?%s",
+		strings.TrimSuffix(s.cfg.BaseURL, "/"), attachmentID, escaped, q.Encode())
+}
+
+func (s *Service) mac(attachmentID id.ID, filename string, expires int64) []byte {
+	m := hmac.New(sha256.New, []byte(s.cfg.URLSecret))
+	fmt.Fprintf(m, "%s\n%s\n%d", attachmentID, filename, expires)
+	return m.Sum(nil)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scan reads an attachment's columns, after any extra leading columns
+// given in dest.
+func scan(row scanner, dest ...interface{}) (Attachment, error) {
+	var a Attachment
+	var width, height sql.NullInt32
+	dest = append(dest, &a.ID, &a.Filename, &a.Size, &a.ContentType, &a.Checksum, &a.key,
+		&width, &height, pq.Array(&a.thumbnailSizes))
+	if err := row.Scan(dest...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return a, err
+		}
+		return a, fmt.Errorf("failed to scan attachment: %w", err)
+	}
+	if width.Valid && height.Valid {
+		w, h := int(width.Int32), int(height.Int32)
+		a.Width, a.Height = &w, &h
+	}
+	return a, nil
+}
+
+// cleanFilename keeps the base name of a client-supplied filename, without
+// control characters, and at most 255 bytes long.
+func cleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	for len(name) > 255 {
+		runes := []rune(name)
+		name = string(runes[:len(runes)-1])
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
@@ -0,0 +1,175 @@
+package attachment
+
+import (
+	"discord/internal/http/response"
+	"discord/internal/id"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+type Handler struct {
+	svc *Service
+	log *zerolog.Logger
+}
+
+func NewHandler(svc *Service, log *zerolog.Logger) *Handler {
+	return &Handler{
+		svc: svc,
+		log: log,
+	}
+}
+
+// Routes serves downloads. They are authorized by the link's signature, not
+// by a session, so they work in <img> tags and plain links.
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/{attachmentID}/{filename}", h.handleDownload)
+	r.Get("/{attachmentID}/thumbnails/{thumbnail}", h.handleThumbnail)
+
+	return r
+}
+
+// @Summary Download attachment
+// @Description Download an attachment through the signed, expiring link given in its url field
+// @Tags attachments
+// @Produce octet-stream
+// @Param attachmentID path string true "Attachment ID"
+// @Param filename path string true "Attachment filename"
+// @Param expires query int true "Expiry of the link, in Unix seconds"
+// @Param signature query string true "Link signature"
+// @Success 200 {file} file
+// @Failure 403 {object} response.Problem "Invalid or expired link"
+// @Failure 404 {object} response.Problem "Attachment not found"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /attachments/{attachmentID}/{filename} [get]
+func (h *Handler) handleDownload(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := id.Parse(chi.URLParam(r, "attachmentID"))
+	if err != nil {
+		response.Render(w, r, response.ErrNotFound(ErrNotFound.Error()))
+		return
+	}
+
+	filename, err := pathParam(r, "filename")
+	if err != nil {
+		response.Render(w, r, response.ErrNotFound(ErrNotFound.Error()))
+		return
+	}
+
+	a, body, err := h.svc.Open(r.Context(), attachmentID, filename,
+		r.URL.Query().Get("expires"), r.URL.Query().Get("signature"))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidLink):
+			response.Render(w, r, response.New(http.StatusForbidden, response.CodeInvalidLink, err.Error()))
+		case errors.Is(err, ErrNotFound):
+			response.Render(w, r, response.ErrNotFound(err.Error()))
+		default:
+			h.log.Error().Err(err).Msg("failed to open attachment")
+			response.Render(w, r, response.ErrInternal())
+		}
+		return
+	}
+	defer body.Close()
+
+	// Only media is shown inline. Anything else, HTML above all, is a
+	// download, and never sniffed or run in the API's origin.
+	disposition := "attachment"
+	if inline(a.ContentType) {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Set("ETag", fmt.Sprintf("%q", a.Checksum))
+
+	if _, err := io.Copy(w, body); err != nil {
+		h.log.Debug().Err(err).Str("attachmentId", a.ID.String()).Msg("attachment download interrupted")
+	}
+}
+
+// @Summary Download thumbnail
+// @Description Download an image thumbnail through the signed, expiring link given in the attachment's thumbnails
+// @Tags attachments
+// @Produce jpeg,png
+// @Param attachmentID path string true "Attachment ID"
+// @Param thumbnail path string true "Thumbnail size and extension" example(256.jpg)
+// @Param expires query int true "Expiry of the link, in Unix seconds"
+// @Param signature query string true "Link signature"
+// @Success 200 {file} file
+// @Failure 403 {object} response.Problem "Invalid or expired link"
+// @Failure 404 {object} response.Problem "Thumbnail not found"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /attachments/{attachmentID}/thumbnails/{thumbnail} [get]
+func (h *Handler) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	attachmentID, err := id.Parse(chi.URLParam(r, "attachmentID"))
+	if err != nil {
+		response.Render(w, r, response.ErrNotFound(ErrNotFound.Error()))
+		return
+	}
+
+	thumbnail, err := pathParam(r, "thumbnail")
+	if err != nil {
+		response.Render(w, r, response.ErrNotFound("thumbnail not found"))
+		return
+	}
+
+	contentType, body, err := h.svc.OpenThumbnail(r.Context(), attachmentID, thumbnail,
+		r.URL.Query().Get("expires"), r.URL.Query().Get("signature"))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidLink):
+			response.Render(w, r, response.New(http.StatusForbidden, response.CodeInvalidLink, err.Error()))
+		case errors.Is(err, ErrNotFound):
+			response.Render(w, r, response.ErrNotFound("thumbnail not found"))
+		default:
+			h.log.Error().Err(err).Msg("failed to open thumbnail")
+			response.Render(w, r, response.ErrInternal())
+		}
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private")
+
+	if _, err := io.Copy(w, body); err != nil {
+		h.log.Debug().Err(err).Str("attachmentId", attachmentID.String()).Msg("thumbnail download interrupted")
+	}
+}
+
+func inline(contentType string) bool {
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return !strings.HasPrefix(contentType, "image/svg")
+		}
+	}
+	return strings.HasPrefix(contentType, "text/plain")
+}
+
+// pathParam is a path parameter as it was before link escaped it. chi
+// matches on the raw path, and so hands back parameters still escaped,
+// whenever the URL has one: that is, when link escaped something a plain
+// path would not, such as a comma.
+func pathParam(r *http.Request, key string) (string, error) {
+	v := chi.URLParam(r, key)
+	if r.URL.RawPath == "" {
+		return v, nil
+	}
+	return url.PathUnescape(v)
+}
@@ -0,0 +1,110 @@
+package attachment
+
+import (
+	"database/sql"
+	"discord/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+// newLinkTest serves the attachment routes where the server mounts them.
+// The database is closed, so a link that verifies fails afterwards with a
+// 500, and a 403 means only that the link was refused.
+func newLinkTest(t *testing.T) (*Service, http.Handler) {
+	t.Helper()
+
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	log := zerolog.Nop()
+	svc := &Service{
+		db: db,
+		cfg: &config.UploadConfig{
+			URLSecret: "secret",
+			URLTTL:    time.Hour,
+			BaseURL:   "http://localhost:8080/",
+		},
+		log: &log,
+	}
+
+	r := chi.NewRouter()
+	r.Route("/api", func(r chi.Router) {
+		r.Mount("/attachments", NewHandler(svc, &log).Routes())
+	})
+	return svc, r
+}
+
+func get(h http.Handler, link string) int {
+	target := strings.TrimPrefix(link, "http://localhost:8080")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec.Code
+}
+
+func TestLinkRoundTrip(t *testing.T) {
+	svc, h := newLinkTest(t)
+
+	names := []string{
+		"cat.png",
+		"holiday photo.jpg",
+		"100%.txt",
+		"a,b;c.txt",
+		"a+b=c.txt",
+		"what?#1.txt",
+		"überraschung.pdf",
+		"猫.gif",
+		"thumbnails/256.jpg",
+		"thumbnails/1024.png",
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			link := svc.link(42, name)
+			if code := get(h, link); code == http.StatusForbidden || code == http.StatusNotFound {
+				t.Errorf("GET %s = %d, want the link accepted", link, code)
+			}
+		})
+	}
+}
+
+func TestLinkRefused(t *testing.T) {
+	svc, h := newLinkTest(t)
+
+	tests := []struct {
+		name   string
+		tamper func(link string) string
+	}{
+		{"other file", func(l string) string { return strings.Replace(l, "/cat.png", "/dog.png", 1) }},
+		{"other attachment", func(l string) string { return strings.Replace(l, "/42/", "/43/", 1) }},
+		{"later expiry", func(l string) string { return strings.Replace(l, "expires=", "expires=9", 1) }},
+		{"no signature", func(l string) string { return l[:strings.Index(l, "&signature=")] }},
+		{"thumbnail instead", func(l string) string { return strings.Replace(l, "/cat.png", "/thumbnails/cat.png", 1) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link := tt.tamper(svc.link(42, "cat.png"))
+			if code := get(h, link); code != http.StatusForbidden {
+				t.Errorf("GET %s = %d, want 403", link, code)
+			}
+		})
+	}
+}
+
+func TestLinkExpired(t *testing.T) {
+	svc, h := newLinkTest(t)
+	svc.cfg.URLTTL = -time.Minute
+
+	if code := get(h, svc.link(42, "cat.png")); code != http.StatusForbidden {
+		t.Errorf("expired link = %d, want 403", code)
+	}
+}
@@ -0,0 +1,357 @@
+package attachment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ErrInvalidImage is returned for a file that sniffs as an image but cannot
+// be read as one, so its metadata cannot be stripped.
+var ErrInvalidImage = errors.New("image is damaged or not supported")
+
+// thumbnailSizes are the bounding boxes thumbnails are rendered into. Only
+// sizes smaller than the image get a thumbnail.
+var thumbnailSizes = []int{256, 1024}
+
+// maxPixels bounds the images that get thumbnails, since decoding needs
+// four bytes per pixel.
+const maxPixels = 64 << 20
+
+// isImage reports whether contentType is an image format the pipeline
+// handles. Anything else is stored as it was uploaded.
+func isImage(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// imageInfo is what is learned about an image at upload.
+type imageInfo struct {
+	width, height int
+	orientation   int
+}
+
+// inspectImage strips location and other metadata from data and reads its
+// dimensions as displayed, after any EXIF rotation.
+func inspectImage(contentType string, data []byte) ([]byte, imageInfo, error) {
+	info := imageInfo{orientation: 1}
+
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		data, info.orientation, err = stripJPEG(data)
+	case "image/png":
+		data, err = stripPNG(data)
+	case "image/webp":
+		data, err = stripWebP(data)
+	}
+	if err != nil {
+		return nil, info, err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, info, ErrInvalidImage
+	}
+
+	info.width, info.height = cfg.Width, cfg.Height
+	if info.orientation >= 5 {
+		info.width, info.height = info.height, info.width
+	}
+	return data, info, nil
+}
+
+// thumbnailType is the format thumbnails of contentType are encoded in:
+// JPEG for photos, PNG for anything that may be transparent.
+func thumbnailType(contentType string) (string, string) {
+	if contentType == "image/jpeg" {
+		return "image/jpeg", "jpg"
+	}
+	return "image/png", "png"
+}
+
+// fit scales width x height down to fit a size x size box.
+func fit(width, height, size int) (int, int) {
+	if width >= height {
+		return size, max(1, (height*size+width/2)/width)
+	}
+	return max(1, (width*size+height/2)/height), size
+}
+
+// renderThumbnail scales src to fit a size x size box once rotated by
+// orientation, and encodes it as contentType.
+func renderThumbnail(src image.Image, orientation, size int, contentType string) ([]byte, error) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+
+	tw, th := fit(w, h, size)
+	if orientation >= 5 {
+		tw, th = th, tw
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, tw, th))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, orient(scaled, orientation), &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, orient(scaled, orientation))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// orient applies an EXIF orientation to src, returning it as it should be
+// displayed.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// stripJPEG drops EXIF, XMP, IPTC and comment segments from a JPEG. Since
+// cameras store rotation in EXIF, an orientation other than the default is
+// written back as an EXIF block holding nothing else.
+func stripJPEG(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, 0, ErrInvalidImage
+	}
+
+	orientation := 1
+	var kept [][]byte
+	rest := data[2:]
+	for {
+		// Markers may be padded with any number of 0xff fill bytes.
+		i := 0
+		for i < len(rest) && rest[i] == 0xff {
+			i++
+		}
+		if i == 0 || i >= len(rest) {
+			return nil, 0, ErrInvalidImage
+		}
+		marker := rest[i]
+		rest = rest[i+1:]
+
+		// Standalone markers carry no length.
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			kept = append(kept, []byte{0xff, marker})
+			continue
+		}
+
+		if len(rest) < 2 {
+			return nil, 0, ErrInvalidImage
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		if n < 2 || n > len(rest) {
+			return nil, 0, ErrInvalidImage
+		}
+		segment := append([]byte{0xff, marker}, rest[:n]...)
+		payload := rest[2:n]
+		rest = rest[n:]
+
+		switch {
+		case marker == 0xe1:
+			if o, ok := exifOrientation(payload); ok {
+				orientation = o
+			}
+		case marker == 0xfe, marker >= 0xe3 && marker <= 0xed, marker == 0xef:
+			// Comments and application data other than JFIF, ICC
+			// profiles and Adobe's color transform.
+		case marker == 0xda:
+			// Start of scan: everything after it is image data.
+			kept = append(kept, segment, rest)
+			return joinJPEG(kept, orientation), orientation, nil
+		default:
+			kept = append(kept, segment)
+		}
+	}
+}
+
+func joinJPEG(segments [][]byte, orientation int) []byte {
+	if orientation > 1 && orientation <= 8 {
+		// The EXIF block follows the JFIF header if there is one.
+		at := 0
+		if len(segments) > 0 && len(segments[0]) > 1 && segments[0][1] == 0xe0 {
+			at = 1
+		}
+		segments = append(segments[:at], append([][]byte{orientationSegment(orientation)}, segments[at:]...)...)
+	}
+
+	out := []byte{0xff, 0xd8}
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return out
+}
+
+// orientationSegment is an APP1 segment whose EXIF data is only an
+// orientation tag.
+func orientationSegment(orientation int) []byte {
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")
+	exif = binary.BigEndian.AppendUint16(exif, 1)      // entries
+	exif = binary.BigEndian.AppendUint16(exif, 0x0112) // orientation
+	exif = binary.BigEndian.AppendUint16(exif, 3)      // SHORT
+	exif = binary.BigEndian.AppendUint32(exif, 1)      // count
+	exif = binary.BigEndian.AppendUint16(exif, uint16(orientation))
+	exif = append(exif, 0, 0)                     // value padding
+	exif = binary.BigEndian.AppendUint32(exif, 0) // no next IFD
+
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(exif)+2))
+	return append(segment, exif...)
+}
+
+// exifOrientation reads the orientation tag from the first IFD of an APP1
+// EXIF payload.
+func exifOrientation(payload []byte) (int, bool) {
+	tiff, ok := bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			o := int(order.Uint16(tiff[e+8:]))
+			return o, o >= 1 && o <= 8
+		}
+	}
+	return 0, false
+}
+
+// stripPNG drops EXIF, text and timestamp chunks from a PNG.
+func stripPNG(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, ErrInvalidImage
+	}
+
+	out := []byte(signature)
+	rest := data[len(signature):]
+	for len(rest) >= 12 {
+		n := int(binary.BigEndian.Uint32(rest))
+		if n > len(rest)-12 {
+			return nil, ErrInvalidImage
+		}
+		chunk := rest[:n+12]
+		rest = rest[n+12:]
+
+		kind := string(chunk[4:8])
+		switch kind {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			continue
+		}
+		out = append(out, chunk...)
+		if kind == "IEND" {
+			return out, nil
+		}
+	}
+	return nil, ErrInvalidImage
+}
+
+// stripWebP drops EXIF and XMP chunks from a WebP and clears the header
+// flags announcing them.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrInvalidImage
+	}
+
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	rest := data[12:]
+	for len(rest) >= 8 {
+		n := int(binary.LittleEndian.Uint32(rest[4:]))
+		padded := n + n&1
+		if padded > len(rest)-8 {
+			// The padding byte of the last chunk is sometimes left out.
+			if n == len(rest)-8 {
+				padded = n
+			} else {
+				return nil, ErrInvalidImage
+			}
+		}
+		chunk := rest[:8+padded]
+		rest = rest[8+padded:]
+
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if n > 0 {
+				chunk = bytes.Clone(chunk)
+				chunk[8] &^= 0x08 | 0x04
+			}
+		}
+		out = append(out, chunk...)
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
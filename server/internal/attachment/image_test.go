@@ -0,0 +1,309 @@
+package attachment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// secret stands for the location and other metadata stripping must drop.
+const secret = "GPS 51.5007N 0.1246W"
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 40), uint8(y * 40), 100, 255})
+		}
+	}
+	return img
+}
+
+// exifPayload is an APP1 EXIF payload with an orientation tag (none if 0)
+// and the secret after the IFD.
+func exifPayload(order binary.AppendByteOrder, orientation int) []byte {
+	tiff := []byte("II")
+	if order == binary.BigEndian {
+		tiff = []byte("MM")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8)
+
+	entries := [][3]uint32{{0x8825, 4, 0}} // GPS IFD pointer
+	if orientation != 0 {
+		entries = append(entries, [3]uint32{0x0112, 3, uint32(orientation)})
+	}
+	tiff = order.AppendUint16(tiff, uint16(len(entries)))
+	for _, e := range entries {
+		tiff = order.AppendUint16(tiff, uint16(e[0]))
+		tiff = order.AppendUint16(tiff, uint16(e[1]))
+		tiff = order.AppendUint32(tiff, 1)
+		if e[1] == 3 {
+			tiff = order.AppendUint16(tiff, uint16(e[2]))
+			tiff = append(tiff, 0, 0)
+		} else {
+			tiff = order.AppendUint32(tiff, e[2])
+		}
+	}
+	tiff = order.AppendUint32(tiff, 0)
+	tiff = append(tiff, secret...)
+
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	s := []byte{0xff, marker}
+	s = binary.BigEndian.AppendUint16(s, uint16(len(payload)+2))
+	return append(s, payload...)
+}
+
+// testJPEG encodes a w x h JPEG and inserts segments after its SOI marker.
+func testJPEG(t *testing.T, w, h int, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	out := append([]byte{}, data[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, data[2:]...)
+}
+
+func TestInspectJPEG(t *testing.T) {
+	tests := []struct {
+		name        string
+		segments    [][]byte
+		orientation int
+		w, h        int
+	}{
+		{name: "no metadata", orientation: 1, w: 6, h: 4},
+		{
+			name:        "exif without orientation",
+			segments:    [][]byte{jpegSegment(0xe1, exifPayload(binary.LittleEndian, 0))},
+			orientation: 1, w: 6, h: 4,
+		},
+		{
+			name:        "upright",
+			segments:    [][]byte{jpegSegment(0xe1, exifPayload(binary.LittleEndian, 1))},
+			orientation: 1, w: 6, h: 4,
+		},
+		{
+			name:        "upside down, big endian",
+			segments:    [][]byte{jpegSegment(0xe1, exifPayload(binary.BigEndian, 3))},
+			orientation: 3, w: 6, h: 4,
+		},
+		{
+			name:        "rotated",
+			segments:    [][]byte{jpegSegment(0xe1, exifPayload(binary.LittleEndian, 6))},
+			orientation: 6, w: 4, h: 6,
+		},
+		{
+			name: "comment, xmp and iptc",
+			segments: [][]byte{
+				jpegSegment(0xe1, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), secret...)),
+				jpegSegment(0xed, append([]byte("Photoshop 3.0\x00"), secret...)),
+				jpegSegment(0xfe, []byte(secret)),
+				jpegSegment(0xe1, exifPayload(binary.BigEndian, 8)),
+			},
+			orientation: 8, w: 4, h: 6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, info, err := inspectImage("image/jpeg", testJPEG(t, 6, 4, tt.segments...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte(secret)) {
+				t.Error("metadata left in the image")
+			}
+			if info.orientation != tt.orientation || info.width != tt.w || info.height != tt.h {
+				t.Errorf("info = %+v, want orientation %d, %dx%d", info, tt.orientation, tt.w, tt.h)
+			}
+
+			// Only a rotation is written back, as a bare EXIF block.
+			hasExif := bytes.Contains(data, []byte("Exif\x00\x00"))
+			if hasExif != (tt.orientation > 1) {
+				t.Errorf("EXIF block kept = %v, want %v", hasExif, tt.orientation > 1)
+			}
+			if tt.orientation > 1 && !bytes.Contains(data, orientationSegment(tt.orientation)) {
+				t.Error("orientation not written back")
+			}
+
+			if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+				t.Errorf("stripped image does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    int
+		ok      bool
+	}{
+		{"little endian", exifPayload(binary.LittleEndian, 6), 6, true},
+		{"big endian", exifPayload(binary.BigEndian, 8), 8, true},
+		{"written back", orientationSegment(5)[4:], 5, true},
+		{"missing", exifPayload(binary.LittleEndian, 0), 0, false},
+		{"out of range", exifPayload(binary.LittleEndian, 9), 9, false},
+		{"not exif", []byte("http://ns.adobe.com/xap/1.0/\x00"), 0, false},
+		{"bad byte order", []byte("Exif\x00\x00XX\x00\x2a\x00\x00\x00\x08"), 0, false},
+		{"truncated", exifPayload(binary.LittleEndian, 6)[:20], 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := exifOrientation(tt.payload)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("%s: exifOrientation = %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func pngChunk(kind string, data []byte) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c = append(c, kind...)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+func TestInspectPNG(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(5, 3)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// Metadata chunks go after IHDR: signature (8) + IHDR chunk (25).
+	var in []byte
+	in = append(in, data[:33]...)
+	for _, kind := range []string{"tEXt", "zTXt", "iTXt", "eXIf"} {
+		in = append(in, pngChunk(kind, []byte("Comment\x00"+secret))...)
+	}
+	in = append(in, pngChunk("tIME", []byte{0x07, 0xe8, 5, 1, 12, 0, 0})...)
+	in = append(in, data[33:]...)
+
+	out, info, err := inspectImage("image/png", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("stripped PNG differs from the original without metadata")
+	}
+	if info.width != 5 || info.height != 3 || info.orientation != 1 {
+		t.Errorf("info = %+v, want 5x3", info)
+	}
+}
+
+func webpChunk(kind string, data []byte) []byte {
+	c := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	c = append(c, data...)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	out := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(out, body...)
+}
+
+func TestStripWebP(t *testing.T) {
+	// VP8X flags: 0x20 ICC, 0x10 alpha, 0x08 EXIF, 0x04 XMP.
+	vp8x := func(flags byte) []byte { return webpChunk("VP8X", []byte{flags, 0, 0, 0, 4, 0, 0, 2, 0, 0}) }
+	image := webpChunk("VP8L", []byte{0x2f, 1, 2, 3, 4})
+
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{name: "simple", in: riff(image), want: riff(image)},
+		{
+			name: "extended",
+			in:   riff(vp8x(0x10|0x08|0x04), image, webpChunk("EXIF", []byte(secret)), webpChunk("XMP ", []byte(secret+"!"))),
+			want: riff(vp8x(0x10), image),
+		},
+		{
+			name: "last padding byte left out",
+			in:   riff(vp8x(0x08), image, webpChunk("EXIF", []byte(secret+"!"))[:8+len(secret)+1]),
+			want: riff(vp8x(0), image),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stripWebP(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("stripWebP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInspectInvalid(t *testing.T) {
+	jpg := testJPEG(t, 4, 4)
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{"empty jpeg", "image/jpeg", nil},
+		{"not a jpeg", "image/jpeg", []byte("GIF89a")},
+		{"truncated jpeg", "image/jpeg", jpg[:20]},
+		{"jpeg segment overruns", "image/jpeg", append([]byte{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff}, secret...)},
+		{"not a png", "image/png", jpg},
+		{"png without IEND", "image/png", []byte("\x89PNG\r\n\x1a\n")},
+		{"not a webp", "image/webp", []byte("RIFF\x04\x00\x00\x00WAVE")},
+		{"webp chunk overruns", "image/webp", append(riff(), []byte("EXIF\xff\x00\x00\x00")...)},
+		{"gif that is not", "image/gif", []byte("GIF89a")},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := inspectImage(tt.contentType, tt.data); err != ErrInvalidImage {
+			t.Errorf("%s: error = %v, want ErrInvalidImage", tt.name, err)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, size   int
+		wantW, wantH int
+	}{
+		{4000, 3000, 256, 256, 192},
+		{3000, 4000, 256, 192, 256},
+		{1000, 1000, 256, 256, 256},
+		{10000, 10, 256, 256, 1},
+		{10, 10000, 1024, 1, 1024},
+		{333, 100, 256, 256, 77},
+	}
+
+	for _, tt := range tests {
+		w, h := fit(tt.w, tt.h, tt.size)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("fit(%d, %d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.size, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"discord/internal/id"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// processTimeout bounds the work on one image.
+	processTimeout = time.Minute
+
+	// sweepInterval is how often images left unprocessed, by a full queue
+	// or a node that stopped, are queued again, and unused files deleted.
+	sweepInterval = time.Minute
+)
+
+// Processed delivers the IDs of messages whose attachments just got their
+// thumbnails. Uploads not yet sent are left out, since they get them when
+// they are sent.
+func (s *Service) Processed() <-chan id.ID {
+	return s.processed
+}
+
+// enqueue asks for thumbnails of the blob with checksum. When the queue is
+// full the sweep picks it up later.
+func (s *Service) enqueue(checksum string) {
+	select {
+	case s.queue <- checksum:
+	default:
+		s.log.Warn().Str("checksum", checksum).Msg("image queue full, deferring thumbnails")
+	}
+}
+
+func (s *Service) work() {
+	for checksum := range s.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), processTimeout)
+		if err := s.process(ctx, checksum); err != nil {
+			s.log.Error().Err(err).Str("checksum", checksum).Msg("failed to make thumbnails")
+		}
+		cancel()
+	}
+}
+
+// sweep periodically queues images that have waited a while for
+// thumbnails, expires uploads that were never sent, and deletes blobs no
+// attachment uses any more. Images are processed at least once; doing one
+// twice only rewrites the same thumbnails.
+func (s *Service) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), sweepInterval)
+
+		if err := s.requeue(ctx); err != nil {
+			s.log.Error().Err(err).Msg("failed to queue unprocessed images")
+		}
+
+		const expire = `DELETE FROM attachments WHERE message_id IS NULL AND created_at < $1`
+		if _, err := s.db.ExecContext(ctx, expire, time.Now().Add(-s.cfg.UnsentTTL)); err != nil {
+			s.log.Error().Err(err).Msg("failed to expire unsent uploads")
+		}
+
+		if err := s.collect(ctx); err != nil {
+			s.log.Error().Err(err).Msg("failed to delete unused blobs")
+		}
+
+		cancel()
+	}
+}
+
+func (s *Service) requeue(ctx context.Context) error {
+	const q = `
+        SELECT checksum FROM blobs
+        WHERE width IS NOT NULL AND thumbnail_sizes IS NULL
+          AND created_at < $1
+        ORDER BY created_at
+        LIMIT 100`
+
+	rows, err := s.db.QueryContext(ctx, q, time.Now().Add(-sweepInterval))
+	if err != nil {
+		return fmt.Errorf("failed to list unprocessed images: %w", err)
+	}
+	defer rows.Close()
+
+	var pending []string
+	for rows.Next() {
+		var checksum string
+		if err := rows.Scan(&checksum); err != nil {
+			return fmt.Errorf("failed to scan unprocessed image: %w", err)
+		}
+		pending = append(pending, checksum)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating unprocessed images: %w", err)
+	}
+
+	for _, checksum := range pending {
+		s.enqueue(checksum)
+	}
+	return nil
+}
+
+// collect deletes blobs that no attachment uses, with their thumbnails.
+// The rows stay locked until their files are gone, so an upload of the
+// same content waits and then stores it afresh.
+func (s *Service) collect(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	const q = `
+        SELECT checksum, storage_key, thumbnail_sizes FROM blobs
+        WHERE ref_count = 0
+        LIMIT 100
+        FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.QueryContext(ctx, q)
+	if err != nil {
+		return fmt.Errorf("failed to list unused blobs: %w", err)
+	}
+
+	type blob struct {
+		checksum, key string
+		sizes         []int64
+	}
+	var unused []blob
+	for rows.Next() {
+		var b blob
+		if err := rows.Scan(&b.checksum, &b.key, pq.Array(&b.sizes)); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan unused blob: %w", err)
+		}
+		unused = append(unused, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating unused blobs: %w", err)
+	}
+
+	var deleted []string
+	for _, b := range unused {
+		keys := []string{b.key}
+		for _, size := range b.sizes {
+			keys = append(keys, thumbnailKey(b.checksum, int(size)))
+		}
+
+		ok := true
+		for _, key := range keys {
+			if err := s.store.Delete(ctx, key); err != nil {
+				s.log.Error().Err(err).Str("key", key).Msg("failed to delete blob")
+				ok = false
+			}
+		}
+		if ok {
+			deleted = append(deleted, b.checksum)
+		}
+	}
+
+	if len(deleted) == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blobs WHERE checksum = ANY($1)`, pq.Array(deleted)); err != nil {
+		return fmt.Errorf("failed to delete blobs: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// process makes the thumbnails of an image blob and records them. Images
+// that cannot be decoded, or are too large to, get none.
+func (s *Service) process(ctx context.Context, checksum string) error {
+	const find = `
+        SELECT content_type, storage_key, width, height FROM blobs
+        WHERE checksum = $1 AND width IS NOT NULL AND thumbnail_sizes IS NULL`
+
+	var contentType, key string
+	var width, height int
+	err := s.db.QueryRowContext(ctx, find, checksum).Scan(&contentType, &key, &width, &height)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("get blob: %w", err)
+	}
+
+	sizes, err := s.renderThumbnails(ctx, checksum, key, contentType, width, height)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, `UPDATE blobs SET thumbnail_sizes = $2 WHERE checksum = $1 AND thumbnail_sizes IS NULL`,
+		checksum, pq.Array(sizes))
+	if err != nil {
+		return fmt.Errorf("failed to record thumbnails: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 || len(sizes) == 0 {
+		return err
+	}
+
+	const sent = `
+        SELECT DISTINCT message_id FROM attachments
+        WHERE checksum = $1 AND message_id IS NOT NULL`
+
+	rows, err := s.db.QueryContext(ctx, sent, checksum)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID id.ID
+		if err := rows.Scan(&messageID); err != nil {
+			return fmt.Errorf("failed to scan message: %w", err)
+		}
+		select {
+		case s.processed <- messageID:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rows.Err()
+}
+
+// renderThumbnails stores a thumbnail of an image for each size smaller
+// than it, and returns those sizes.
+func (s *Service) renderThumbnails(ctx context.Context, checksum, key, contentType string, width, height int) ([]int64, error) {
+	sizes := []int64{}
+	if int64(width)*int64(height) > maxPixels {
+		return sizes, nil
+	}
+
+	body, err := s.store.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("open image: %w", err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read image: %w", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		s.log.Warn().Err(err).Str("checksum", checksum).Msg("cannot decode image for thumbnails")
+		return sizes, nil
+	}
+
+	orientation := 1
+	if contentType == "image/jpeg" {
+		if _, o, err := stripJPEG(data); err == nil {
+			orientation = o
+		}
+	}
+
+	thumbType, _ := thumbnailType(contentType)
+	for _, size := range thumbnailSizes {
+		if max(width, height) <= size {
+			continue
+		}
+
+		thumb, err := renderThumbnail(img, orientation, size, thumbType)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.store.Put(ctx, thumbnailKey(checksum, size), bytes.NewReader(thumb), int64(len(thumb)), thumbType); err != nil {
+			return nil, fmt.Errorf("store thumbnail: %w", err)
+		}
+		sizes = append(sizes, int64(size))
+	}
+	return sizes, nil
+}
+
+func thumbnailKey(checksum string, size int) string {
+	return "thumbnails/" + checksum + "_" + strconv.Itoa(size)
+}
@@ -10,7 +10,7 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -40,8 +40,8 @@ type LoginRequest struct {
 // @Router /auth/login [post]
 type RegisterRequest struct {
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8"`
-	Username string `json:"username" validate:"required,min=3,max=30"`
+	Password string `json:"password" validate:"required,min=8,password"`
+	Username string `json:"username" validate:"required,min=3,max=30,username"`
 }
 
 type AuthResponse struct {
@@ -49,6 +49,7 @@ type AuthResponse struct {
 	User  *user.User `json:"user"`
 }
 
+// Claims identify the user and, through the JWT ID, their session.
 type Claims struct {
 	UserID string `json:"user_id"`
 	jwt.RegisteredClaims
@@ -56,40 +57,44 @@ type Claims struct {
 
 type Service struct {
 	userService *user.Service
+	redis       *redis.Client
 	key         []byte
 	log         *zerolog.Logger
 }
 
+// Tokens, and the sessions backing them, live this long.
+const tokenDuration = 24 * time.Hour
+
 var (
 	ErrInvalidCredentials     = errors.New("invalid email or password")
-	ErrUserExistsWithEmail    = errors.New("user with this email already exists")
-	ErrUserExistsWithUsername = errors.New("user with this username already exists")
+	ErrUserExistsWithEmail    = user.ErrEmailTaken
+	ErrUserExistsWithUsername = user.ErrUsernameTaken
 	ErrInvalidToken           = errors.New("invalid or expired token")
 )
 
-func isPgUniqueViolation(err error) bool {
-	pgErr, ok := err.(*pq.Error)
-	return ok && pgErr.Code == "23505" // unique_violation
-}
-
-func isEmailConstraint(err error) bool {
-	pgErr, ok := err.(*pq.Error)
-	return ok && pgErr.Constraint == "users_email_key"
-}
-
-func isUsernameConstraint(err error) bool {
-	pgErr, ok := err.(*pq.Error)
-	return ok && pgErr.Constraint == "users_username_key"
-}
-
-func NewService(userService *user.Service, jwtKey []byte, log *zerolog.Logger) *Service {
+func NewService(userService *user.Service, redis *redis.Client, jwtKey []byte, log *zerolog.Logger) *Service {
 	return &Service{
 		userService: userService,
+		redis:       redis,
 		key:         jwtKey,
 		log:         log,
 	}
 }
 
+// HashPassword hashes a password for storage.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password matches the stored hash.
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
 func (s *Service) Login(ctx context.Context, req LoginRequest) (*AuthResponse, error) {
 	user, err := s.userService.GetByEmail(ctx, req.Email)
 	if err != nil {
@@ -99,14 +104,11 @@ func (s *Service) Login(ctx context.Context, req LoginRequest) (*AuthResponse, e
 		return nil, fmt.Errorf("get user: %w", err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword(
-		[]byte(user.PasswordHash),
-		[]byte(req.Password),
-	); err != nil {
+	if !CheckPassword(user.PasswordHash, req.Password) {
 		return nil, ErrInvalidCredentials
 	}
 
-	token, err := s.createToken(user.ID)
+	token, err := s.createToken(ctx, user.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create token: %w", err)
 	}
@@ -118,7 +120,7 @@ func (s *Service) Login(ctx context.Context, req LoginRequest) (*AuthResponse, e
 }
 
 func (s *Service) Register(ctx context.Context, req RegisterRequest) (*AuthResponse, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := HashPassword(req.Password)
 	if err != nil {
 		return nil, fmt.Errorf("hash password: %w", err)
 	}
@@ -127,24 +129,19 @@ func (s *Service) Register(ctx context.Context, req RegisterRequest) (*AuthRespo
 		ID:           uuid.New().String(),
 		Email:        req.Email,
 		Username:     req.Username,
-		PasswordHash: string(hash),
+		PasswordHash: hash,
 		CreatedAt:    time.Now(),
 		UpdatedAt:    time.Now(),
 	}
 
 	if err := s.userService.Create(ctx, user); err != nil {
-		if isPgUniqueViolation(err) {
-			if isEmailConstraint(err) {
-				return nil, ErrUserExistsWithEmail
-			}
-			if isUsernameConstraint(err) {
-				return nil, ErrUserExistsWithUsername
-			}
+		if err == ErrUserExistsWithEmail || err == ErrUserExistsWithUsername {
+			return nil, err
 		}
 		return nil, fmt.Errorf("create user: %w", err)
 	}
 
-	token, err := s.createToken(user.ID)
+	token, err := s.createToken(ctx, user.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create token: %w", err)
 	}
@@ -155,7 +152,9 @@ func (s *Service) Register(ctx context.Context, req RegisterRequest) (*AuthRespo
 	}, nil
 }
 
-func (s *Service) VerifyToken(token string) (string, error) {
+// VerifyToken checks the token's signature and that its session has not
+// been revoked.
+func (s *Service) VerifyToken(ctx context.Context, token string) (*Claims, error) {
 	claims := &Claims{}
 
 	tkn, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
@@ -166,23 +165,38 @@ func (s *Service) VerifyToken(token string) (string, error) {
 	})
 	if err != nil {
 		if err == jwt.ErrSignatureInvalid {
-			return "", ErrInvalidToken
+			return nil, ErrInvalidToken
 		}
-		return "", fmt.Errorf("parse token: %w", err)
+		return nil, fmt.Errorf("parse token: %w", err)
+	}
+
+	if !tkn.Valid || claims.ID == "" {
+		return nil, ErrInvalidToken
 	}
 
-	if !tkn.Valid {
-		return "", ErrInvalidToken
+	active, err := s.sessionActive(ctx, claims.ID)
+	if err != nil {
+		return nil, fmt.Errorf("check session: %w", err)
+	}
+	if !active {
+		return nil, ErrInvalidToken
 	}
 
-	return claims.UserID, nil
+	return claims, nil
 }
 
-func (s *Service) createToken(userID string) (string, error) {
+// createToken starts a new session for the user and returns a token for it.
+func (s *Service) createToken(ctx context.Context, userID string) (string, error) {
+	sessionID := uuid.New().String()
+	if err := s.startSession(ctx, userID, sessionID); err != nil {
+		return "", fmt.Errorf("start session: %w", err)
+	}
+
 	claims := &Claims{
 		UserID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ID:        sessionID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenDuration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
@@ -1,25 +1,26 @@
 package auth
 
 import (
+	"discord/internal/http/response"
+	"discord/internal/validation"
 	"encoding/json"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-playground/validator/v10"
 	"github.com/rs/zerolog"
 )
 
 type Handler struct {
 	svc      *Service
 	log      *zerolog.Logger
-	validate *validator.Validate
+	validate *validation.Validator
 }
 
-func NewHandler(svc *Service, log *zerolog.Logger) *Handler {
+func NewHandler(svc *Service, validate *validation.Validator, log *zerolog.Logger) *Handler {
 	return &Handler{
 		svc:      svc,
 		log:      log,
-		validate: validator.New(),
+		validate: validate,
 	}
 }
 
@@ -39,18 +40,19 @@ func (h *Handler) Routes() chi.Router {
 // @Produce json
 // @Param request body RegisterRequest true "Registration credentials"
 // @Success 200 {object} AuthResponse
-// @Failure 400 {string} string "Invalid request"
-// @Failure 409 {string} string "User already exists"
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 409 {object} response.Problem "User already exists"
+// @Failure 500 {object} response.Problem "Internal server error"
 // @Router /auth/register [post]
 func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
 		return
 	}
 
-	if err := h.validate.Struct(req); err != nil {
-		http.Error(w, "validation failed", http.StatusBadRequest)
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
 		return
 	}
 
@@ -58,12 +60,12 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		switch err {
 		case ErrUserExistsWithEmail:
-			http.Error(w, err.Error(), http.StatusConflict)
+			response.Render(w, r, response.ErrConflict(response.CodeEmailTaken, err.Error()))
 		case ErrUserExistsWithUsername:
-			http.Error(w, err.Error(), http.StatusConflict)
+			response.Render(w, r, response.ErrConflict(response.CodeUsernameTaken, err.Error()))
 		default:
 			h.log.Error().Err(err).Msg("registration failed")
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			response.Render(w, r, response.ErrInternal())
 		}
 		return
 	}
@@ -79,18 +81,19 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Param request body LoginRequest true "Login credentials"
 // @Success 200 {object} AuthResponse
-// @Failure 400 {string} string "Invalid request"
-// @Failure 401 {string} string "Invalid credentials"
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Invalid credentials"
+// @Failure 500 {object} response.Problem "Internal server error"
 // @Router /auth/login [post]
 func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
 		return
 	}
 
-	if err := h.validate.Struct(req); err != nil {
-		http.Error(w, "validation failed", http.StatusBadRequest)
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
 		return
 	}
 
@@ -98,10 +101,10 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		switch err {
 		case ErrInvalidCredentials:
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			response.Render(w, r, response.ErrInvalidCredentials())
 		default:
 			h.log.Error().Err(err).Msg("login failed")
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			response.Render(w, r, response.ErrInternal())
 		}
 		return
 	}
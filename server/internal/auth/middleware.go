@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"discord/internal/http/response"
 	"net/http"
 	"strings"
 	"time"
@@ -12,38 +13,66 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// webSocketPath is the one route that also takes its token from
+// Sec-WebSocket-Protocol, since browsers cannot set headers on a websocket.
+const webSocketPath = "/api/chat/ws"
+
+// WebSocketProtocol is the subprotocol a websocket client offers ahead of
+// its token, as in "Sec-WebSocket-Protocol: bearer, <token>".
+const WebSocketProtocol = "bearer"
+
 func (s *Service) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" && r.URL.Path == webSocketPath {
+			authHeader = webSocketAuthorization(r)
+		}
 		if authHeader == "" {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			response.Render(w, r, response.ErrUnauthorized("missing authorization header"))
 			return
 		}
 
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "invalid authorization header", http.StatusUnauthorized)
+			response.Render(w, r, response.ErrUnauthorized("invalid authorization header"))
 			return
 		}
 
-		userID, err := s.VerifyToken(parts[1])
+		claims, err := s.VerifyToken(r.Context(), parts[1])
 		if err != nil {
 			s.log.Print("Failed to verify token")
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			response.Render(w, r, response.ErrUnauthorized("invalid or expired token"))
 			return
 		}
 
-		parsedID, err := uuid.Parse(userID)
+		parsedID, err := uuid.Parse(claims.UserID)
 		if err != nil {
-			http.Error(w, "invalid user id", http.StatusInternalServerError)
+			s.log.Error().Err(err).Msg("token carries an invalid user id")
+			response.Render(w, r, response.ErrInternal())
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "userID", parsedID)
+		ctx = context.WithValue(ctx, "sessionID", claims.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// webSocketAuthorization turns the protocols "bearer, <token>" into a
+// bearer Authorization value, or returns "" if they are anything else.
+func webSocketAuthorization(r *http.Request) string {
+	var protocols []string
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			protocols = append(protocols, strings.TrimSpace(p))
+		}
+	}
+	if len(protocols) != 2 || protocols[0] != WebSocketProtocol {
+		return ""
+	}
+	return "Bearer " + protocols[1]
+}
+
 func RequestLogger(log *zerolog.Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebSocketAuthorization(t *testing.T) {
+	tests := []struct {
+		protocols []string
+		want      string
+	}{
+		{nil, ""},
+		{[]string{"bearer, abc.def.ghi"}, "Bearer abc.def.ghi"},
+		{[]string{"bearer,abc.def.ghi"}, "Bearer abc.def.ghi"},
+		{[]string{"bearer", "abc.def.ghi"}, "Bearer abc.def.ghi"},
+		{[]string{"bearer"}, ""},
+		{[]string{"abc.def.ghi"}, ""},
+		{[]string{"abc.def.ghi, bearer"}, ""},
+		{[]string{"bearer, abc, def"}, ""},
+		{[]string{"chat, abc.def.ghi"}, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", webSocketPath, nil)
+		for _, p := range tt.protocols {
+			r.Header.Add("Sec-WebSocket-Protocol", p)
+		}
+		if got := webSocketAuthorization(r); got != tt.want {
+			t.Errorf("webSocketAuthorization(%q) = %q, want %q", tt.protocols, got, tt.want)
+		}
+	}
+}
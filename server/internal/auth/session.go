@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+)
+
+// Sessions are kept in Redis so they can be revoked before their token
+// expires. session:{id} holds the owning user, and user:{id}:sessions
+// indexes a user's sessions for bulk revocation.
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+func userSessionsKey(userID string) string {
+	return fmt.Sprintf("user:%s:sessions", userID)
+}
+
+func (s *Service) startSession(ctx context.Context, userID, sessionID string) error {
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, sessionKey(sessionID), userID, tokenDuration)
+	pipe.SAdd(ctx, userSessionsKey(userID), sessionID)
+	pipe.Expire(ctx, userSessionsKey(userID), tokenDuration)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *Service) sessionActive(ctx context.Context, sessionID string) (bool, error) {
+	n, err := s.redis.Exists(ctx, sessionKey(sessionID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// RevokeOtherSessions signs the user out everywhere except keepSessionID.
+func (s *Service) RevokeOtherSessions(ctx context.Context, userID, keepSessionID string) error {
+	ids, err := s.redis.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return fmt.Errorf("list sessions: %w", err)
+	}
+
+	pipe := s.redis.TxPipeline()
+	for _, id := range ids {
+		if id == keepSessionID {
+			continue
+		}
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userSessionsKey(userID), id)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -3,93 +3,305 @@ package chat
 import (
 	"context"
 	"database/sql"
+	"discord/internal/attachment"
+	"discord/internal/event"
+	"discord/internal/id"
+	"discord/internal/presence"
+	"discord/internal/ratelimit"
+	"discord/internal/relationship"
+	"discord/internal/search"
+	"discord/internal/settings"
+	"discord/internal/user"
+	"discord/internal/validation"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 )
 
 type Message struct {
-	ID        uuid.UUID `json:"id" db:"id"`
-	FromID    uuid.UUID `json:"fromId" db:"from_id"`
-	ToID      uuid.UUID `json:"toId" db:"to_id"`
-	Content   string    `json:"content" db:"content"`
-	CreatedAt time.Time `json:"createdAt" db:"created_at"`
-	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+	ID        id.ID       `json:"id" db:"id" swaggertype:"string" example:"1234567890123456789"`
+	Type      MessageType `json:"type" db:"type" enums:"0,1,2,3,6,7,18,19"`
+	FromID    uuid.UUID   `json:"fromId" db:"from_id"`
+	ToID      uuid.UUID   `json:"toId" db:"to_id"`
+	Content   string      `json:"content" db:"content"`
+	CreatedAt time.Time   `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time   `json:"updatedAt" db:"updated_at"`
+
+	// ReferencedMessageID is the message this one replies to, always from
+	// the same conversation. ReferencedMessage quotes it, and is left out
+	// once it has been deleted.
+	ReferencedMessageID *id.ID             `json:"referencedMessageId,omitempty" db:"referenced_message_id" swaggertype:"string"`
+	ReferencedMessage   *ReferencedMessage `json:"referencedMessage,omitempty" db:"-"`
+
+	// Attachments are the files sent with the message, with download links
+	// that expire.
+	Attachments []attachment.Attachment `json:"attachments,omitempty" db:"-"`
+
+	// Mentions are the users the message mentions. MentionRoles are the
+	// roles it mentions, and MentionEveryone is set by @everyone or @here.
+	Mentions        []user.Profile `json:"mentions,omitempty" db:"-"`
+	MentionRoles    []id.ID        `json:"mentionRoles,omitempty" db:"mention_role_ids" swaggertype:"array,string"`
+	MentionEveryone bool           `json:"mentionEveryone,omitempty" db:"mention_everyone"`
+
+	// Reactions are aggregated per emoji, in the order they were first
+	// added.
+	Reactions []Reaction `json:"reactions,omitempty" db:"-"`
+
+	// Payload describes what a system message records, in a shape that
+	// depends on its type. User messages have none.
+	Payload json.RawMessage `json:"payload,omitempty" db:"payload" swaggertype:"object"`
+
+	// Pinned is set on messages pinned in their conversation.
+	Pinned bool `json:"pinned" db:"-"`
+
+	// Nonce is an optional client-chosen value echoed back to the sender's
+	// sessions so the one that sent the message can match it up. It is not
+	// stored.
+	Nonce string `json:"nonce,omitempty" db:"-"`
+
+	// Blocked marks a message from a user the reader has blocked. Its
+	// content is withheld so clients can show it collapsed.
+	Blocked bool `json:"blocked,omitempty" db:"-"`
+
+	// Suppressed messages were sent to someone who had blocked the sender.
+	// Only the sender ever sees them.
+	Suppressed bool `json:"-" db:"suppressed"`
+
+	// attachmentIDs are the uploads to send with a new message.
+	attachmentIDs []id.ID
 }
 
 type Service struct {
-	db    *sql.DB
-	redis *redis.Client
-	log   *zerolog.Logger
-	hub   *Hub
+	db            *sql.DB
+	redis         *redis.Client
+	ids           *id.Generator
+	events        *event.Publisher
+	userService   *user.Service
+	relationships *relationship.Service
+	settings      *settings.Service
+	attachments   *attachment.Service
+	index         search.SearchIndex
+	validate      *validation.Validator
+	log           *zerolog.Logger
+	hub           *Hub
 }
 
-func NewService(db *sql.DB, redis *redis.Client, log *zerolog.Logger) *Service {
+// ErrDMNotAllowed is returned when the recipient's privacy settings do not
+// let the sender start a conversation with them.
+var ErrDMNotAllowed = errors.New("this user is not accepting direct messages from you")
+
+func NewService(
+	db *sql.DB,
+	redis *redis.Client,
+	ids *id.Generator,
+	events *event.Publisher,
+	userService *user.Service,
+	relationships *relationship.Service,
+	settings *settings.Service,
+	attachments *attachment.Service,
+	index search.SearchIndex,
+	presence *presence.Service,
+	limiter *ratelimit.Limiter,
+	validate *validation.Validator,
+	log *zerolog.Logger,
+) *Service {
 	svc := &Service{
-		db:    db,
-		redis: redis,
-		log:   log,
+		db:            db,
+		redis:         redis,
+		ids:           ids,
+		events:        events,
+		userService:   userService,
+		relationships: relationships,
+		settings:      settings,
+		attachments:   attachments,
+		index:         index,
+		validate:      validate,
+		log:           log,
 	}
 
-	svc.hub = NewHub(redis, log)
+	svc.hub = NewHub(redis, limiter, presence, log)
+	svc.hub.handle(OpTypingStart, svc.handleTypingStart)
+	svc.hub.handle(OpMessageAck, svc.handleAck)
+	svc.hub.handle(OpSendMessage, svc.handleSendMessage)
 	go svc.hub.Run()
+	go svc.watchAttachments()
 
 	return svc
 }
 
-func (s *Service) SendMessage(ctx context.Context, msg *Message) error {
-	msg.CreatedAt = time.Now()
+// send assigns msg an ID, stores it and delivers it to the recipient. If the recipient has
+// blocked the sender, the message is stored for the sender only and
+// nothing tells the sender it was not delivered. A first message from
+// someone who is not a friend lands among the recipient's message requests,
+// if their DM policy allows it at all.
+func (s *Service) send(ctx context.Context, msg *Message) error {
+	if err := s.resolveReference(ctx, msg); err != nil {
+		return err
+	}
+
+	if msg.Type == MessageTypeDefault && msg.ReferencedMessageID != nil {
+		msg.Type = MessageTypeReply
+	}
+
+	if err := s.resolveMentions(ctx, msg); err != nil {
+		return err
+	}
+
+	msg.ID = s.ids.Next()
+	msg.CreatedAt = msg.ID.Time()
 	msg.UpdatedAt = msg.CreatedAt
 
+	blocked, err := s.relationships.HasBlocked(ctx, msg.ToID, msg.FromID)
+	if err != nil {
+		return fmt.Errorf("check block: %w", err)
+	}
+	msg.Suppressed = blocked
+
+	var state string
+	if !msg.Suppressed {
+		state, err = s.recipientState(ctx, msg.FromID, msg.ToID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A recipient who ignores the sender's requests is not told about
+	// mentions either. The message records whether it counted, so the
+	// count can be redone when the recipient reads.
+	mentionsRecipient := !msg.Suppressed && state != StateIgnored && msg.mentions(msg.ToID)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	const q = `
-        INSERT INTO messages (id, from_id, to_id, content, created_at, updated_at)
-        VALUES ($1, $2, $3, $4, $5, $6)
+        INSERT INTO messages (id, type, from_id, to_id, content, created_at, updated_at, suppressed, referenced_message_id, payload,
+            mention_user_ids, mention_role_ids, mention_everyone, mentions_recipient)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
         RETURNING id, created_at, updated_at`
 
-	err := s.db.QueryRowContext(ctx, q,
+	mentionUsers := make([]string, len(msg.Mentions))
+	for i, p := range msg.Mentions {
+		mentionUsers[i] = p.ID
+	}
+	mentionRoles := make([]int64, len(msg.MentionRoles))
+	for i, r := range msg.MentionRoles {
+		mentionRoles[i] = int64(r)
+	}
+
+	err = tx.QueryRowContext(ctx, q,
 		msg.ID,
+		msg.Type,
 		msg.FromID,
 		msg.ToID,
 		msg.Content,
 		msg.CreatedAt,
 		msg.UpdatedAt,
+		msg.Suppressed,
+		msg.ReferencedMessageID,
+		nullJSON(msg.Payload),
+		pq.Array(mentionUsers),
+		pq.Array(mentionRoles),
+		msg.MentionEveryone,
+		mentionsRecipient,
 	).Scan(&msg.ID, &msg.CreatedAt, &msg.UpdatedAt)
 	if err != nil {
 		return fmt.Errorf("failed to store message: %w", err)
 	}
 
-	channel := fmt.Sprintf("user:%s:messages", msg.ToID.String())
+	if len(msg.attachmentIDs) > 0 {
+		msg.Attachments, err = s.attachments.Link(ctx, tx, msg.FromID, msg.ID, msg.attachmentIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := touchConversations(ctx, tx, msg, state); err != nil {
+		return err
+	}
 
-	if err := s.redis.Publish(ctx, channel, msg).Err(); err != nil {
+	if mentionsRecipient {
+		if err := addMention(ctx, tx, msg.ToID, msg.FromID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	s.indexMessage(ctx, msg)
+
+	// Every one of the sender's sessions gets the message, the sending one
+	// included; it matches the nonce to its pending copy.
+	if err := s.events.Publish(ctx, msg.FromID, event.MessageCreate, msg); err != nil {
 		s.log.Error().Err(err).
-			Str("channel", channel).
+			Str("fromId", msg.FromID.String()).
+			Msg("failed to publish message to sender")
+	}
+
+	if msg.Suppressed {
+		s.log.Debug().
 			Str("fromId", msg.FromID.String()).
 			Str("toId", msg.ToID.String()).
-			Msg("failed to publish message to redis")
-	} else {
-		s.log.Info().
-			Str("channel", channel).
+			Msg("message suppressed by recipient block")
+		return nil
+	}
+
+	eventType := event.MessageCreate
+	switch state {
+	case StateRequest:
+		eventType = event.MessageRequestCreate
+	case StateIgnored:
+		return nil
+	}
+
+	// The nonce only means something to the sender's sessions.
+	delivered := *msg
+	delivered.Nonce = ""
+	delivered.ReferencedMessage = referenceFor(msg.ReferencedMessage, msg.ToID)
+
+	if err := s.events.Publish(ctx, msg.ToID, eventType, &delivered); err != nil {
+		s.log.Error().Err(err).
 			Str("fromId", msg.FromID.String()).
 			Str("toId", msg.ToID.String()).
-			Msg("message published to redis")
+			Msg("failed to publish message")
 	}
 
 	return nil
 }
 
-func (s *Service) GetMessages(ctx context.Context, userID1, userID2 uuid.UUID, limit int) ([]Message, error) {
+// GetMessages returns the latest messages between userID1 and userID2, as
+// userID1 sees them: messages userID1 never received are left out, and
+// those from a user userID1 has blocked are collapsed, in replies' quotes
+// too. A non-zero before only returns messages older than that ID.
+func (s *Service) GetMessages(ctx context.Context, userID1, userID2 uuid.UUID, before id.ID, limit int) ([]Message, error) {
+	blocked, err := s.relationships.HasBlocked(ctx, userID1, userID2)
+	if err != nil {
+		return nil, fmt.Errorf("check block: %w", err)
+	}
+
 	const q = `
-        SELECT id, from_id, to_id, content, created_at, updated_at
-        FROM messages
-        WHERE (from_id = $1 AND to_id = $2) OR (from_id = $2 AND to_id = $1)
-        ORDER BY created_at DESC
-        LIMIT $3`
+        SELECT m.id, m.type, m.from_id, m.to_id, m.content, m.created_at, m.updated_at, m.suppressed,
+            EXISTS (SELECT 1 FROM message_pins p WHERE p.message_id = m.id),
+            m.referenced_message_id, m.payload, r.id, r.from_id, r.content, r.created_at
+        FROM messages m
+        LEFT JOIN messages r ON r.id = m.referenced_message_id AND NOT (r.suppressed AND r.to_id = $1)
+        WHERE ((m.from_id = $1 AND m.to_id = $2) OR (m.from_id = $2 AND m.to_id = $1))
+          AND NOT (m.suppressed AND m.to_id = $1)
+          AND ($3::bigint = 0 OR m.id < $3)
+        ORDER BY m.id DESC
+        LIMIT $4`
 
-	rows, err := s.db.QueryContext(ctx, q, userID1, userID2, limit)
+	rows, err := s.db.QueryContext(ctx, q, userID1, userID2, before, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query messages: %w", err)
 	}
@@ -98,16 +310,50 @@ func (s *Service) GetMessages(ctx context.Context, userID1, userID2 uuid.UUID, l
 	var messages []Message
 	for rows.Next() {
 		var msg Message
+		var (
+			payload      []byte
+			refID        sql.NullInt64
+			refFromID    uuid.NullUUID
+			refContent   sql.NullString
+			refCreatedAt sql.NullTime
+		)
 		if err := rows.Scan(
 			&msg.ID,
+			&msg.Type,
 			&msg.FromID,
 			&msg.ToID,
 			&msg.Content,
 			&msg.CreatedAt,
 			&msg.UpdatedAt,
+			&msg.Suppressed,
+			&msg.Pinned,
+			&msg.ReferencedMessageID,
+			&payload,
+			&refID,
+			&refFromID,
+			&refContent,
+			&refCreatedAt,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan message: %w", err)
 		}
+		msg.Payload = payload
+		if blocked && msg.FromID == userID2 {
+			msg.Content = ""
+			msg.Blocked = true
+		}
+		if refID.Valid {
+			ref := &ReferencedMessage{
+				ID:        id.ID(refID.Int64),
+				FromID:    refFromID.UUID,
+				Content:   snippet(refContent.String),
+				CreatedAt: refCreatedAt.Time,
+			}
+			if blocked && ref.FromID == userID2 {
+				ref.Content = ""
+				ref.Blocked = true
+			}
+			msg.ReferencedMessage = ref
+		}
 		messages = append(messages, msg)
 	}
 
@@ -115,9 +361,39 @@ func (s *Service) GetMessages(ctx context.Context, userID1, userID2 uuid.UUID, l
 		return nil, fmt.Errorf("error iterating messages: %w", err)
 	}
 
+	if err := s.attachFiles(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := s.attachMentions(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := s.attachReactions(ctx, userID1, messages); err != nil {
+		return nil, err
+	}
+
 	return messages, nil
 }
 
+// attachFiles fills in the attachments of messages, except those whose
+// content is withheld because the reader blocked the sender.
+func (s *Service) attachFiles(ctx context.Context, messages []Message) error {
+	ids := make([]id.ID, 0, len(messages))
+	for _, m := range messages {
+		if !m.Blocked {
+			ids = append(ids, m.ID)
+		}
+	}
+
+	files, err := s.attachments.ForMessages(ctx, ids)
+	if err != nil {
+		return fmt.Errorf("get attachments: %w", err)
+	}
+	for i := range messages {
+		messages[i].Attachments = files[messages[i].ID]
+	}
+	return nil
+}
+
 func (m *Message) MarshalBinary() ([]byte, error) {
 	return json.Marshal(m)
 }
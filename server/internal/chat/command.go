@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"context"
+	"discord/internal/attachment"
+	"discord/internal/event"
+	"discord/internal/id"
+	"discord/internal/ratelimit"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// Ops a client may send over the websocket.
+const (
+	OpTypingStart = "TYPING_START"
+	OpMessageAck  = "MESSAGE_ACK"
+	OpSendMessage = "SEND_MESSAGE"
+)
+
+// errorEvent is sent back to a client whose command failed.
+const errorEvent = "ERROR"
+
+var errUnknownOp = errors.New("unknown op")
+
+// Command is a frame sent by a client over the websocket.
+type Command struct {
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+}
+
+// CommandError tells a client why its command failed.
+type CommandError struct {
+	Op     string `json:"op"`
+	Detail string `json:"detail"`
+}
+
+// commandError is a failure the client caused and may be told about. Any
+// other error from a command handler is logged and reported as internal.
+type commandError struct {
+	detail string
+}
+
+func (e *commandError) Error() string {
+	return e.detail
+}
+
+// commandHandler runs one kind of command for the user who sent it.
+type commandHandler func(ctx context.Context, userID uuid.UUID, data json.RawMessage) error
+
+// TypingStartCommand is the data of a TYPING_START command.
+type TypingStartCommand struct {
+	UserID string `json:"userId"`
+}
+
+func (s *Service) handleTypingStart(ctx context.Context, userID uuid.UUID, data json.RawMessage) error {
+	var cmd TypingStartCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return &commandError{"invalid data"}
+	}
+
+	peerID, err := uuid.Parse(cmd.UserID)
+	if err != nil {
+		return &commandError{"invalid user id"}
+	}
+
+	if err := s.StartTyping(ctx, userID, peerID); err != nil {
+		if errors.Is(err, ErrTypingToSelf) {
+			return &commandError{err.Error()}
+		}
+		return err
+	}
+	return nil
+}
+
+// SendMessageCommand is the data of a SEND_MESSAGE command. It has the
+// fields and rules of the HTTP send. The nonce is also its idempotency key,
+// so a client resending after a dropped connection does not post the
+// message twice.
+type SendMessageCommand SendMessageRequest
+
+// handleSendMessage sends a message over the websocket. The result reaches
+// the client as the MESSAGE_CREATE echo, which carries the nonce.
+func (s *Service) handleSendMessage(ctx context.Context, userID uuid.UUID, data json.RawMessage) error {
+	var cmd SendMessageCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return &commandError{"invalid data"}
+	}
+
+	if err := s.validate.Err(cmd); err != nil {
+		return &commandError{err.Error()}
+	}
+
+	toID, err := uuid.Parse(cmd.ToID)
+	if err != nil {
+		return &commandError{"invalid recipient id"}
+	}
+
+	// Websocket sends count against the same limit as the HTTP endpoint.
+	res, err := s.hub.limiter.Allow(ctx, ratelimit.GroupMessages, "user:"+userID.String())
+	if err != nil {
+		return err
+	}
+	if !res.Allowed {
+		return &commandError{"rate limit exceeded"}
+	}
+
+	msg := &Message{
+		Type:    cmd.Type,
+		FromID:  userID,
+		ToID:    toID,
+		Content: cmd.Content,
+		Nonce:   cmd.Nonce,
+	}
+
+	if cmd.ReferencedMessageID != "" {
+		ref, err := id.Parse(cmd.ReferencedMessageID)
+		if err != nil {
+			return &commandError{"invalid referenced message id"}
+		}
+		msg.ReferencedMessageID = &ref
+	}
+
+	for _, v := range cmd.AttachmentIDs {
+		attachmentID, err := id.Parse(v)
+		if err != nil {
+			return &commandError{"invalid attachment id"}
+		}
+		msg.attachmentIDs = append(msg.attachmentIDs, attachmentID)
+	}
+
+	replayed, err := s.SendMessage(ctx, msg, cmd.Nonce)
+	if err != nil {
+		if errors.Is(err, ErrDMNotAllowed) || errors.Is(err, ErrReferenceNotFound) ||
+			errors.Is(err, ErrSystemMessage) || errors.Is(err, ErrEmptyMessage) ||
+			errors.Is(err, ErrTooManyAttachments) || errors.Is(err, attachment.ErrUnavailable) ||
+			errors.Is(err, ErrSendInProgress) || errors.Is(err, ErrIdempotencyReused) {
+			return &commandError{err.Error()}
+		}
+		return err
+	}
+
+	// The original send already echoed the message, but the client retried
+	// because it never saw that, so echo it again to the sender.
+	if replayed {
+		if err := s.events.Publish(ctx, userID, event.MessageCreate, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/event"
+	"discord/internal/id"
+	"discord/internal/relationship"
+	"discord/internal/settings"
+	"discord/internal/user"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Where a conversation is listed for one of its two users.
+const (
+	StateActive  = "active"
+	StateRequest = "request"
+	StateIgnored = "ignored"
+)
+
+var ErrNoMessageRequest = errors.New("no message request from this user")
+
+// Conversation is a DM as seen by one of its users.
+type Conversation struct {
+	ID            string       `json:"id"`
+	User          user.Profile `json:"user"`
+	State         string       `json:"state" enums:"active,request,ignored"`
+	LastMessage   *Message     `json:"lastMessage,omitempty"`
+	LastMessageAt time.Time    `json:"lastMessageAt"`
+
+	// Read state of the listing user.
+	LastReadMessageID *id.ID `json:"lastReadMessageId,omitempty" swaggertype:"string"`
+	UnreadCount       int    `json:"unreadCount"`
+	MentionCount      int    `json:"mentionCount"`
+
+	// PeerLastReadMessageID is set when the peer shares read receipts.
+	PeerLastReadMessageID *id.ID `json:"peerLastReadMessageId,omitempty" swaggertype:"string"`
+}
+
+// ConversationState is the payload of a CONVERSATION_UPDATE event.
+type ConversationState struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
+// recipientState decides where a message from fromID is listed for toID.
+// Friends always reach the main list. Anyone else needs an existing
+// conversation, or toID's DM policy to let them start one as a request.
+func (s *Service) recipientState(ctx context.Context, fromID, toID uuid.UUID) (string, error) {
+	var state string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT state FROM conversations WHERE user_id = $1 AND peer_id = $2`,
+		toID, fromID,
+	).Scan(&state)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("get conversation: %w", err)
+	}
+
+	if state == StateActive || state == StateIgnored {
+		return state, nil
+	}
+
+	friends, err := s.relationships.AreFriends(ctx, toID, fromID)
+	if err != nil {
+		return "", fmt.Errorf("check friendship: %w", err)
+	}
+	if friends {
+		return StateActive, nil
+	}
+
+	if state == StateRequest {
+		return state, nil
+	}
+
+	st, err := s.settings.Get(ctx, toID)
+	if err != nil {
+		return "", fmt.Errorf("get settings: %w", err)
+	}
+	if st.DMPolicy != settings.DMPolicyEveryone {
+		return "", ErrDMNotAllowed
+	}
+
+	return StateRequest, nil
+}
+
+// touchConversations records msg on both sides of the conversation. Sending
+// a message always makes the conversation active for the sender, which is
+// also how replying accepts a request. recipientState is empty when the
+// recipient's side should not change.
+func touchConversations(ctx context.Context, tx *sql.Tx, msg *Message, recipientState string) error {
+	const q = `
+        INSERT INTO conversations (user_id, peer_id, state, last_message_at, created_at)
+        VALUES ($1, $2, $3, $4, $4)
+        ON CONFLICT (user_id, peer_id) DO UPDATE
+        SET state = EXCLUDED.state, last_message_at = EXCLUDED.last_message_at`
+
+	if _, err := tx.ExecContext(ctx, q, msg.FromID, msg.ToID, StateActive, msg.CreatedAt); err != nil {
+		return fmt.Errorf("update sender conversation: %w", err)
+	}
+
+	if recipientState == "" {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, q, msg.ToID, msg.FromID, recipientState, msg.CreatedAt); err != nil {
+		return fmt.Errorf("update recipient conversation: %w", err)
+	}
+	return nil
+}
+
+// Conversations lists userID's conversations in the given state, most
+// recently active first, with their last message and read state.
+func (s *Service) Conversations(ctx context.Context, userID uuid.UUID, state string, before time.Time, limit int) ([]Conversation, error) {
+	const q = `
+        SELECT c.peer_id, c.state, c.last_message_at,
+            m.id, m.type, m.from_id, m.to_id, m.content, m.payload, m.created_at, m.updated_at,
+            rs.last_read_message_id,
+            COALESCE(rs.mention_count, 0),
+            (
+                SELECT COUNT(*) FROM messages u
+                WHERE u.from_id = c.peer_id AND u.to_id = c.user_id AND NOT u.suppressed
+                  AND (rs.last_read_message_id IS NULL OR u.id > rs.last_read_message_id)
+            ),
+            CASE
+                WHEN COALESCE(ps.read_receipts, TRUE) AND NOT EXISTS (
+                    SELECT 1 FROM relationships r
+                    WHERE r.type = $5 AND (
+                        (r.user_id = c.user_id AND r.peer_id = c.peer_id) OR
+                        (r.user_id = c.peer_id AND r.peer_id = c.user_id)
+                    )
+                ) THEN prs.last_read_message_id
+            END
+        FROM conversations c
+        LEFT JOIN LATERAL (
+            SELECT id, type, from_id, to_id, content, payload, created_at, updated_at
+            FROM messages
+            WHERE ((from_id = c.user_id AND to_id = c.peer_id) OR (from_id = c.peer_id AND to_id = c.user_id))
+              AND NOT (suppressed AND to_id = c.user_id)
+            ORDER BY id DESC
+            LIMIT 1
+        ) m ON TRUE
+        LEFT JOIN read_states rs ON rs.user_id = c.user_id AND rs.peer_id = c.peer_id
+        LEFT JOIN read_states prs ON prs.user_id = c.peer_id AND prs.peer_id = c.user_id
+        LEFT JOIN user_settings ps ON ps.user_id = c.peer_id
+        WHERE c.user_id = $1 AND c.state = $2 AND c.last_message_at < $3
+        ORDER BY c.last_message_at DESC
+        LIMIT $4`
+
+	rows, err := s.db.QueryContext(ctx, q, userID, state, before, limit, relationship.TypeBlocked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query conversations: %w", err)
+	}
+	defer rows.Close()
+
+	conversations := []Conversation{}
+	var ids []string
+	for rows.Next() {
+		var c Conversation
+		var (
+			msgID, msgType       sql.NullInt64
+			fromID, toID         uuid.NullUUID
+			content              sql.NullString
+			payload              []byte
+			createdAt, updatedAt sql.NullTime
+			lastRead, peerRead   sql.NullInt64
+		)
+		if err := rows.Scan(
+			&c.ID,
+			&c.State,
+			&c.LastMessageAt,
+			&msgID,
+			&msgType,
+			&fromID,
+			&toID,
+			&content,
+			&payload,
+			&createdAt,
+			&updatedAt,
+			&lastRead,
+			&c.MentionCount,
+			&c.UnreadCount,
+			&peerRead,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation: %w", err)
+		}
+
+		if lastRead.Valid {
+			v := id.ID(lastRead.Int64)
+			c.LastReadMessageID = &v
+		}
+		if peerRead.Valid {
+			v := id.ID(peerRead.Int64)
+			c.PeerLastReadMessageID = &v
+		}
+
+		if msgID.Valid {
+			c.LastMessage = &Message{
+				ID:        id.ID(msgID.Int64),
+				Type:      MessageType(msgType.Int64),
+				FromID:    fromID.UUID,
+				ToID:      toID.UUID,
+				Content:   content.String,
+				Payload:   payload,
+				CreatedAt: createdAt.Time,
+				UpdatedAt: updatedAt.Time,
+			}
+		}
+
+		conversations = append(conversations, c)
+		ids = append(ids, c.ID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating conversations: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return conversations, nil
+	}
+
+	profiles, err := s.userService.GetProfiles(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("get profiles: %w", err)
+	}
+
+	byID := make(map[string]user.Profile, len(profiles))
+	for _, p := range profiles {
+		byID[p.ID] = p
+	}
+	for i := range conversations {
+		conversations[i].User = byID[conversations[i].ID]
+	}
+
+	return conversations, nil
+}
+
+// AcceptMessageRequest moves peerID's conversation with userID into the main
+// list. Ignored requests can be accepted too.
+func (s *Service) AcceptMessageRequest(ctx context.Context, userID, peerID uuid.UUID) error {
+	return s.setConversationState(ctx, userID, peerID, StateActive, StateRequest, StateIgnored)
+}
+
+// IgnoreMessageRequest hides a message request. Later messages in it are
+// stored but not notified.
+func (s *Service) IgnoreMessageRequest(ctx context.Context, userID, peerID uuid.UUID) error {
+	return s.setConversationState(ctx, userID, peerID, StateIgnored, StateRequest)
+}
+
+func (s *Service) setConversationState(ctx context.Context, userID, peerID uuid.UUID, state string, from ...string) error {
+	const q = `
+        UPDATE conversations SET state = $3
+        WHERE user_id = $1 AND peer_id = $2 AND state = ANY($4)`
+
+	res, err := s.db.ExecContext(ctx, q, userID, peerID, state, pq.Array(from))
+	if err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
+	if n == 0 {
+		return ErrNoMessageRequest
+	}
+
+	// Keep the user's other sessions in step.
+	update := ConversationState{ID: peerID.String(), State: state}
+	if err := s.events.Publish(ctx, userID, event.ConversationUpdate, update); err != nil {
+		s.log.Error().Err(err).
+			Str("userId", userID.String()).
+			Msg("failed to publish conversation update")
+	}
+
+	return nil
+}
@@ -1,8 +1,20 @@
 package chat
 
 import (
+	"context"
+	"discord/internal/attachment"
+	"discord/internal/auth"
+	"discord/internal/http/response"
+	"discord/internal/id"
+	"discord/internal/ratelimit"
+	"discord/internal/validation"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -12,17 +24,47 @@ import (
 
 type Handler struct {
 	svc      *Service
+	validate *validation.Validator
+	limiter  *ratelimit.Limiter
 	log      *zerolog.Logger
 	upgrader websocket.Upgrader
 }
 
-func NewHandler(svc *Service, log *zerolog.Logger) *Handler {
+type SendMessageRequest struct {
+	ToID    string `json:"toId" validate:"required,uuid"`
+	Content string `json:"content" validate:"max=2000"`
+	Nonce   string `json:"nonce" validate:"omitempty,max=64"`
+
+	// ReferencedMessageID makes the message a reply.
+	ReferencedMessageID string `json:"referencedMessageId" validate:"omitempty,number"`
+
+	// AttachmentIDs are uploads from POST /chat/attachments to send with
+	// the message. A message needs content, attachments or both.
+	AttachmentIDs []string `json:"attachmentIds" validate:"max=10,dive,number"`
+
+	// Type may only be 0. Replies are typed by the server, and system
+	// types are refused.
+	Type MessageType `json:"type,omitempty" enums:"0"`
+}
+
+type SearchRequest struct {
+	Query  string `json:"q" validate:"required,max=500"`
+	Cursor string `json:"cursor" validate:"omitempty,number"`
+	Limit  int    `json:"limit" validate:"min=1,max=25"`
+}
+
+func NewHandler(svc *Service, validate *validation.Validator, limiter *ratelimit.Limiter, log *zerolog.Logger) *Handler {
 	return &Handler{
-		svc: svc,
-		log: log,
+		svc:      svc,
+		validate: validate,
+		limiter:  limiter,
+		log:      log,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			// Browsers close the socket unless the server picks one of
+			// the protocols offered; never echo the token.
+			Subprotocols: []string{auth.WebSocketProtocol},
 			CheckOrigin: func(r *http.Request) bool {
 				// TODO: In production, implement proper origin checking
 				return true
@@ -34,27 +76,42 @@ func NewHandler(svc *Service, log *zerolog.Logger) *Handler {
 func (h *Handler) Routes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Post("/messages", h.handleSendMessage)
+	r.With(h.limiter.Middleware(ratelimit.GroupMessages)).Post("/messages", h.handleSendMessage)
+	r.With(h.limiter.Middleware(ratelimit.GroupUploads)).Post("/attachments", h.handleUpload)
 	r.Get("/messages/{userID}", h.handleGetMessages)
+	r.Get("/messages/{messageID}/reactions/{emoji}", h.handleListReactions)
+	r.With(h.limiter.Middleware(ratelimit.GroupReactions)).Put("/messages/{messageID}/reactions/{emoji}/me", h.handleAddReaction)
+	r.Delete("/messages/{messageID}/reactions/{emoji}/me", h.handleRemoveReaction)
+	r.With(h.limiter.Middleware(ratelimit.GroupSearch)).Get("/search", h.handleSearch)
+	r.Get("/conversations", h.handleListConversations)
+	r.Post("/conversations/{userID}/ack", h.handleAck)
+	r.Get("/conversations/{userID}/pins", h.handleListPins)
+	r.Put("/conversations/{userID}/pins/{messageID}", h.handlePin)
+	r.Delete("/conversations/{userID}/pins/{messageID}", h.handleUnpin)
+	r.Get("/message-requests", h.handleListMessageRequests)
+	r.Post("/message-requests/{userID}/accept", h.handleAcceptMessageRequest)
+	r.Post("/message-requests/{userID}/ignore", h.handleIgnoreMessageRequest)
+	r.Post("/typing/{userID}", h.handleTyping)
 	r.Get("/ws", h.handleWebSocket)
 
 	return r
 }
 
 // @Summary WebSocket connection
-// @Description Connect to WebSocket for real-time messages
+// @Description Connect to WebSocket for real-time messages. Events arrive as {"type", "data"}; events queued together share a frame, one per line. Browsers, which cannot set Authorization on a websocket, may instead offer the protocols "bearer" and the token in Sec-WebSocket-Protocol. Clients may send commands as {"op", "data"}; TYPING_START with data {"userId"}, MESSAGE_ACK with data {"userId", "messageId"} and SEND_MESSAGE with data {"toId", "content", "nonce", "referencedMessageId"}. A failed command is answered with an ERROR event.
 // @Tags chat
 // @Accept json
 // @Produce json
-// @Param Authorization header string true "Bearer token"
+// @Param Authorization header string false "Bearer token"
+// @Param Sec-WebSocket-Protocol header string false "bearer, <token>"
 // @Success 101 {string} string "Switching protocols"
-// @Failure 401 {string} string "Unauthorized"
+// @Failure 401 {object} response.Problem "Unauthorized"
 // @Router /chat/ws [get]
 func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(uuid.UUID)
 	if !ok {
 		h.log.Error().Msg("user ID not found in context")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
 		return
 	}
 
@@ -72,6 +129,7 @@ func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	client := &Client{
 		hub:    h.svc.hub,
 		userID: userID,
+		connID: uuid.NewString(),
 		conn:   conn,
 		send:   make(chan []byte, 256),
 	}
@@ -82,57 +140,117 @@ func (h *Handler) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Msg("new websocket connection established")
 
 	client.hub.register <- client
+	client.connectPresence()
 
 	go client.writePump()
 	go client.readPump()
 }
 
 // @Summary Send message
-// @Description Send a private message to another user
+// @Description Send a private message to another user. The message is also pushed as MESSAGE_CREATE to all of the sender's sessions, carrying the nonce if one was given.
+// @Description Set referencedMessageId to reply to an earlier message in the same conversation; the reply quotes it as referencedMessage.
+// @Description Sends are idempotent per Idempotency-Key header, or per nonce when no header is given: a retry within 10 minutes returns the original message with Idempotent-Replayed set and stores nothing new. Reusing a key for a different message is refused.
 // @Tags chat
 // @Accept json
 // @Produce json
 // @Param Authorization header string true "Bearer token"
-// @Param request body Message true "Message content"
+// @Param Idempotency-Key header string false "Deduplicates retries of the same send"
+// @Param request body SendMessageRequest true "Message content"
 // @Success 200 {object} Message
-// @Failure 400 {string} string "Invalid request"
-// @Failure 401 {string} string "Unauthorized"
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Header 200 {string} Idempotent-Replayed "true when the original message of a retried send is returned"
+// @Failure 403 {object} response.Problem "Recipient does not accept DMs from the sender"
+// @Failure 409 {object} response.Problem "A send with the same idempotency key is still in progress"
+// @Failure 422 {object} response.Problem "The idempotency key was already used for a different message"
+// @Failure 429 {object} response.Problem "Rate limit exceeded"
+// @Failure 500 {object} response.Problem "Internal server error"
 // @Router /chat/messages [post]
 func (h *Handler) handleSendMessage(w http.ResponseWriter, r *http.Request) {
-	var msg struct {
-		ToID    string `json:"toId"`
-		Content string `json:"content"`
+	var msg SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if p := h.validate.Check(r, msg); p != nil {
+		response.Render(w, r, p)
 		return
 	}
+
 	fromID, ok := r.Context().Value("userID").(uuid.UUID)
 	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
 		return
 	}
 
 	toID, err := uuid.Parse(msg.ToID)
 	if err != nil {
-		http.Error(w, "invalid recipient id", http.StatusBadRequest)
+		response.Render(w, r, response.ErrInvalidRequest("invalid recipient id"))
 		return
 	}
 
 	message := &Message{
-		ID:      uuid.New(),
 		FromID:  fromID,
 		ToID:    toID,
+		Type:    msg.Type,
 		Content: msg.Content,
+		Nonce:   msg.Nonce,
+	}
+
+	if msg.ReferencedMessageID != "" {
+		ref, err := id.Parse(msg.ReferencedMessageID)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("invalid referenced message id"))
+			return
+		}
+		message.ReferencedMessageID = &ref
+	}
+
+	for _, v := range msg.AttachmentIDs {
+		attachmentID, err := id.Parse(v)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("invalid attachment id"))
+			return
+		}
+		message.attachmentIDs = append(message.attachmentIDs, attachmentID)
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = msg.Nonce
+	}
+	if len(key) > 255 {
+		response.Render(w, r, response.ErrInvalidRequest("idempotency key too long"))
+		return
 	}
 
-	if err := h.svc.SendMessage(r.Context(), message); err != nil {
+	replayed, err := h.svc.SendMessage(r.Context(), message, key)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrDMNotAllowed):
+			response.Render(w, r, response.New(http.StatusForbidden, response.CodeDMNotAllowed, err.Error()))
+			return
+		case errors.Is(err, ErrReferenceNotFound), errors.Is(err, ErrSystemMessage),
+			errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrTooManyAttachments),
+			errors.Is(err, attachment.ErrUnavailable):
+			response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+			return
+		case errors.Is(err, ErrSendInProgress):
+			response.Render(w, r, response.New(http.StatusConflict, response.CodeSendInProgress, err.Error()))
+			return
+		case errors.Is(err, ErrIdempotencyReused):
+			response.Render(w, r, response.New(http.StatusUnprocessableEntity, response.CodeIdempotencyReused, err.Error()))
+			return
+		}
 		h.log.Error().Err(err).Msg("failed to send message")
-		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		response.Render(w, r, response.ErrInternal())
 		return
 	}
 
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(message)
 }
@@ -144,30 +262,671 @@ func (h *Handler) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Param Authorization header string true "Bearer token"
 // @Param userID path string true "User ID to get messages with"
+// @Param before query string false "Only messages older than this message ID"
+// @Param limit query int false "Maximum number of messages (1-100, default 50)"
 // @Success 200 {array} Message
-// @Failure 401 {string} string "Unauthorized"
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
 // @Router /chat/messages/{userID} [get]
 func (h *Handler) handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	userID := chi.URLParam(r, "userID")
 	fromID, ok := r.Context().Value("userID").(uuid.UUID)
 	if !ok {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
 		return
 	}
 
 	toID, err := uuid.Parse(userID)
 	if err != nil {
-		http.Error(w, "invalid user id", http.StatusBadRequest)
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
 		return
 	}
 
-	messages, err := h.svc.GetMessages(r.Context(), fromID, toID, 50) // Default limit of 50
+	var before id.ID
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err = id.Parse(v)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("before must be a message id"))
+			return
+		}
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			response.Render(w, r, response.ErrInvalidRequest("limit must be between 1 and 100"))
+			return
+		}
+		limit = n
+	}
+
+	messages, err := h.svc.GetMessages(r.Context(), fromID, toID, before, limit)
 	if err != nil {
 		h.log.Error().Err(err).Msg("failed to get messages")
-		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		response.Render(w, r, response.ErrInternal())
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
+
+// @Summary Search messages
+// @Description Search messages in the signed-in user's conversations, newest first. Words are matched in full-text, with "quoted phrases", OR and -excluded words. Filters narrow the results: from:, in: and mentions: take a username, user ID or me; has: takes attachment, image or link; before: and after: take a YYYY-MM-DD date in UTC and exclude that day. Messages from blocked users are left out.
+// @Tags chat
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param q query string true "Search words and filters" example(lunch from:me has:image)
+// @Param cursor query string false "Cursor from the previous page"
+// @Param limit query int false "Page size (1-25, default 25)"
+// @Success 200 {object} SearchPage
+// @Failure 400 {object} response.Problem "Invalid search"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 429 {object} response.Problem "Rate limit exceeded"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/search [get]
+func (h *Handler) handleSearch(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	req := SearchRequest{
+		Query:  r.URL.Query().Get("q"),
+		Cursor: r.URL.Query().Get("cursor"),
+		Limit:  25,
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("limit must be a number"))
+			return
+		}
+		req.Limit = n
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	var before id.ID
+	if req.Cursor != "" {
+		cursor, err := id.Parse(req.Cursor)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("invalid cursor"))
+			return
+		}
+		before = cursor
+	}
+
+	page, err := h.svc.SearchMessages(r.Context(), userID, req.Query, before, req.Limit)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSearch) {
+			response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+			return
+		}
+		h.log.Error().Err(err).Msg("failed to search messages")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// @Summary List conversations
+// @Description List the signed-in user's DM conversations, most recent first. Message requests are listed separately.
+// @Tags chat
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param before query string false "Only conversations active before this RFC 3339 time"
+// @Param limit query int false "Maximum number of conversations (1-100, default 50)"
+// @Success 200 {array} Conversation
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/conversations [get]
+func (h *Handler) handleListConversations(w http.ResponseWriter, r *http.Request) {
+	h.handleList(w, r, StateActive)
+}
+
+// @Summary List message requests
+// @Description List conversations started by people who are not friends with the signed-in user and have not been accepted or ignored yet
+// @Tags chat
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param before query string false "Only requests active before this RFC 3339 time"
+// @Param limit query int false "Maximum number of requests (1-100, default 50)"
+// @Success 200 {array} Conversation
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/message-requests [get]
+func (h *Handler) handleListMessageRequests(w http.ResponseWriter, r *http.Request) {
+	h.handleList(w, r, StateRequest)
+}
+
+// @Summary Accept message request
+// @Description Move a message request, or an ignored one, into the conversation list
+// @Tags chat
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User who sent the request"
+// @Success 204 "Request accepted"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "No message request from this user"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/message-requests/{userID}/accept [post]
+func (h *Handler) handleAcceptMessageRequest(w http.ResponseWriter, r *http.Request) {
+	h.handleSetState(w, r, h.svc.AcceptMessageRequest, "failed to accept message request")
+}
+
+// @Summary Ignore message request
+// @Description Hide a message request. Further messages from the user are kept but not notified.
+// @Tags chat
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User who sent the request"
+// @Success 204 "Request ignored"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "No message request from this user"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/message-requests/{userID}/ignore [post]
+func (h *Handler) handleIgnoreMessageRequest(w http.ResponseWriter, r *http.Request) {
+	h.handleSetState(w, r, h.svc.IgnoreMessageRequest, "failed to ignore message request")
+}
+
+func (h *Handler) handleList(w http.ResponseWriter, r *http.Request, state string) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	before := time.Now()
+	if v := r.URL.Query().Get("before"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("before must be an RFC 3339 time"))
+			return
+		}
+		before = t
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			response.Render(w, r, response.ErrInvalidRequest("limit must be between 1 and 100"))
+			return
+		}
+		limit = n
+	}
+
+	conversations, err := h.svc.Conversations(r.Context(), userID, state, before, limit)
+	if err != nil {
+		h.log.Error().Err(err).Str("state", state).Msg("failed to list conversations")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+func (h *Handler) handleSetState(w http.ResponseWriter, r *http.Request, set func(ctx context.Context, userID, peerID uuid.UUID) error, msg string) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	if err := set(r.Context(), userID, peerID); err != nil {
+		if errors.Is(err, ErrNoMessageRequest) {
+			response.Render(w, r, response.ErrNotFound(err.Error()))
+			return
+		}
+		h.log.Error().Err(err).Msg(msg)
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Start typing
+// @Description Tell another user you are typing to them. They receive a TYPING_START event that expires after about 8 seconds. Repeated calls are throttled on the server.
+// @Tags chat
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User being typed to"
+// @Success 204 "Typing sent"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/typing/{userID} [post]
+func (h *Handler) handleTyping(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	if err := h.svc.StartTyping(r.Context(), userID, peerID); err != nil {
+		if errors.Is(err, ErrTypingToSelf) {
+			response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+			return
+		}
+		h.log.Error().Err(err).Msg("failed to send typing")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Mark conversation read
+// @Description Mark the conversation with a user as read up to a message. Read states only move forward. The signed-in user's other devices get a MESSAGE_ACK event, and so does the peer if read receipts are on.
+// @Tags chat
+// @Accept json
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Other user in the conversation"
+// @Param request body AckRequest true "Last message read"
+// @Success 204 "Read state updated"
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "Message not found"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/conversations/{userID}/ack [post]
+func (h *Handler) handleAck(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	var req AckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	messageID, err := id.Parse(req.MessageID)
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid message id"))
+		return
+	}
+
+	if err := h.svc.AckMessage(r.Context(), userID, peerID, messageID); err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			response.Render(w, r, response.ErrNotFound(err.Error()))
+			return
+		}
+		h.log.Error().Err(err).Msg("failed to ack message")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Add reaction
+// @Description React to a message with a Unicode emoji or a custom emoji given as name:id. Both users get a MESSAGE_REACTION_ADD event. Adding the same reaction twice changes nothing.
+// @Tags chat
+// @Param Authorization header string true "Bearer token"
+// @Param messageID path string true "Message ID"
+// @Param emoji path string true "URL-encoded emoji"
+// @Success 204 "Reaction added"
+// @Failure 400 {object} response.Problem "Invalid message id or emoji"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 403 {object} response.Problem "One of the users has blocked the other"
+// @Failure 404 {object} response.Problem "Message not found"
+// @Failure 429 {object} response.Problem "Rate limit exceeded"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/messages/{messageID}/reactions/{emoji}/me [put]
+func (h *Handler) handleAddReaction(w http.ResponseWriter, r *http.Request) {
+	h.handleReaction(w, r, h.svc.AddReaction, "failed to add reaction")
+}
+
+// @Summary Remove reaction
+// @Description Take back your reaction to a message. Both users get a MESSAGE_REACTION_REMOVE event.
+// @Tags chat
+// @Param Authorization header string true "Bearer token"
+// @Param messageID path string true "Message ID"
+// @Param emoji path string true "URL-encoded emoji"
+// @Success 204 "Reaction removed"
+// @Failure 400 {object} response.Problem "Invalid message id or emoji"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "Message not found"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/messages/{messageID}/reactions/{emoji}/me [delete]
+func (h *Handler) handleRemoveReaction(w http.ResponseWriter, r *http.Request) {
+	h.handleReaction(w, r, h.svc.RemoveReaction, "failed to remove reaction")
+}
+
+// @Summary List reactions
+// @Description List the users who reacted to a message with an emoji, ordered by user ID
+// @Tags chat
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param messageID path string true "Message ID"
+// @Param emoji path string true "URL-encoded emoji"
+// @Param after query string false "Only users after this user ID"
+// @Param limit query int false "Maximum number of users (1-100, default 25)"
+// @Success 200 {array} user.Profile
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "Message not found"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/messages/{messageID}/reactions/{emoji} [get]
+func (h *Handler) handleListReactions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	messageID, emoji, ok := reactionParams(w, r)
+	if !ok {
+		return
+	}
+
+	var after *uuid.UUID
+	if v := r.URL.Query().Get("after"); v != "" {
+		a, err := uuid.Parse(v)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("after must be a user id"))
+			return
+		}
+		after = &a
+	}
+
+	limit := 25
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			response.Render(w, r, response.ErrInvalidRequest("limit must be between 1 and 100"))
+			return
+		}
+		limit = n
+	}
+
+	users, err := h.svc.Reactors(r.Context(), userID, messageID, emoji, after, limit)
+	if err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			response.Render(w, r, response.ErrNotFound(err.Error()))
+			return
+		}
+		h.log.Error().Err(err).Msg("failed to list reactions")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *Handler) handleReaction(
+	w http.ResponseWriter,
+	r *http.Request,
+	fn func(ctx context.Context, userID uuid.UUID, messageID id.ID, emoji string) error,
+	failure string,
+) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	messageID, emoji, ok := reactionParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := fn(r.Context(), userID, messageID, emoji); err != nil {
+		switch {
+		case errors.Is(err, ErrMessageNotFound):
+			response.Render(w, r, response.ErrNotFound(err.Error()))
+		case errors.Is(err, ErrCannotReact):
+			response.Render(w, r, response.New(http.StatusForbidden, response.CodeUserBlocked, err.Error()))
+		default:
+			h.log.Error().Err(err).Msg(failure)
+			response.Render(w, r, response.ErrInternal())
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reactionParams reads the message ID and emoji of a reaction route,
+// rendering a problem if either is invalid.
+func reactionParams(w http.ResponseWriter, r *http.Request) (id.ID, string, bool) {
+	messageID, err := id.Parse(chi.URLParam(r, "messageID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid message id"))
+		return 0, "", false
+	}
+
+	raw, err := url.PathUnescape(chi.URLParam(r, "emoji"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest(ErrInvalidEmoji.Error()))
+		return 0, "", false
+	}
+	emoji, err := ParseEmoji(raw)
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+		return 0, "", false
+	}
+
+	return messageID, emoji, true
+}
+
+// @Summary List pins
+// @Description List the messages pinned in the conversation with a user, most recently pinned first
+// @Tags chat
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Other user in the conversation"
+// @Success 200 {array} Message
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/conversations/{userID}/pins [get]
+func (h *Handler) handleListPins(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	messages, err := h.svc.Pins(r.Context(), userID, peerID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to list pins")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// @Summary Pin message
+// @Description Pin a message in the conversation with a user. A pin notice is posted to the conversation and both users get a PINS_UPDATE event. Pinning a pinned message changes nothing.
+// @Tags chat
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Other user in the conversation"
+// @Param messageID path string true "Message to pin"
+// @Success 204 "Message pinned"
+// @Failure 400 {object} response.Problem "Invalid id, or a system message"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 403 {object} response.Problem "One of the users has blocked the other"
+// @Failure 404 {object} response.Problem "Message not found"
+// @Failure 409 {object} response.Problem "Too many pins in the conversation"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/conversations/{userID}/pins/{messageID} [put]
+func (h *Handler) handlePin(w http.ResponseWriter, r *http.Request) {
+	h.handlePinChange(w, r, h.svc.PinMessage, "failed to pin message")
+}
+
+// @Summary Unpin message
+// @Description Unpin a message in the conversation with a user. Both users get a PINS_UPDATE event.
+// @Tags chat
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Other user in the conversation"
+// @Param messageID path string true "Message to unpin"
+// @Success 204 "Message unpinned"
+// @Failure 400 {object} response.Problem "Invalid id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 403 {object} response.Problem "One of the users has blocked the other"
+// @Failure 404 {object} response.Problem "Message is not pinned"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/conversations/{userID}/pins/{messageID} [delete]
+func (h *Handler) handleUnpin(w http.ResponseWriter, r *http.Request) {
+	h.handlePinChange(w, r, h.svc.UnpinMessage, "failed to unpin message")
+}
+
+func (h *Handler) handlePinChange(
+	w http.ResponseWriter,
+	r *http.Request,
+	fn func(ctx context.Context, userID, peerID uuid.UUID, messageID id.ID) error,
+	failure string,
+) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	messageID, err := id.Parse(chi.URLParam(r, "messageID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid message id"))
+		return
+	}
+
+	if err := fn(r.Context(), userID, peerID, messageID); err != nil {
+		switch {
+		case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrNotPinned):
+			response.Render(w, r, response.ErrNotFound(err.Error()))
+		case errors.Is(err, ErrNotPinnable):
+			response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+		case errors.Is(err, ErrCannotPin):
+			response.Render(w, r, response.New(http.StatusForbidden, response.CodeUserBlocked, err.Error()))
+		case errors.Is(err, ErrTooManyPins):
+			response.Render(w, r, response.New(http.StatusConflict, response.CodeTooManyPins, err.Error()))
+		default:
+			h.log.Error().Err(err).Msg(failure)
+			response.Render(w, r, response.ErrInternal())
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Upload attachment
+// @Description Upload a file as multipart form field "file", to send with a message through attachmentIds. The content type is detected from the file, not its name. Images are stored without EXIF and other metadata, and get thumbnails in the background. Uploads count towards the uploader's storage quota, see GET /users/@me; those not sent within a day are deleted.
+// @Tags chat
+// @Accept multipart/form-data
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param file formData file true "File to upload"
+// @Success 201 {object} attachment.Attachment
+// @Failure 400 {object} response.Problem "Missing file or unreadable image"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 413 {object} response.Problem "File too large or storage quota exceeded"
+// @Failure 429 {object} response.Problem "Rate limit exceeded"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /chat/attachments [post]
+func (h *Handler) handleUpload(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	max := h.svc.attachments.MaxFileSize()
+	tooLarge := response.New(http.StatusRequestEntityTooLarge, response.CodeFileTooLarge,
+		fmt.Sprintf("files can be at most %d bytes", max))
+
+	// Leave room for the multipart framing around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, max+1<<20)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			response.Render(w, r, tooLarge)
+			return
+		}
+		response.Render(w, r, response.ErrInvalidRequest("invalid multipart form"))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("missing file"))
+		return
+	}
+	defer file.Close()
+
+	a, err := h.svc.attachments.Upload(r.Context(), userID, header.Filename, file, header.Size)
+	if err != nil {
+		if errors.Is(err, attachment.ErrTooLarge) {
+			response.Render(w, r, tooLarge)
+			return
+		}
+		if errors.Is(err, attachment.ErrQuotaExceeded) {
+			response.Render(w, r, response.New(http.StatusRequestEntityTooLarge, response.CodeQuotaExceeded, err.Error()))
+			return
+		}
+		if errors.Is(err, attachment.ErrInvalidImage) {
+			response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+			return
+		}
+		h.log.Error().Err(err).Msg("failed to upload attachment")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
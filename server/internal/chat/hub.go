@@ -2,7 +2,11 @@ package chat
 
 import (
 	"context"
+	"discord/internal/event"
+	"discord/internal/presence"
+	"discord/internal/ratelimit"
 	"encoding/json"
+	"errors"
 	"sync"
 	"time"
 
@@ -24,6 +28,9 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 4096
+
+	// Close code sent when a client exceeds the gateway rate limit.
+	closeRateLimited = 4008
 )
 
 type Hub struct {
@@ -31,6 +38,9 @@ type Hub struct {
 	register   chan *Client
 	unregister chan *Client
 	redis      *redis.Client
+	limiter    *ratelimit.Limiter
+	presence   *presence.Service
+	commands   map[string]commandHandler
 	log        *zerolog.Logger
 	mu         sync.RWMutex
 }
@@ -38,79 +48,128 @@ type Hub struct {
 type Client struct {
 	hub    *Hub
 	userID uuid.UUID
+	connID string
 	conn   *websocket.Conn
 	send   chan []byte
 }
 
-func NewHub(redis *redis.Client, log *zerolog.Logger) *Hub {
+func NewHub(redis *redis.Client, limiter *ratelimit.Limiter, presence *presence.Service, log *zerolog.Logger) *Hub {
 	return &Hub{
 		clients:    make(map[string]map[*Client]bool),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		redis:      redis,
+		limiter:    limiter,
+		presence:   presence,
+		commands:   make(map[string]commandHandler),
 		log:        log,
 	}
 }
 
+// handle registers the handler for a client command. Handlers are set up
+// before Run and never change afterwards.
+func (h *Hub) handle(op string, fn commandHandler) {
+	h.commands[op] = fn
+}
+
+// Run registers and unregisters clients and forwards events from Redis to
+// the connections of the user each event is addressed to.
 func (h *Hub) Run() {
-	pubsub := h.redis.PSubscribe(context.Background(), "user:*:messages")
+	pubsub := h.redis.PSubscribe(context.Background(), event.ChannelPattern)
 	defer pubsub.Close()
 
-	// Handle Redis messages
-	go func() {
-		ch := pubsub.Channel()
-		for msg := range ch {
-			var message Message
-			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
-				h.log.Error().Err(err).
-					Str("payload", msg.Payload).
-					Msg("failed to unmarshal message")
-				continue
+	ch := pubsub.Channel()
+	for {
+		select {
+		case client := <-h.register:
+			h.mu.Lock()
+			userID := client.userID.String()
+			if h.clients[userID] == nil {
+				h.clients[userID] = make(map[*Client]bool)
 			}
+			h.clients[userID][client] = true
+			h.mu.Unlock()
+
+		case client := <-h.unregister:
+			h.mu.Lock()
+			h.remove(client)
+			h.mu.Unlock()
 
-			h.mu.RLock()
-			if clients, ok := h.clients[message.ToID.String()]; ok {
-				// Marshal the message for WebSocket delivery
-				payload, err := json.Marshal(message)
-				if err != nil {
-					h.log.Error().Err(err).Msg("failed to marshal message for websocket")
-					h.mu.RUnlock()
-					continue
-				}
-
-				for client := range clients {
-					select {
-					case client.send <- payload:
-						h.log.Debug().
-							Str("toId", message.ToID.String()).
-							Msg("message sent to websocket client")
-					default:
-						h.mu.RUnlock()
-						h.unregister <- client
-						h.mu.RLock()
-					}
-				}
+		case msg, ok := <-ch:
+			if !ok {
+				h.log.Error().Msg("redis event subscription closed")
+				return
 			}
-			h.mu.RUnlock()
+			h.deliver(msg)
 		}
-	}()
+	}
+}
+
+// deliver sends an event payload to every local connection of its user.
+// Clients too slow to keep up are dropped.
+func (h *Hub) deliver(msg *redis.Message) {
+	userID, ok := event.UserFromChannel(msg.Channel)
+	if !ok {
+		h.log.Error().Str("channel", msg.Channel).Msg("event on unexpected channel")
+		return
+	}
+
+	payload := []byte(msg.Payload)
+
+	var slow []*Client
+	h.mu.RLock()
+	for client := range h.clients[userID] {
+		select {
+		case client.send <- payload:
+			h.log.Debug().
+				Str("userId", userID).
+				Msg("event sent to websocket client")
+		default:
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	if len(slow) > 0 {
+		h.mu.Lock()
+		for _, client := range slow {
+			h.remove(client)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// remove drops a client and closes its send channel. Callers hold h.mu.
+func (h *Hub) remove(client *Client) {
+	userID := client.userID.String()
+	if _, ok := h.clients[userID][client]; !ok {
+		return
+	}
+
+	delete(h.clients[userID], client)
+	if len(h.clients[userID]) == 0 {
+		delete(h.clients, userID)
+	}
+	close(client.send)
 }
 
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
+		c.disconnectPresence()
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.heartbeat()
 		return nil
 	})
 
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseGoingAway,
@@ -119,9 +178,108 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		// We only use server-to-client communication
-		// Client-to-server goes through regular HTTP endpoints
+
+		if !c.allow() {
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(closeRateLimited, "rate limited"),
+				time.Now().Add(writeWait))
+			break
+		}
+
+		c.dispatch(message)
+	}
+}
+
+// dispatch runs a command frame and reports any failure back to the client.
+func (c *Client) dispatch(message []byte) {
+	var cmd Command
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		c.sendError("", "invalid command")
+		return
+	}
+
+	fn, ok := c.hub.commands[cmd.Op]
+	if !ok {
+		c.sendError(cmd.Op, errUnknownOp.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+
+	if err := fn(ctx, c.userID, cmd.Data); err != nil {
+		var public *commandError
+		if errors.As(err, &public) {
+			c.sendError(cmd.Op, public.Error())
+			return
+		}
+		c.hub.log.Error().Err(err).
+			Str("userId", c.userID.String()).
+			Str("op", cmd.Op).
+			Msg("websocket command failed")
+		c.sendError(cmd.Op, "internal error")
+	}
+}
+
+// sendError queues an ERROR event for this client only. It is dropped if
+// the client is not keeping up.
+func (c *Client) sendError(op, detail string) {
+	data, _ := json.Marshal(CommandError{Op: op, Detail: detail})
+	payload, err := json.Marshal(event.Event{Type: errorEvent, Data: data})
+	if err != nil {
+		return
+	}
+
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	if _, ok := c.hub.clients[c.userID.String()][c]; !ok {
+		return
+	}
+	select {
+	case c.send <- payload:
+	default:
+	}
+}
+
+// connectPresence counts the connection towards the user being online.
+func (c *Client) connectPresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+
+	if err := c.hub.presence.Connect(ctx, c.userID, c.connID); err != nil {
+		c.hub.log.Error().Err(err).Str("userId", c.userID.String()).Msg("failed to record presence")
+	}
+}
+
+// heartbeat keeps the connection counted as online. Pongs arrive every
+// pingPeriod, well within the presence connection TTL.
+func (c *Client) heartbeat() {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+
+	if err := c.hub.presence.Heartbeat(ctx, c.userID, c.connID); err != nil {
+		c.hub.log.Error().Err(err).Str("userId", c.userID.String()).Msg("failed to refresh presence")
+	}
+}
+
+func (c *Client) disconnectPresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+
+	if err := c.hub.presence.Disconnect(ctx, c.userID, c.connID); err != nil {
+		c.hub.log.Error().Err(err).Str("userId", c.userID.String()).Msg("failed to clear presence")
+	}
+}
+
+// allow reports whether the client may send another frame under the
+// gateway rate limit.
+func (c *Client) allow() bool {
+	res, err := c.hub.limiter.Allow(context.Background(), ratelimit.GroupGateway, "user:"+c.userID.String())
+	if err != nil {
+		c.hub.log.Error().Err(err).Msg("gateway rate limit check failed")
+		return true
 	}
+	return res.Allowed
 }
 
 func (c *Client) writePump() {
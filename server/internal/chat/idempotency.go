@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"discord/internal/attachment"
+	"discord/internal/id"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// idempotencyWindow is how long a send's idempotency key is remembered.
+// Retrying with the same key within it returns the original message.
+const idempotencyWindow = 10 * time.Minute
+
+var (
+	ErrSendInProgress     = errors.New("a message with this idempotency key is still being sent")
+	ErrIdempotencyReused  = errors.New("this idempotency key was already used for a different message")
+	ErrEmptyMessage       = errors.New("a message needs content or attachments")
+	ErrTooManyAttachments = fmt.Errorf("a message can have at most %d attachments", attachment.MaxPerMessage)
+)
+
+// idempotentSend is what is stored under an idempotency key: a hash of the
+// send, and the message once it has gone out.
+type idempotentSend struct {
+	Hash    string   `json:"hash"`
+	Message *Message `json:"message,omitempty"`
+}
+
+// SendMessage sends msg once per idempotency key. When key was already used
+// by the sender within the window, msg is replaced by the message that was
+// sent then, nothing new is stored, and replayed is true. Reusing a key for
+// a different message is ErrIdempotencyReused. An empty key disables the
+// check. Users can only send plain messages and replies; the
+// type is always worked out by the server.
+func (s *Service) SendMessage(ctx context.Context, msg *Message, key string) (replayed bool, err error) {
+	// Only the server writes system messages.
+	if msg.Type != MessageTypeDefault {
+		return false, ErrSystemMessage
+	}
+	if msg.Content == "" && len(msg.attachmentIDs) == 0 {
+		return false, ErrEmptyMessage
+	}
+	if len(msg.attachmentIDs) > attachment.MaxPerMessage {
+		return false, ErrTooManyAttachments
+	}
+
+	if key == "" {
+		return false, s.send(ctx, msg)
+	}
+
+	k := idempotencyKey(msg.FromID, key)
+	hash := sendHash(msg)
+
+	pending, err := json.Marshal(idempotentSend{Hash: hash})
+	if err != nil {
+		return false, fmt.Errorf("marshal idempotent send: %w", err)
+	}
+
+	claimed, err := s.redis.SetNX(ctx, k, pending, idempotencyWindow).Result()
+	if err != nil {
+		return false, fmt.Errorf("claim idempotency key: %w", err)
+	}
+
+	if !claimed {
+		data, err := s.redis.Get(ctx, k).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				// Expired or released in between; treat it as in flight
+				// rather than risk a duplicate.
+				return false, ErrSendInProgress
+			}
+			return false, fmt.Errorf("get idempotency key: %w", err)
+		}
+
+		var original idempotentSend
+		if err := json.Unmarshal(data, &original); err != nil {
+			return false, fmt.Errorf("unmarshal idempotent send: %w", err)
+		}
+		if original.Hash != hash {
+			return false, ErrIdempotencyReused
+		}
+		if original.Message == nil {
+			return false, ErrSendInProgress
+		}
+		*msg = *original.Message
+		return true, nil
+	}
+
+	if err := s.send(ctx, msg); err != nil {
+		// Free the key so the client can retry a send that did not happen.
+		if delErr := s.redis.Del(ctx, k).Err(); delErr != nil {
+			s.log.Error().Err(delErr).Str("key", k).Msg("failed to release idempotency key")
+		}
+		return false, err
+	}
+
+	data, err := json.Marshal(idempotentSend{Hash: hash, Message: msg})
+	if err != nil {
+		return false, fmt.Errorf("marshal idempotent send: %w", err)
+	}
+	err = s.redis.SetArgs(ctx, k, data, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		// The message went out; a failure here only weakens deduplication.
+		s.log.Error().Err(err).Str("key", k).Msg("failed to store idempotent result")
+	}
+
+	return false, nil
+}
+
+// sendHash identifies what msg asks to send, so a retry can be told apart
+// from a different message under the same key. Attachment order matters,
+// as it is the order they are shown in.
+func sendHash(msg *Message) string {
+	data, _ := json.Marshal(struct {
+		ToID                uuid.UUID   `json:"toId"`
+		Type                MessageType `json:"type"`
+		Content             string      `json:"content"`
+		Nonce               string      `json:"nonce"`
+		ReferencedMessageID *id.ID      `json:"referencedMessageId"`
+		AttachmentIDs       []id.ID     `json:"attachmentIds"`
+	}{msg.ToID, msg.Type, msg.Content, msg.Nonce, msg.ReferencedMessageID, msg.attachmentIDs})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func idempotencyKey(userID uuid.UUID, key string) string {
+	return fmt.Sprintf("idempotency:message:%s:%s", userID.String(), key)
+}
@@ -0,0 +1,45 @@
+package chat
+
+import (
+	"context"
+	"discord/internal/search"
+
+	"github.com/google/uuid"
+)
+
+// indexMessage feeds a message that was just sent to the search index.
+// Indexing is best effort: the message is already stored, and a message
+// the index missed is picked up by the next reindex. Edits and deletions
+// are to go through the index the same way, with Index and Delete, once
+// messages can be edited or deleted.
+func (s *Service) indexMessage(ctx context.Context, msg *Message) {
+	if msg.Type.System() {
+		return
+	}
+
+	doc := search.Document{
+		ID:            msg.ID,
+		FromID:        msg.FromID,
+		ToID:          msg.ToID,
+		Content:       msg.Content,
+		CreatedAt:     msg.CreatedAt,
+		Suppressed:    msg.Suppressed,
+		HasAttachment: len(msg.Attachments) > 0,
+	}
+	for _, p := range msg.Mentions {
+		if u, err := uuid.Parse(p.ID); err == nil {
+			doc.Mentions = append(doc.Mentions, u)
+		}
+	}
+	for _, a := range msg.Attachments {
+		if a.Width != nil {
+			doc.HasImage = true
+		}
+	}
+
+	if err := s.index.Index(ctx, doc); err != nil {
+		s.log.Error().Err(err).
+			Str("messageId", msg.ID.String()).
+			Msg("failed to index message")
+	}
+}
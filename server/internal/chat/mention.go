@@ -0,0 +1,203 @@
+package chat
+
+import (
+	"context"
+	"discord/internal/id"
+	"discord/internal/user"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Mentions in message content. Users are mentioned as <@id>, or <@!id> as
+// some clients write it, and roles as <@&id>. Mentions inside code are
+// only text. Code blocks are stripped before inline code, in two passes,
+// as the backfill in migration 000020 does.
+var (
+	userMentionPattern = regexp.MustCompile(`<@!?([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})>`)
+	roleMentionPattern = regexp.MustCompile(`<@&([0-9]{1,19})>`)
+	everyonePattern    = regexp.MustCompile(`(?:^|[^\w@])@(?:everyone|here)\b`)
+	codeBlockPattern   = regexp.MustCompile("(?s)```.*?```")
+	inlineCodePattern  = regexp.MustCompile("`[^`]*`")
+)
+
+// mentionSet is what a message's content mentions, each user and role
+// once, in the order they first appear.
+type mentionSet struct {
+	users    []uuid.UUID
+	roles    []id.ID
+	everyone bool
+}
+
+// parseMentions finds the mentions in content.
+func parseMentions(content string) mentionSet {
+	content = codeBlockPattern.ReplaceAllString(content, " ")
+	content = inlineCodePattern.ReplaceAllString(content, " ")
+
+	var set mentionSet
+	seenUsers := make(map[uuid.UUID]bool)
+	for _, m := range userMentionPattern.FindAllStringSubmatch(content, -1) {
+		u, err := uuid.Parse(m[1])
+		if err != nil || seenUsers[u] {
+			continue
+		}
+		seenUsers[u] = true
+		set.users = append(set.users, u)
+	}
+
+	seenRoles := make(map[id.ID]bool)
+	for _, m := range roleMentionPattern.FindAllStringSubmatch(content, -1) {
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil || seenRoles[id.ID(n)] {
+			continue
+		}
+		seenRoles[id.ID(n)] = true
+		set.roles = append(set.roles, id.ID(n))
+	}
+
+	set.everyone = everyonePattern.MatchString(content)
+	return set
+}
+
+// resolveMentions parses the mentions in a new message's content and fills
+// them in. Mentions of users that do not exist are dropped. There are no
+// roles yet, so role mentions are kept as IDs.
+//
+// In a conversation, @everyone and @here reach the one other user, so
+// anyone may use them. Once guilds exist they must be limited to members
+// with the permission to mention everyone.
+func (s *Service) resolveMentions(ctx context.Context, msg *Message) error {
+	if msg.Type.System() {
+		return nil
+	}
+
+	set := parseMentions(msg.Content)
+	msg.MentionRoles = set.roles
+	msg.MentionEveryone = set.everyone
+
+	if len(set.users) == 0 {
+		return nil
+	}
+	profiles, err := s.mentionProfiles(ctx, set.users)
+	if err != nil {
+		return err
+	}
+	for _, u := range set.users {
+		if p, ok := profiles[u.String()]; ok {
+			msg.Mentions = append(msg.Mentions, p)
+		}
+	}
+	return nil
+}
+
+// mentions reports whether msg mentions userID, by name or through
+// @everyone or @here.
+func (m *Message) mentions(userID uuid.UUID) bool {
+	if m.MentionEveryone {
+		return true
+	}
+	for _, p := range m.Mentions {
+		if p.ID == userID.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// attachMentions fills in what messages mention, except for those whose
+// content is withheld because the reader blocked the sender.
+func (s *Service) attachMentions(ctx context.Context, messages []Message) error {
+	ids := make([]int64, 0, len(messages))
+	for _, m := range messages {
+		if !m.Blocked {
+			ids = append(ids, int64(m.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	const q = `
+        SELECT id, mention_user_ids, mention_role_ids, mention_everyone
+        FROM messages
+        WHERE id = ANY($1)
+          AND (cardinality(mention_user_ids) > 0 OR cardinality(mention_role_ids) > 0 OR mention_everyone)`
+
+	rows, err := s.db.QueryContext(ctx, q, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to query mentions: %w", err)
+	}
+	defer rows.Close()
+
+	type stored struct {
+		users    []string
+		roles    []int64
+		everyone bool
+	}
+	found := make(map[id.ID]stored)
+	var users []uuid.UUID
+	for rows.Next() {
+		var messageID id.ID
+		var m stored
+		if err := rows.Scan(&messageID, pq.Array(&m.users), pq.Array(&m.roles), &m.everyone); err != nil {
+			return fmt.Errorf("failed to scan mentions: %w", err)
+		}
+		found[messageID] = m
+		for _, u := range m.users {
+			if parsed, err := uuid.Parse(u); err == nil {
+				users = append(users, parsed)
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating mentions: %w", err)
+	}
+
+	profiles, err := s.mentionProfiles(ctx, users)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		m, ok := found[messages[i].ID]
+		if !ok || messages[i].Blocked {
+			continue
+		}
+		for _, u := range m.users {
+			if p, ok := profiles[u]; ok {
+				messages[i].Mentions = append(messages[i].Mentions, p)
+			}
+		}
+		for _, r := range m.roles {
+			messages[i].MentionRoles = append(messages[i].MentionRoles, id.ID(r))
+		}
+		messages[i].MentionEveryone = m.everyone
+	}
+	return nil
+}
+
+// mentionProfiles looks up the profiles of mentioned users, by ID.
+func (s *Service) mentionProfiles(ctx context.Context, users []uuid.UUID) (map[string]user.Profile, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.String()
+	}
+	list, err := s.userService.GetProfiles(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("get mentioned users: %w", err)
+	}
+
+	profiles := make(map[string]user.Profile, len(list))
+	for _, p := range list {
+		profiles[p.ID] = p
+	}
+	return profiles, nil
+}
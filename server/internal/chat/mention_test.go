@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"discord/internal/id"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestParseMentions(t *testing.T) {
+	alice := uuid.MustParse("6f1c1b52-8a5e-4a4e-9d43-0d8a7b1f2c3e")
+	bob := uuid.MustParse("0b0e8f3e-8c3f-4f5b-9a55-2a5f4d2b9c11")
+
+	tests := []struct {
+		name    string
+		content string
+		want    mentionSet
+	}{
+		{name: "none", content: "hello there", want: mentionSet{}},
+		{name: "user", content: "hi <@" + alice.String() + ">", want: mentionSet{users: []uuid.UUID{alice}}},
+		{name: "user with bang", content: "hi <@!" + alice.String() + ">", want: mentionSet{users: []uuid.UUID{alice}}},
+		{name: "upper case id", content: "<@6F1C1B52-8A5E-4A4E-9D43-0D8A7B1F2C3E>", want: mentionSet{users: []uuid.UUID{alice}}},
+		{
+			name:    "users in order, once each",
+			content: "<@" + bob.String() + "> <@" + alice.String() + "> <@!" + bob.String() + ">",
+			want:    mentionSet{users: []uuid.UUID{bob, alice}},
+		},
+		{name: "not a uuid", content: "<@alice>", want: mentionSet{}},
+		{name: "unclosed", content: "<@" + alice.String(), want: mentionSet{}},
+		{name: "roles once each", content: "<@&42> <@&7> <@&42>", want: mentionSet{roles: []id.ID{42, 7}}},
+		{name: "role out of range", content: "<@&9999999999999999999>", want: mentionSet{}},
+		{name: "role too long", content: "<@&12345678901234567890>", want: mentionSet{}},
+		{name: "everyone", content: "@everyone look", want: mentionSet{everyone: true}},
+		{name: "here", content: "look (@here)", want: mentionSet{everyone: true}},
+		{name: "everyone after a newline", content: "look\n@here", want: mentionSet{everyone: true}},
+		{name: "email is not everyone", content: "mail me@everyone.com", want: mentionSet{}},
+		{name: "double at", content: "@@everyone", want: mentionSet{}},
+		{name: "longer word", content: "@everyones @hereafter", want: mentionSet{}},
+		{name: "inline code", content: "`@everyone <@" + alice.String() + ">`", want: mentionSet{}},
+		{name: "code block", content: "```\n@everyone\n<@&42>\n```", want: mentionSet{}},
+		{
+			name:    "between code blocks",
+			content: "```a``` <@" + alice.String() + "> ```b```",
+			want:    mentionSet{users: []uuid.UUID{alice}},
+		},
+		{
+			name:    "between inline code",
+			content: "`a` @here `b`",
+			want:    mentionSet{everyone: true},
+		},
+		{
+			name:    "code block holding a backtick",
+			content: "```x ` y``` <@&42> `z`",
+			want:    mentionSet{roles: []id.ID{42}},
+		},
+		{name: "unclosed inline code", content: "`@everyone", want: mentionSet{everyone: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMentions(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMentions(%q) = %+v, want %+v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package chat
+
+import (
+	"context"
+	"discord/internal/id"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MessageType tells user content apart from system messages, which the
+// server writes to record something that happened in the conversation.
+// The values match Discord's, so clients can share rendering code.
+type MessageType int
+
+const (
+	MessageTypeDefault         MessageType = 0
+	MessageTypeRecipientAdd    MessageType = 1
+	MessageTypeRecipientRemove MessageType = 2
+	MessageTypeCall            MessageType = 3
+	MessageTypePinnedMessage   MessageType = 6
+	MessageTypeMemberJoin      MessageType = 7
+	MessageTypeThreadCreated   MessageType = 18
+	MessageTypeReply           MessageType = 19
+)
+
+var ErrSystemMessage = errors.New("system messages cannot be sent by users")
+
+// System reports whether messages of type t are written by the server
+// rather than typed by a user.
+func (t MessageType) System() bool {
+	return t != MessageTypeDefault && t != MessageTypeReply
+}
+
+// PinnedMessagePayload is the payload of a pin notice.
+type PinnedMessagePayload struct {
+	MessageID id.ID `json:"messageId" swaggertype:"string"`
+}
+
+// RecipientPayload is the payload of recipient add and remove, and member
+// join messages.
+type RecipientPayload struct {
+	UserID uuid.UUID `json:"userId"`
+}
+
+// CallPayload is the payload of a call message. EndedAt is empty while the
+// call is ongoing.
+type CallPayload struct {
+	Participants []uuid.UUID `json:"participants"`
+	EndedAt      *time.Time  `json:"endedAt,omitempty"`
+}
+
+// ThreadCreatedPayload is the payload of a thread created message.
+type ThreadCreatedPayload struct {
+	ThreadID id.ID  `json:"threadId" swaggertype:"string"`
+	Name     string `json:"name"`
+}
+
+// postSystemMessage records an event in the conversation between fromID,
+// who caused it, and toID. It is stored and delivered like any message.
+func (s *Service) postSystemMessage(ctx context.Context, fromID, toID uuid.UUID, t MessageType, payload interface{}, ref *id.ID) (*Message, error) {
+	if !t.System() {
+		return nil, fmt.Errorf("message type %d is not a system type", t)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshal payload: %w", err)
+	}
+
+	msg := &Message{
+		Type:                t,
+		FromID:              fromID,
+		ToID:                toID,
+		Payload:             data,
+		ReferencedMessageID: ref,
+	}
+	if err := s.send(ctx, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// nullJSON turns an empty payload into SQL NULL.
+func nullJSON(data json.RawMessage) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
@@ -0,0 +1,249 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/event"
+	"discord/internal/id"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxPins is how many messages a conversation can have pinned at once.
+const maxPins = 50
+
+var (
+	ErrTooManyPins = fmt.Errorf("a conversation can have at most %d pinned messages", maxPins)
+	ErrNotPinnable = errors.New("system messages cannot be pinned")
+	ErrNotPinned   = errors.New("message is not pinned")
+	ErrCannotPin   = errors.New("you cannot pin messages in this conversation")
+)
+
+// PinsUpdate is the payload of a PINS_UPDATE event. LastPinTimestamp is
+// when the most recent remaining pin was made, and is absent once the
+// conversation has no pins.
+type PinsUpdate struct {
+	ConversationID   string     `json:"conversationId"`
+	LastPinTimestamp *time.Time `json:"lastPinTimestamp,omitempty"`
+}
+
+// PinMessage pins messageID in userID's conversation with peerID and posts
+// a pin notice to it. Pinning a message that is already pinned changes
+// nothing.
+func (s *Service) PinMessage(ctx context.Context, userID, peerID uuid.UUID, messageID id.ID) error {
+	ok, err := s.unblocked(ctx, userID, peerID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCannotPin
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Serialize pins per conversation so the cap holds.
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, pinsKey(userID, peerID)); err != nil {
+		return fmt.Errorf("lock pins: %w", err)
+	}
+
+	// Pins are shared, so only messages both users received can be pinned.
+	const find = `
+        SELECT type FROM messages
+        WHERE id = $3
+          AND ((from_id = $1 AND to_id = $2) OR (from_id = $2 AND to_id = $1))
+          AND NOT suppressed`
+
+	var msgType MessageType
+	if err := tx.QueryRowContext(ctx, find, userID, peerID, messageID).Scan(&msgType); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMessageNotFound
+		}
+		return fmt.Errorf("get message: %w", err)
+	}
+	if msgType.System() {
+		return ErrNotPinnable
+	}
+
+	const count = `
+        SELECT COUNT(*) FROM message_pins p
+        JOIN messages m ON m.id = p.message_id
+        WHERE (m.from_id = $1 AND m.to_id = $2) OR (m.from_id = $2 AND m.to_id = $1)`
+
+	var pins int
+	if err := tx.QueryRowContext(ctx, count, userID, peerID).Scan(&pins); err != nil {
+		return fmt.Errorf("count pins: %w", err)
+	}
+
+	const q = `
+        INSERT INTO message_pins (message_id, pinned_by, pinned_at)
+        VALUES ($1, $2, $3)
+        ON CONFLICT DO NOTHING`
+
+	res, err := tx.ExecContext(ctx, q, messageID, userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to pin message: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to pin message: %w", err)
+	}
+
+	// Pinning again is a no-op even at the cap; the rollback undoes the
+	// insert when a new pin would go over it.
+	if n == 0 {
+		return nil
+	}
+	if pins >= maxPins {
+		return ErrTooManyPins
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	payload := PinnedMessagePayload{MessageID: messageID}
+	if _, err := s.postSystemMessage(ctx, userID, peerID, MessageTypePinnedMessage, payload, &messageID); err != nil {
+		s.log.Error().Err(err).
+			Str("messageId", messageID.String()).
+			Msg("failed to post pin notice")
+	}
+
+	s.publishPins(ctx, userID, peerID)
+	return nil
+}
+
+// UnpinMessage unpins messageID from userID's conversation with peerID.
+// Like pinning, it is refused while either user has blocked the other.
+func (s *Service) UnpinMessage(ctx context.Context, userID, peerID uuid.UUID, messageID id.ID) error {
+	ok, err := s.unblocked(ctx, userID, peerID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCannotPin
+	}
+
+	const q = `
+        DELETE FROM message_pins p
+        USING messages m
+        WHERE p.message_id = $3 AND m.id = p.message_id
+          AND ((m.from_id = $1 AND m.to_id = $2) OR (m.from_id = $2 AND m.to_id = $1))`
+
+	res, err := s.db.ExecContext(ctx, q, userID, peerID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to unpin message: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to unpin message: %w", err)
+	}
+	if n == 0 {
+		return ErrNotPinned
+	}
+
+	s.publishPins(ctx, userID, peerID)
+	return nil
+}
+
+// Pins lists the messages pinned in userID's conversation with peerID, most
+// recently pinned first, as userID sees them.
+func (s *Service) Pins(ctx context.Context, userID, peerID uuid.UUID) ([]Message, error) {
+	blocked, err := s.relationships.HasBlocked(ctx, userID, peerID)
+	if err != nil {
+		return nil, fmt.Errorf("check block: %w", err)
+	}
+
+	const q = `
+        SELECT m.id, m.type, m.from_id, m.to_id, m.content, m.created_at, m.updated_at
+        FROM message_pins p
+        JOIN messages m ON m.id = p.message_id
+        WHERE (m.from_id = $1 AND m.to_id = $2) OR (m.from_id = $2 AND m.to_id = $1)
+        ORDER BY p.pinned_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, q, userID, peerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pins: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg := Message{Pinned: true}
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.Type,
+			&msg.FromID,
+			&msg.ToID,
+			&msg.Content,
+			&msg.CreatedAt,
+			&msg.UpdatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		if blocked && msg.FromID == peerID {
+			msg.Content = ""
+			msg.Blocked = true
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pins: %w", err)
+	}
+
+	if err := s.attachFiles(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := s.attachMentions(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := s.attachReactions(ctx, userID, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// publishPins sends PINS_UPDATE to both users of the conversation.
+func (s *Service) publishPins(ctx context.Context, userID, peerID uuid.UUID) {
+	const q = `
+        SELECT MAX(p.pinned_at) FROM message_pins p
+        JOIN messages m ON m.id = p.message_id
+        WHERE (m.from_id = $1 AND m.to_id = $2) OR (m.from_id = $2 AND m.to_id = $1)`
+
+	var last sql.NullTime
+	if err := s.db.QueryRowContext(ctx, q, userID, peerID).Scan(&last); err != nil {
+		s.log.Error().Err(err).Msg("failed to get last pin")
+		return
+	}
+
+	update := PinsUpdate{ConversationID: peerID.String()}
+	if last.Valid {
+		update.LastPinTimestamp = &last.Time
+	}
+	if err := s.events.Publish(ctx, userID, event.PinsUpdate, update); err != nil {
+		s.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to publish pins update")
+	}
+
+	update.ConversationID = userID.String()
+	if err := s.events.Publish(ctx, peerID, event.PinsUpdate, update); err != nil {
+		s.log.Error().Err(err).Str("userId", peerID.String()).Msg("failed to publish pins update")
+	}
+}
+
+// pinsKey names a conversation's pins the same way whichever side is acting.
+func pinsKey(a, b uuid.UUID) string {
+	if a.String() > b.String() {
+		a, b = b, a
+	}
+	return "pins:" + a.String() + ":" + b.String()
+}
@@ -0,0 +1,369 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/event"
+	"discord/internal/id"
+	"discord/internal/user"
+	"errors"
+	"fmt"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidEmoji = errors.New("invalid emoji")
+	ErrCannotReact  = errors.New("you cannot react to messages in this conversation")
+)
+
+// customEmoji matches a custom emoji written as name:id.
+var customEmoji = regexp.MustCompile(`^[A-Za-z0-9_]{2,32}:[1-9][0-9]{0,18}$`)
+
+// Reaction is the aggregate of one emoji on a message. Me is set when the
+// reader is among those who reacted with it.
+type Reaction struct {
+	Emoji string `json:"emoji" example:"👍"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me"`
+}
+
+// ReactionEvent is the payload of MESSAGE_REACTION_ADD and
+// MESSAGE_REACTION_REMOVE. ConversationID is the peer of the receiving
+// user, as in the conversation list.
+type ReactionEvent struct {
+	UserID         string `json:"userId"`
+	ConversationID string `json:"conversationId"`
+	MessageID      string `json:"messageId"`
+	Emoji          string `json:"emoji"`
+}
+
+// ParseEmoji checks that s is a single Unicode emoji, or a custom emoji as
+// name:id.
+func ParseEmoji(s string) (string, error) {
+	if customEmoji.MatchString(s) {
+		return s, nil
+	}
+
+	if s == "" || len(s) > 64 || !utf8.ValidString(s) || !isEmoji([]rune(s)) {
+		return "", ErrInvalidEmoji
+	}
+	return s, nil
+}
+
+const (
+	zeroWidthJoiner   = '\u200d'
+	variationSelector = '\ufe0f'
+	keycapMark        = '\u20e3'
+	tagEnd            = '\U000e007f'
+)
+
+// isEmoji reports whether rs is one emoji: a keycap, a flag, or pictographs
+// joined by zero width joiners.
+func isEmoji(rs []rune) bool {
+	switch {
+	case isKeycapBase(rs[0]):
+		// 0-9, # or *, then an optional variation selector, then the
+		// keycap mark.
+		n := len(rs)
+		return (n == 2 || (n == 3 && rs[1] == variationSelector)) && rs[n-1] == keycapMark
+	case isRegionalIndicator(rs[0]):
+		return len(rs) == 2 && isRegionalIndicator(rs[1])
+	}
+
+	elements := splitRunes(rs, zeroWidthJoiner)
+	for _, e := range elements {
+		if !isEmojiElement(e, len(elements) > 1) {
+			return false
+		}
+	}
+	return true
+}
+
+// isEmojiElement reports whether rs is a pictograph, optionally followed by
+// a variation selector or a skin tone, and by a tag sequence. Outside a
+// joined sequence, a pictograph shown as text by default, such as ©, needs
+// the variation selector or a skin tone to count.
+func isEmojiElement(rs []rune, joined bool) bool {
+	if len(rs) == 0 || !unicode.Is(extendedPictographic, rs[0]) {
+		return false
+	}
+	presented := joined || unicode.Is(emojiPresentation, rs[0])
+	rest := rs[1:]
+
+	if len(rest) > 0 && (rest[0] == variationSelector || isSkinTone(rest[0])) {
+		presented = true
+		rest = rest[1:]
+	}
+
+	// Subdivision flags spell their region in tags, ending with a cancel
+	// tag.
+	if len(rest) > 0 {
+		if len(rest) < 2 || rest[len(rest)-1] != tagEnd {
+			return false
+		}
+		for _, r := range rest[:len(rest)-1] {
+			if r < 0xe0020 || r > 0xe007e {
+				return false
+			}
+		}
+	}
+
+	return presented
+}
+
+func isKeycapBase(r rune) bool {
+	return r >= '0' && r <= '9' || r == '#' || r == '*'
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func isSkinTone(r rune) bool {
+	return r >= 0x1f3fb && r <= 0x1f3ff
+}
+
+// splitRunes splits rs around each sep, keeping empty parts.
+func splitRunes(rs []rune, sep rune) [][]rune {
+	var parts [][]rune
+	start := 0
+	for i, r := range rs {
+		if r == sep {
+			parts = append(parts, rs[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, rs[start:])
+}
+
+// AddReaction reacts to messageID as userID. Adding a reaction that is
+// already there changes nothing.
+func (s *Service) AddReaction(ctx context.Context, userID uuid.UUID, messageID id.ID, emoji string) error {
+	peerID, suppressed, err := s.reactionTarget(ctx, userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	const q = `
+        INSERT INTO message_reactions (message_id, emoji, user_id)
+        VALUES ($1, $2, $3)
+        ON CONFLICT DO NOTHING`
+
+	res, err := s.db.ExecContext(ctx, q, messageID, emoji, userID)
+	if err != nil {
+		return fmt.Errorf("failed to add reaction: %w", err)
+	}
+
+	return s.publishReaction(ctx, res, event.MessageReactionAdd, userID, peerID, suppressed, messageID, emoji)
+}
+
+// RemoveReaction takes back userID's reaction to messageID, which is
+// allowed even after a block. Removing a reaction that is not there changes
+// nothing.
+func (s *Service) RemoveReaction(ctx context.Context, userID uuid.UUID, messageID id.ID, emoji string) error {
+	peerID, suppressed, err := s.visiblePeer(ctx, userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	const q = `
+        DELETE FROM message_reactions
+        WHERE message_id = $1 AND emoji = $2 AND user_id = $3`
+
+	res, err := s.db.ExecContext(ctx, q, messageID, emoji, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove reaction: %w", err)
+	}
+
+	return s.publishReaction(ctx, res, event.MessageReactionRemove, userID, peerID, suppressed, messageID, emoji)
+}
+
+// Reactors lists who reacted to messageID with emoji, ordered by user ID.
+// A non-nil after only returns users after that ID.
+func (s *Service) Reactors(ctx context.Context, userID uuid.UUID, messageID id.ID, emoji string, after *uuid.UUID, limit int) ([]user.Profile, error) {
+	if _, _, err := s.visiblePeer(ctx, userID, messageID); err != nil {
+		return nil, err
+	}
+
+	const q = `
+        SELECT user_id FROM message_reactions
+        WHERE message_id = $1 AND emoji = $2 AND ($3::uuid IS NULL OR user_id > $3)
+        ORDER BY user_id
+        LIMIT $4`
+
+	rows, err := s.db.QueryContext(ctx, q, messageID, emoji, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query reactions: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var reactorID string
+		if err := rows.Scan(&reactorID); err != nil {
+			return nil, fmt.Errorf("failed to scan reaction: %w", err)
+		}
+		ids = append(ids, reactorID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating reactions: %w", err)
+	}
+
+	users := []user.Profile{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	profiles, err := s.userService.GetProfiles(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("get profiles: %w", err)
+	}
+
+	byID := make(map[string]user.Profile, len(profiles))
+	for _, p := range profiles {
+		byID[p.ID] = p
+	}
+	for _, reactorID := range ids {
+		if p, ok := byID[reactorID]; ok {
+			users = append(users, p)
+		}
+	}
+
+	return users, nil
+}
+
+// attachReactions fills in the reactions on messages as readerID sees them.
+func (s *Service) attachReactions(ctx context.Context, readerID uuid.UUID, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(messages))
+	index := make(map[id.ID]int, len(messages))
+	for i, m := range messages {
+		ids[i] = int64(m.ID)
+		index[m.ID] = i
+	}
+
+	const q = `
+        SELECT message_id, emoji, COUNT(*), bool_or(user_id = $1)
+        FROM message_reactions
+        WHERE message_id = ANY($2)
+        GROUP BY message_id, emoji
+        ORDER BY message_id, MIN(created_at)`
+
+	rows, err := s.db.QueryContext(ctx, q, readerID, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to query reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID id.ID
+		var r Reaction
+		if err := rows.Scan(&messageID, &r.Emoji, &r.Count, &r.Me); err != nil {
+			return fmt.Errorf("failed to scan reaction: %w", err)
+		}
+		if i, ok := index[messageID]; ok {
+			messages[i].Reactions = append(messages[i].Reactions, r)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating reactions: %w", err)
+	}
+	return nil
+}
+
+// reactionTarget is visiblePeer for a user about to react to messageID:
+// neither of them may have blocked the other.
+func (s *Service) reactionTarget(ctx context.Context, userID uuid.UUID, messageID id.ID) (uuid.UUID, bool, error) {
+	peerID, suppressed, err := s.visiblePeer(ctx, userID, messageID)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+
+	ok, err := s.unblocked(ctx, userID, peerID)
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	if !ok {
+		return uuid.Nil, false, ErrCannotReact
+	}
+
+	return peerID, suppressed, nil
+}
+
+// unblocked reports whether neither user has blocked the other.
+func (s *Service) unblocked(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	for _, pair := range [][2]uuid.UUID{{userID, peerID}, {peerID, userID}} {
+		blocked, err := s.relationships.HasBlocked(ctx, pair[0], pair[1])
+		if err != nil {
+			return false, fmt.Errorf("check block: %w", err)
+		}
+		if blocked {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// visiblePeer returns the other user in messageID's conversation, provided
+// userID is part of it and received the message, and whether the message
+// was suppressed. Only its sender can see a suppressed message.
+func (s *Service) visiblePeer(ctx context.Context, userID uuid.UUID, messageID id.ID) (uuid.UUID, bool, error) {
+	const q = `
+        SELECT CASE WHEN from_id = $2 THEN to_id ELSE from_id END, suppressed
+        FROM messages
+        WHERE id = $1 AND (from_id = $2 OR to_id = $2)
+          AND NOT (suppressed AND to_id = $2)`
+
+	var peerID uuid.UUID
+	var suppressed bool
+	if err := s.db.QueryRowContext(ctx, q, messageID, userID).Scan(&peerID, &suppressed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, false, ErrMessageNotFound
+		}
+		return uuid.Nil, false, fmt.Errorf("get message: %w", err)
+	}
+	return peerID, suppressed, nil
+}
+
+// publishReaction tells both users about a reaction change, unless res
+// shows nothing changed. The peer is not told about reactions to a
+// suppressed message, which they never received: that would reveal the
+// sender wrote while blocked.
+func (s *Service) publishReaction(ctx context.Context, res sql.Result, eventType string, userID, peerID uuid.UUID, suppressed bool, messageID id.ID, emoji string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update reaction: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	payload := ReactionEvent{
+		UserID:         userID.String(),
+		ConversationID: peerID.String(),
+		MessageID:      messageID.String(),
+		Emoji:          emoji,
+	}
+	if err := s.events.Publish(ctx, userID, eventType, payload); err != nil {
+		s.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to publish reaction")
+	}
+	if suppressed {
+		return nil
+	}
+
+	payload.ConversationID = userID.String()
+	if err := s.events.Publish(ctx, peerID, eventType, payload); err != nil {
+		s.log.Error().Err(err).Str("userId", peerID.String()).Msg("failed to publish reaction")
+	}
+
+	return nil
+}
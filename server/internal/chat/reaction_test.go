@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEmoji(t *testing.T) {
+	tests := []struct {
+		in    string
+		valid bool
+	}{
+		{"👍", true},
+		{"❤️", true},      // with variation selector
+		{"👍🏽", true},      // skin tone
+		{"👩‍👩‍👧", true},   // zero width joiners
+		{"🏳️‍🌈", true},    // flag sequence
+		{"🇯🇵", true},      // regional indicators
+		{"1️⃣", true},     // keycap
+		{"#⃣", true},      // keycap without variation selector
+		{"🏴󠁧󠁢󠁳󠁣󠁴󠁿", true}, // tag sequence
+		{"©️", true},      // text pictograph with variation selector
+		{"☝🏽", true},      // text pictograph with skin tone
+		{"👨‍⚕️", true},    // joined text pictograph
+		{"party_parrot:123456789", true},
+		{"ab:1", true},
+		{"", false},
+		{"a", false},
+		{"1", false},
+		{"#", false},
+		{"👍 ", false},
+		{"👍a", false},
+		{"<script>", false},
+		{"\u200d", false}, // a joiner alone
+		{"\xff", false},
+		{strings.Repeat("👍", 17), false}, // over 64 bytes
+		{"©", false},
+		{"°", false},
+		{"™", false},
+		{"👍👍👍", false},
+		{"👍🏽🏽", false},
+		{"🏽", false},
+		{"👍\u200d", false},
+		{"12345\u20e3", false},
+		{"1\u20e3\u20e3", false},
+		{"\u20e3", false},
+		{"🇯", false},
+		{"🇯🇵🇯", false},
+		{"🏴\U000e007f", false}, // cancel tag without a region
+		{"a:1", false},         // name too short
+		{"party parrot:1", false},
+		{"parrot:0", false},
+		{"parrot:01", false},
+		{"parrot:12345678901234567890", false},
+		{"parrot:", false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseEmoji(tt.in)
+		switch {
+		case tt.valid && (err != nil || got != tt.in):
+			t.Errorf("ParseEmoji(%q) = %q, %v, want it accepted", tt.in, got, err)
+		case !tt.valid && err != ErrInvalidEmoji:
+			t.Errorf("ParseEmoji(%q) = %q, %v, want ErrInvalidEmoji", tt.in, got, err)
+		}
+	}
+}
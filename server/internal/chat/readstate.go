@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/event"
+	"discord/internal/id"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+type AckRequest struct {
+	MessageID string `json:"messageId" validate:"required,number"`
+}
+
+// AckCommand is the data of a MESSAGE_ACK command.
+type AckCommand struct {
+	UserID    string `json:"userId"`
+	MessageID string `json:"messageId"`
+}
+
+// Ack is the payload of a MESSAGE_ACK event: UserID has read up to
+// MessageID in the conversation the receiving client knows as
+// ConversationID. When UserID is the receiver, it is one of their other
+// devices catching up; otherwise it is a read receipt from the peer.
+type Ack struct {
+	UserID         string    `json:"userId"`
+	ConversationID string    `json:"conversationId"`
+	MessageID      string    `json:"messageId"`
+	ReadAt         time.Time `json:"readAt"`
+}
+
+// AckMessage marks userID's conversation with peerID as read up to
+// messageID. Read states only move forward; acking an older message is a
+// no-op. The peer is told too, if userID shares read receipts.
+func (s *Service) AckMessage(ctx context.Context, userID, peerID uuid.UUID, messageID id.ID) error {
+	const find = `
+        SELECT created_at FROM messages
+        WHERE id = $3
+          AND ((from_id = $1 AND to_id = $2) OR (from_id = $2 AND to_id = $1))
+          AND NOT (suppressed AND to_id = $1)`
+
+	var createdAt time.Time
+	if err := s.db.QueryRowContext(ctx, find, userID, peerID, messageID).Scan(&createdAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMessageNotFound
+		}
+		return fmt.Errorf("get message: %w", err)
+	}
+
+	// Mentions in messages after the one acked stay counted.
+	const q = `
+        INSERT INTO read_states (user_id, peer_id, last_read_message_id, last_read_at, mention_count, updated_at)
+        VALUES ($1, $2, $3, $4, (
+            SELECT COUNT(*) FROM messages m
+            WHERE m.from_id = $2 AND m.to_id = $1 AND m.id > $3 AND m.mentions_recipient
+        ), $5)
+        ON CONFLICT (user_id, peer_id) DO UPDATE SET
+            last_read_message_id = EXCLUDED.last_read_message_id,
+            last_read_at = EXCLUDED.last_read_at,
+            mention_count = EXCLUDED.mention_count,
+            updated_at = EXCLUDED.updated_at
+        WHERE read_states.last_read_message_id IS NULL
+           OR read_states.last_read_message_id < EXCLUDED.last_read_message_id`
+
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, q, userID, peerID, messageID, createdAt, now)
+	if err != nil {
+		return fmt.Errorf("failed to update read state: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update read state: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	self := Ack{
+		UserID:         userID.String(),
+		ConversationID: peerID.String(),
+		MessageID:      messageID.String(),
+		ReadAt:         now,
+	}
+	if err := s.events.Publish(ctx, userID, event.MessageAck, self); err != nil {
+		s.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to publish ack")
+	}
+
+	share, err := s.sharesReceipts(ctx, userID, peerID)
+	if err != nil {
+		s.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to check read receipts")
+		return nil
+	}
+	if share {
+		receipt := self
+		receipt.ConversationID = userID.String()
+		if err := s.events.Publish(ctx, peerID, event.MessageAck, receipt); err != nil {
+			s.log.Error().Err(err).Str("userId", peerID.String()).Msg("failed to publish read receipt")
+		}
+	}
+
+	return nil
+}
+
+// addMention counts a new message mentioning userID in their conversation
+// with peerID as unread. A conversation userID has never read starts its
+// read state here.
+func addMention(ctx context.Context, tx *sql.Tx, userID, peerID uuid.UUID) error {
+	const q = `
+        INSERT INTO read_states (user_id, peer_id, last_read_at, mention_count, updated_at)
+        VALUES ($1, $2, 'epoch', 1, NOW())
+        ON CONFLICT (user_id, peer_id) DO UPDATE SET
+            mention_count = read_states.mention_count + 1,
+            updated_at = EXCLUDED.updated_at`
+
+	if _, err := tx.ExecContext(ctx, q, userID, peerID); err != nil {
+		return fmt.Errorf("count mention: %w", err)
+	}
+	return nil
+}
+
+// sharesReceipts reports whether peerID may see how far userID has read:
+// userID must have read receipts on, and neither may have blocked the other.
+func (s *Service) sharesReceipts(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	st, err := s.settings.Get(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("get settings: %w", err)
+	}
+	if !st.ReadReceipts {
+		return false, nil
+	}
+
+	return s.unblocked(ctx, userID, peerID)
+}
+
+func (s *Service) handleAck(ctx context.Context, userID uuid.UUID, data json.RawMessage) error {
+	var cmd AckCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return &commandError{"invalid data"}
+	}
+
+	peerID, err := uuid.Parse(cmd.UserID)
+	if err != nil {
+		return &commandError{"invalid user id"}
+	}
+	messageID, err := id.Parse(cmd.MessageID)
+	if err != nil {
+		return &commandError{"invalid message id"}
+	}
+
+	if err := s.AckMessage(ctx, userID, peerID, messageID); err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			return &commandError{err.Error()}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/id"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// snippetLength is how many characters of a replied-to message are quoted
+// in the reply.
+const snippetLength = 100
+
+var ErrReferenceNotFound = errors.New("referenced message not found in this conversation")
+
+// ReferencedMessage is the quoted summary of the message a reply answers.
+// A reply whose referencedMessageId is set but has no referencedMessage
+// answers a message that has since been deleted.
+type ReferencedMessage struct {
+	ID        id.ID     `json:"id" swaggertype:"string" example:"1234567890123456789"`
+	FromID    uuid.UUID `json:"fromId"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Blocked is set when the reader has blocked the author. The content
+	// is withheld, as it is for the message itself.
+	Blocked bool `json:"blocked,omitempty"`
+
+	// suppressed is whether the referenced message was kept from its
+	// recipient.
+	suppressed bool
+	toID       uuid.UUID
+}
+
+// resolveReference checks that msg's reference points at a message the
+// sender can see in the same conversation, and embeds its summary.
+func (s *Service) resolveReference(ctx context.Context, msg *Message) error {
+	if msg.ReferencedMessageID == nil {
+		return nil
+	}
+
+	const q = `
+        SELECT id, from_id, to_id, content, created_at, suppressed
+        FROM messages
+        WHERE id = $3
+          AND ((from_id = $1 AND to_id = $2) OR (from_id = $2 AND to_id = $1))
+          AND NOT (suppressed AND to_id = $1)`
+
+	var ref ReferencedMessage
+	err := s.db.QueryRowContext(ctx, q, msg.FromID, msg.ToID, *msg.ReferencedMessageID).Scan(
+		&ref.ID,
+		&ref.FromID,
+		&ref.toID,
+		&ref.Content,
+		&ref.CreatedAt,
+		&ref.suppressed,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrReferenceNotFound
+		}
+		return fmt.Errorf("get referenced message: %w", err)
+	}
+
+	ref.Content = snippet(ref.Content)
+	msg.ReferencedMessage = &ref
+	return nil
+}
+
+// referenceFor returns the summary of msg's reference as readerID may see
+// it, or nil if they may not see the referenced message at all.
+func referenceFor(ref *ReferencedMessage, readerID uuid.UUID) *ReferencedMessage {
+	if ref == nil || (ref.suppressed && ref.toID == readerID) {
+		return nil
+	}
+	return ref
+}
+
+// snippet cuts content down to snippetLength characters.
+func snippet(content string) string {
+	if utf8.RuneCountInString(content) <= snippetLength {
+		return content
+	}
+	runes := []rune(content)
+	return string(runes[:snippetLength-1]) + "…"
+}
@@ -0,0 +1,229 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/id"
+	"discord/internal/search"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var ErrInvalidSearch = errors.New("invalid search")
+
+// SearchPage is one page of search results, newest first. NextCursor is
+// empty on the last page.
+type SearchPage struct {
+	Messages   []SearchResult `json:"messages"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// SearchResult is a message that matched a search. Snippet is the part of
+// its content around the matched words, split so that matched words are
+// their own parts. It is empty when the search had no words.
+type SearchResult struct {
+	Message
+	Snippet []search.SnippetPart `json:"snippet,omitempty"`
+}
+
+// parseSearch splits q into words and filters. Filters are key:value
+// pairs: from:, in: and mentions: take a username, a user ID or "me";
+// has: takes attachment, image or link; before: and after: take a date as
+// YYYY-MM-DD in UTC, and exclude that day.
+func (s *Service) parseSearch(ctx context.Context, userID uuid.UUID, q string) (*search.Query, error) {
+	sq := search.Query{UserID: userID}
+	var terms []string
+
+	for _, field := range strings.Fields(q) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			terms = append(terms, field)
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "from", "in", "mentions":
+			target, err := s.searchUser(ctx, userID, value)
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToLower(key) {
+			case "from":
+				sq.From = append(sq.From, target)
+			case "in":
+				if sq.In != nil && *sq.In != target {
+					return nil, fmt.Errorf("%w: in: can only be given once", ErrInvalidSearch)
+				}
+				sq.In = &target
+			case "mentions":
+				sq.Mentions = append(sq.Mentions, target)
+			}
+		case "has":
+			switch strings.ToLower(value) {
+			case "attachment", "file":
+				sq.HasAttachment = true
+			case "image":
+				sq.HasImage = true
+			case "link":
+				sq.HasLink = true
+			default:
+				return nil, fmt.Errorf("%w: has: must be attachment, image or link", ErrInvalidSearch)
+			}
+		case "before", "after":
+			day, err := time.Parse(time.DateOnly, value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: must be a date as YYYY-MM-DD", ErrInvalidSearch, key)
+			}
+			if strings.ToLower(key) == "before" {
+				bound := id.At(day)
+				sq.Before = &bound
+			} else {
+				bound := id.At(day.AddDate(0, 0, 1))
+				sq.After = &bound
+			}
+		default:
+			// Not a filter, just a word with a colon in it.
+			terms = append(terms, field)
+		}
+	}
+
+	sq.Terms = strings.Join(terms, " ")
+	if sq.Terms == "" && len(sq.From) == 0 && sq.In == nil && len(sq.Mentions) == 0 &&
+		!sq.HasAttachment && !sq.HasImage && !sq.HasLink && sq.Before == nil && sq.After == nil {
+		return nil, fmt.Errorf("%w: search for some words or use a filter", ErrInvalidSearch)
+	}
+	return &sq, nil
+}
+
+// searchUser resolves the user a filter names.
+func (s *Service) searchUser(ctx context.Context, userID uuid.UUID, value string) (uuid.UUID, error) {
+	value = strings.TrimPrefix(value, "@")
+	if value == "" {
+		return uuid.Nil, fmt.Errorf("%w: filters need a user", ErrInvalidSearch)
+	}
+	if strings.EqualFold(value, "me") {
+		return userID, nil
+	}
+	if parsed, err := uuid.Parse(value); err == nil {
+		return parsed, nil
+	}
+
+	profile, err := s.userService.GetProfileByUsername(ctx, value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, fmt.Errorf("%w: no user named %s", ErrInvalidSearch, value)
+		}
+		return uuid.Nil, fmt.Errorf("get user: %w", err)
+	}
+	return uuid.Parse(profile.ID)
+}
+
+// SearchMessages finds messages in userID's conversations that match q,
+// newest first. Messages from users userID has blocked are left out. A
+// non-zero before continues from the message with that ID.
+func (s *Service) SearchMessages(ctx context.Context, userID uuid.UUID, q string, before id.ID, limit int) (*SearchPage, error) {
+	sq, err := s.parseSearch(ctx, userID, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if before != 0 && (sq.Before == nil || before < *sq.Before) {
+		sq.Before = &before
+	}
+	sq.Limit = limit
+
+	blocked, err := s.relationships.Blocked(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get blocked users: %w", err)
+	}
+	for _, rel := range blocked {
+		if peer, err := uuid.Parse(rel.User.ID); err == nil {
+			sq.ExcludeFrom = append(sq.ExcludeFrom, peer)
+		}
+	}
+
+	hits, err := s.index.Search(ctx, *sq)
+	if err != nil {
+		return nil, err
+	}
+	if len(hits) == 0 {
+		return &SearchPage{Messages: []SearchResult{}}, nil
+	}
+
+	ids := make([]int64, len(hits))
+	for i, hit := range hits {
+		ids[i] = int64(hit.ID)
+	}
+
+	// An index kept apart from the database may lag behind it, so access
+	// is checked again here.
+	const query = `
+        SELECT m.id, m.type, m.from_id, m.to_id, m.content, m.created_at, m.updated_at,
+            EXISTS (SELECT 1 FROM message_pins p WHERE p.message_id = m.id)
+        FROM messages m
+        WHERE m.id = ANY($1)
+          AND (m.from_id = $2 OR (m.to_id = $2 AND NOT m.suppressed))`
+
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(ids), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[id.ID]Message, len(ids))
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.Type,
+			&msg.FromID,
+			&msg.ToID,
+			&msg.Content,
+			&msg.CreatedAt,
+			&msg.UpdatedAt,
+			&msg.Pinned,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		found[msg.ID] = msg
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	var messages []Message
+	var snippets [][]search.SnippetPart
+	for _, hit := range hits {
+		if msg, ok := found[hit.ID]; ok {
+			messages = append(messages, msg)
+			snippets = append(snippets, hit.Snippet)
+		}
+	}
+
+	if err := s.attachFiles(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := s.attachMentions(ctx, messages); err != nil {
+		return nil, err
+	}
+	if err := s.attachReactions(ctx, userID, messages); err != nil {
+		return nil, err
+	}
+
+	page := &SearchPage{Messages: make([]SearchResult, len(messages))}
+	for i, msg := range messages {
+		page.Messages[i] = SearchResult{Message: msg, Snippet: snippets[i]}
+	}
+	// The cursor follows the index, so a page thinned by the check above
+	// still leads on to the next.
+	if len(hits) == limit {
+		page.NextCursor = hits[len(hits)-1].ID.String()
+	}
+	return page, nil
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"context"
+	"discord/internal/event"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Clients stop showing a typing indicator this long after the last
+	// TYPING_START they received.
+	typingTimeout = 8 * time.Second
+
+	// At most one TYPING_START per sender and recipient is forwarded in
+	// this window. It is shorter than typingTimeout so that someone who
+	// keeps typing never appears to stop.
+	typingThrottle = 5 * time.Second
+)
+
+var ErrTypingToSelf = errors.New("cannot send typing to yourself")
+
+// TypingStart is the payload of a TYPING_START event.
+type TypingStart struct {
+	UserID    string    `json:"userId"`
+	Timestamp time.Time `json:"timestamp"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// StartTyping tells peerID that userID is typing to them. Typing is never
+// stored beyond the throttle key in Redis. It is silently dropped when
+// throttled, or when peerID would not see a message from userID in their
+// conversation list.
+func (s *Service) StartTyping(ctx context.Context, userID, peerID uuid.UUID) error {
+	if userID == peerID {
+		return ErrTypingToSelf
+	}
+
+	ok, err := s.redis.SetNX(ctx, typingKey(userID, peerID), 1, typingThrottle).Result()
+	if err != nil {
+		return fmt.Errorf("throttle typing: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	blocked, err := s.relationships.HasBlocked(ctx, peerID, userID)
+	if err != nil {
+		return fmt.Errorf("check block: %w", err)
+	}
+	if blocked {
+		return nil
+	}
+
+	state, err := s.recipientState(ctx, userID, peerID)
+	if err != nil {
+		if errors.Is(err, ErrDMNotAllowed) {
+			return nil
+		}
+		return err
+	}
+	if state != StateActive {
+		return nil
+	}
+
+	now := time.Now()
+	typing := TypingStart{
+		UserID:    userID.String(),
+		Timestamp: now,
+		ExpiresAt: now.Add(typingTimeout),
+	}
+	if err := s.events.Publish(ctx, peerID, event.TypingStart, typing); err != nil {
+		return fmt.Errorf("publish typing: %w", err)
+	}
+
+	return nil
+}
+
+func typingKey(userID, peerID uuid.UUID) string {
+	return fmt.Sprintf("typing:%s:%s", userID.String(), peerID.String())
+}
@@ -0,0 +1,76 @@
+package chat
+
+import (
+	"context"
+	"discord/internal/attachment"
+	"discord/internal/event"
+	"discord/internal/id"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MessageUpdate is the payload of MESSAGE_UPDATE. It holds the message's
+// ID and the fields that changed. ConversationID is the peer of the
+// receiving user, as in the conversation list.
+type MessageUpdate struct {
+	ID             id.ID                   `json:"id" swaggertype:"string"`
+	ConversationID string                  `json:"conversationId"`
+	Attachments    []attachment.Attachment `json:"attachments,omitempty"`
+}
+
+// watchAttachments sends MESSAGE_UPDATE for messages whose attachments got
+// their thumbnails after the message was sent.
+func (s *Service) watchAttachments() {
+	for messageID := range s.attachments.Processed() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := s.publishAttachments(ctx, messageID); err != nil {
+			s.log.Error().Err(err).Str("messageId", messageID.String()).Msg("failed to publish attachment update")
+		}
+		cancel()
+	}
+}
+
+func (s *Service) publishAttachments(ctx context.Context, messageID id.ID) error {
+	const q = `SELECT from_id, to_id, suppressed FROM messages WHERE id = $1`
+
+	var fromID, toID uuid.UUID
+	var suppressed bool
+	if err := s.db.QueryRowContext(ctx, q, messageID).Scan(&fromID, &toID, &suppressed); err != nil {
+		return fmt.Errorf("get message: %w", err)
+	}
+
+	files, err := s.attachments.ForMessages(ctx, []id.ID{messageID})
+	if err != nil {
+		return fmt.Errorf("get attachments: %w", err)
+	}
+
+	update := MessageUpdate{
+		ID:             messageID,
+		ConversationID: toID.String(),
+		Attachments:    files[messageID],
+	}
+	if err := s.events.Publish(ctx, fromID, event.MessageUpdate, update); err != nil {
+		s.log.Error().Err(err).Str("userId", fromID.String()).Msg("failed to publish message update")
+	}
+
+	// The recipient never saw a suppressed message, and sees no files
+	// from someone they blocked.
+	if suppressed {
+		return nil
+	}
+	blocked, err := s.relationships.HasBlocked(ctx, toID, fromID)
+	if err != nil {
+		return fmt.Errorf("check block: %w", err)
+	}
+	if blocked {
+		return nil
+	}
+
+	update.ConversationID = fromID.String()
+	if err := s.events.Publish(ctx, toID, event.MessageUpdate, update); err != nil {
+		s.log.Error().Err(err).Str("userId", toID.String()).Msg("failed to publish message update")
+	}
+	return nil
+}
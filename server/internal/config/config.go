@@ -1,6 +1,7 @@
 package config
 
 import (
+	"discord/internal/id"
 	"fmt"
 	"time"
 
@@ -9,11 +10,19 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig `mapstructure:"server"`
-	Database DBConfig     `mapstructure:"database"`
-	JWT      JWTConfig    `mapstructure:"jwt"`
-	Log      LogConfig    `mapstructure:"log"`
-	Redis    RedisConfig  `mapstructure:"redis"`
+	Server    ServerConfig    `mapstructure:"server"`
+	Database  DBConfig        `mapstructure:"database"`
+	JWT       JWTConfig       `mapstructure:"jwt"`
+	Log       LogConfig       `mapstructure:"log"`
+	Redis     RedisConfig     `mapstructure:"redis"`
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	Mail      MailConfig      `mapstructure:"mail"`
+	Account   AccountConfig   `mapstructure:"account"`
+	Presence  PresenceConfig  `mapstructure:"presence"`
+	ID        IDConfig        `mapstructure:"id"`
+	Storage   StorageConfig   `mapstructure:"storage"`
+	Upload    UploadConfig    `mapstructure:"upload"`
+	Search    SearchConfig    `mapstructure:"search"`
 }
 
 type ServerConfig struct {
@@ -47,6 +56,99 @@ type RedisConfig struct {
 	DB       int    `mapstructure:"db"`
 }
 
+// RateLimitConfig holds the limits for each route group. Groups without an
+// entry are not limited.
+type RateLimitConfig struct {
+	Enabled bool                   `mapstructure:"enabled"`
+	Groups  map[string]LimitConfig `mapstructure:"groups"`
+}
+
+// LimitConfig allows Rate requests per Period, with bursts of up to Burst
+// requests.
+type LimitConfig struct {
+	Rate   int           `mapstructure:"rate"`
+	Period time.Duration `mapstructure:"period"`
+	Burst  int           `mapstructure:"burst"`
+}
+
+// MailConfig selects how outgoing mail is sent: "log" only logs it, which
+// is handy in development, "smtp" delivers it.
+type MailConfig struct {
+	Backend  string `mapstructure:"backend"`
+	From     string `mapstructure:"from"`
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+type AccountConfig struct {
+	UsernameCooldown time.Duration `mapstructure:"username_cooldown"`
+	EmailTokenTTL    time.Duration `mapstructure:"email_token_ttl"`
+	// VerifyEmailURL is the client page that confirms an email change; the
+	// token is appended as the "token" query parameter.
+	VerifyEmailURL string `mapstructure:"verify_email_url"`
+}
+
+// PresenceConfig controls how long a websocket connection counts as online
+// without a heartbeat, and how often each node looks for connections that
+// have lapsed, e.g. because the node holding them died.
+type PresenceConfig struct {
+	ConnectionTTL time.Duration `mapstructure:"connection_ttl"`
+	SweepInterval time.Duration `mapstructure:"sweep_interval"`
+}
+
+// IDConfig sets this node's worker ID for generating IDs. No two nodes may
+// run with the same one at the same time. A WorkerID of -1, the default,
+// leases a free one from Redis for LeaseTTL at a time instead.
+type IDConfig struct {
+	WorkerID int64         `mapstructure:"worker_id"`
+	LeaseTTL time.Duration `mapstructure:"lease_ttl"`
+}
+
+// StorageConfig selects where uploaded files are kept: "local" writes them
+// under LocalPath, "s3" puts them in a bucket on an S3-compatible service.
+type StorageConfig struct {
+	Backend   string   `mapstructure:"backend"`
+	LocalPath string   `mapstructure:"local_path"`
+	S3        S3Config `mapstructure:"s3"`
+}
+
+// S3Config addresses a bucket. With PathStyle, objects live at
+// Endpoint/Bucket/key rather than at Bucket.Endpoint/key, as MinIO expects.
+type S3Config struct {
+	Endpoint  string `mapstructure:"endpoint"`
+	Region    string `mapstructure:"region"`
+	Bucket    string `mapstructure:"bucket"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey string `mapstructure:"secret_key"`
+	PathStyle bool   `mapstructure:"path_style"`
+}
+
+// UploadConfig limits attachment uploads and controls their download
+// links, which are signed with URLSecret and expire after URLTTL. BaseURL
+// is where clients reach the API. ImageWorkers is how many images each
+// node makes thumbnails for at once. Quota is the storage each user may
+// use, in bytes, and uploads not sent within UnsentTTL are deleted.
+type UploadConfig struct {
+	MaxFileSize  int64         `mapstructure:"max_file_size"`
+	URLSecret    string        `mapstructure:"url_secret"`
+	URLTTL       time.Duration `mapstructure:"url_ttl"`
+	BaseURL      string        `mapstructure:"base_url"`
+	ImageWorkers int           `mapstructure:"image_workers"`
+	Quota        int64         `mapstructure:"quota"`
+	UnsentTTL    time.Duration `mapstructure:"unsent_ttl"`
+}
+
+// SearchConfig selects the message search index: "postgres" searches the
+// messages table with its full-text index, "bleve" keeps an index on disk
+// at BlevePath on every node, off the primary database, and passes changes
+// between nodes through Redis.
+type SearchConfig struct {
+	Backend   string `mapstructure:"backend"`
+	BlevePath string `mapstructure:"bleve_path"`
+}
+
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -70,6 +172,36 @@ func Load() (*Config, error) {
 	viper.SetDefault("redis.password", "")
 	viper.SetDefault("redis.db", 0)
 
+	viper.SetDefault("rate_limit.enabled", true)
+
+	viper.SetDefault("mail.backend", "log")
+	viper.SetDefault("mail.from", "no-reply@localhost")
+	viper.SetDefault("mail.port", 587)
+
+	viper.SetDefault("account.username_cooldown", "1h")
+	viper.SetDefault("account.email_token_ttl", "24h")
+	viper.SetDefault("account.verify_email_url", "http://localhost:3000/verify-email")
+
+	viper.SetDefault("presence.connection_ttl", "2m")
+	viper.SetDefault("presence.sweep_interval", "30s")
+
+	viper.SetDefault("id.worker_id", -1)
+	viper.SetDefault("id.lease_ttl", "30s")
+
+	viper.SetDefault("storage.backend", "local")
+	viper.SetDefault("storage.local_path", "data/blobs")
+	viper.SetDefault("storage.s3.region", "us-east-1")
+
+	viper.SetDefault("upload.max_file_size", 25<<20)
+	viper.SetDefault("upload.url_ttl", "1h")
+	viper.SetDefault("upload.base_url", "http://localhost:8080")
+	viper.SetDefault("upload.image_workers", 2)
+	viper.SetDefault("upload.quota", 1<<30)
+	viper.SetDefault("upload.unsent_ttl", "24h")
+
+	viper.SetDefault("search.backend", "postgres")
+	viper.SetDefault("search.bleve_path", "data/search.bleve")
+
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("error reading config: %w", err)
 	}
@@ -99,6 +231,47 @@ func validateConfig(cfg *Config) error {
 	if cfg.Redis.Addr == "" {
 		return fmt.Errorf("redis address is required")
 	}
+	if cfg.Mail.Backend != "log" && cfg.Mail.Backend != "smtp" {
+		return fmt.Errorf("mail backend must be log or smtp")
+	}
+	if cfg.Mail.Backend == "smtp" && cfg.Mail.Host == "" {
+		return fmt.Errorf("mail host is required for the smtp backend")
+	}
+	if cfg.Presence.ConnectionTTL <= 0 || cfg.Presence.SweepInterval <= 0 {
+		return fmt.Errorf("presence connection ttl and sweep interval must be positive")
+	}
+	if cfg.ID.WorkerID < -1 || cfg.ID.WorkerID > id.MaxWorker {
+		return fmt.Errorf("id worker id must be between 0 and %d, or -1 to lease one", id.MaxWorker)
+	}
+	if cfg.ID.WorkerID == -1 && cfg.ID.LeaseTTL <= 0 {
+		return fmt.Errorf("id lease ttl must be positive")
+	}
+	if cfg.Storage.Backend != "local" && cfg.Storage.Backend != "s3" {
+		return fmt.Errorf("storage backend must be local or s3")
+	}
+	if cfg.Storage.Backend == "s3" && (cfg.Storage.S3.Endpoint == "" || cfg.Storage.S3.Bucket == "") {
+		return fmt.Errorf("s3 endpoint and bucket are required for the s3 storage backend")
+	}
+	if cfg.Upload.MaxFileSize <= 0 || cfg.Upload.URLTTL <= 0 {
+		return fmt.Errorf("upload max file size and url ttl must be positive")
+	}
+	if cfg.Upload.ImageWorkers <= 0 || cfg.Upload.Quota <= 0 || cfg.Upload.UnsentTTL <= 0 {
+		return fmt.Errorf("upload image workers, quota and unsent ttl must be positive")
+	}
+	if cfg.Upload.URLSecret == "" {
+		return fmt.Errorf("upload url secret is required")
+	}
+	if cfg.Search.Backend != "postgres" && cfg.Search.Backend != "bleve" {
+		return fmt.Errorf("search backend must be postgres or bleve")
+	}
+	if cfg.Search.Backend == "bleve" && cfg.Search.BlevePath == "" {
+		return fmt.Errorf("bleve path is required for the bleve search backend")
+	}
+	for name, l := range cfg.RateLimit.Groups {
+		if l.Rate <= 0 || l.Period <= 0 || l.Burst <= 0 {
+			return fmt.Errorf("rate limit group %q needs a positive rate, period and burst", name)
+		}
+	}
 	return nil
 }
 
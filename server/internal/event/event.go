@@ -0,0 +1,90 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// Event types sent to clients over the websocket.
+const (
+	MessageCreate         = "MESSAGE_CREATE"
+	MessageUpdate         = "MESSAGE_UPDATE"
+	MessageRequestCreate  = "MESSAGE_REQUEST_CREATE"
+	ConversationUpdate    = "CONVERSATION_UPDATE"
+	RelationshipAdd       = "RELATIONSHIP_ADD"
+	RelationshipRemove    = "RELATIONSHIP_REMOVE"
+	PresenceUpdate        = "PRESENCE_UPDATE"
+	TypingStart           = "TYPING_START"
+	MessageAck            = "MESSAGE_ACK"
+	MessageReactionAdd    = "MESSAGE_REACTION_ADD"
+	MessageReactionRemove = "MESSAGE_REACTION_REMOVE"
+	PinsUpdate            = "PINS_UPDATE"
+)
+
+// ChannelPattern matches every per-user event channel.
+const ChannelPattern = "user:*:events"
+
+// Event is the envelope for everything pushed to a websocket client.
+type Event struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Publisher fans events out through Redis, so a user's connections receive
+// them whichever node they are attached to.
+type Publisher struct {
+	redis *redis.Client
+	log   *zerolog.Logger
+}
+
+func NewPublisher(redis *redis.Client, log *zerolog.Logger) *Publisher {
+	return &Publisher{
+		redis: redis,
+		log:   log,
+	}
+}
+
+// Channel is the Redis channel carrying events for userID.
+func Channel(userID uuid.UUID) string {
+	return fmt.Sprintf("user:%s:events", userID.String())
+}
+
+// UserFromChannel extracts the user ID from a channel name built by Channel.
+func UserFromChannel(channel string) (string, bool) {
+	id, ok := strings.CutPrefix(channel, "user:")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(id, ":events")
+}
+
+// Publish sends an event to all of userID's connections.
+func (p *Publisher) Publish(ctx context.Context, userID uuid.UUID, eventType string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshal %s data: %w", eventType, err)
+	}
+
+	payload, err := json.Marshal(Event{Type: eventType, Data: raw})
+	if err != nil {
+		return fmt.Errorf("marshal %s event: %w", eventType, err)
+	}
+
+	channel := Channel(userID)
+	if err := p.redis.Publish(ctx, channel, payload).Err(); err != nil {
+		return fmt.Errorf("publish %s to %s: %w", eventType, channel, err)
+	}
+
+	p.log.Debug().
+		Str("channel", channel).
+		Str("type", eventType).
+		Msg("event published")
+
+	return nil
+}
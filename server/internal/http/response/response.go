@@ -1,50 +1,113 @@
 package response
 
 import (
+	"encoding/json"
 	"net/http"
+)
 
-	"github.com/go-chi/render"
+// Machine-readable error codes. Clients should switch on these rather than
+// on the human-readable title or detail.
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeWrongPassword      = "wrong_password"
+	CodeInvalidToken       = "invalid_token"
+	CodeNotFound           = "not_found"
+	CodeEmailTaken         = "email_taken"
+	CodeUsernameTaken      = "username_taken"
+	CodeUsernameCooldown   = "username_cooldown"
+	CodeAlreadyFriends     = "already_friends"
+	CodeRequestExists      = "friend_request_exists"
+	CodeUserBlocked        = "user_blocked"
+	CodeDMNotAllowed       = "dm_not_allowed"
+	CodeSendInProgress     = "send_in_progress"
+	CodeIdempotencyReused  = "idempotency_key_reused"
+	CodeTooManyPins        = "too_many_pins"
+	CodeFileTooLarge       = "file_too_large"
+	CodeQuotaExceeded      = "storage_quota_exceeded"
+	CodeInvalidLink        = "invalid_download_link"
+	CodeRateLimited        = "rate_limited"
+	CodeInternal           = "internal_error"
 )
 
-type ErrResponse struct {
-	HTTPStatusCode int    `json:"-"`
-	StatusText     string `json:"status"`
-	ErrorText      string `json:"error,omitempty"`
+// Problem is an RFC 7807 problem details object, extended with a stable
+// error code and, for validation failures, a per-field error map.
+// @Description Error response (application/problem+json)
+type Problem struct {
+	Type     string                `json:"type" example:"about:blank"`
+	Title    string                `json:"title" example:"Bad Request"`
+	Status   int                   `json:"status" example:"400"`
+	Code     string                `json:"code" example:"validation_failed"`
+	Detail   string                `json:"detail,omitempty" example:"request validation failed"`
+	Instance string                `json:"instance,omitempty" example:"/api/auth/register"`
+	Errors   map[string]FieldError `json:"errors,omitempty"`
 }
 
-func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
-	render.Status(r, e.HTTPStatusCode)
-	return nil
+// FieldError names the rule a field failed and explains it in the
+// client's language.
+type FieldError struct {
+	Rule    string `json:"rule" example:"min"`
+	Message string `json:"message" example:"password must be at least 8 characters in length"`
 }
 
-func ErrInvalidRequest(err error) render.Renderer {
-	return &ErrResponse{
-		HTTPStatusCode: http.StatusBadRequest,
-		StatusText:     "Invalid request.",
-		ErrorText:      err.Error(),
+// New builds a problem for the given status and code.
+func New(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
 	}
 }
 
-func ErrUnauthorized() render.Renderer {
-	return &ErrResponse{
-		HTTPStatusCode: http.StatusUnauthorized,
-		StatusText:     "Authentication failed.",
-		ErrorText:      "Invalid email or password.",
+// Render writes p as application/problem+json.
+func Render(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
 	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
 }
 
-func ErrConflict(message string) render.Renderer {
-	return &ErrResponse{
-		HTTPStatusCode: http.StatusConflict,
-		StatusText:     "Request conflict.",
-		ErrorText:      message,
-	}
+func ErrInvalidRequest(detail string) *Problem {
+	return New(http.StatusBadRequest, CodeInvalidRequest, detail)
 }
 
-func ErrInternal(err error) render.Renderer {
-	return &ErrResponse{
-		HTTPStatusCode: http.StatusInternalServerError,
-		StatusText:     "Internal server error.",
-		ErrorText:      err.Error(),
-	}
+// ErrValidation reports invalid fields, keyed by their JSON name.
+func ErrValidation(fields map[string]FieldError) *Problem {
+	p := New(http.StatusBadRequest, CodeValidationFailed, "request validation failed")
+	p.Errors = fields
+	return p
+}
+
+func ErrUnauthorized(detail string) *Problem {
+	return New(http.StatusUnauthorized, CodeUnauthorized, detail)
+}
+
+func ErrInvalidCredentials() *Problem {
+	return New(http.StatusUnauthorized, CodeInvalidCredentials, "invalid email or password")
+}
+
+func ErrNotFound(detail string) *Problem {
+	return New(http.StatusNotFound, CodeNotFound, detail)
+}
+
+func ErrConflict(code, detail string) *Problem {
+	return New(http.StatusConflict, code, detail)
+}
+
+// ErrTooManyRequests is sent alongside a Retry-After header.
+func ErrTooManyRequests() *Problem {
+	return New(http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded")
+}
+
+// ErrInternal deliberately carries no detail; the cause is logged by the
+// handler, never sent to the client.
+func ErrInternal() *Problem {
+	return New(http.StatusInternalServerError, CodeInternal, "")
 }
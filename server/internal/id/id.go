@@ -0,0 +1,138 @@
+// Package id generates time-ordered 64-bit IDs in the style of Discord's
+// snowflakes. From the most significant bit down, an ID holds:
+//
+//	41 bits  milliseconds since Epoch
+//	10 bits  worker ID of the node that generated it
+//	12 bits  sequence within the millisecond
+//
+// IDs from any node sort by creation time, so they double as pagination
+// cursors. Every node must run with its own worker ID.
+package id
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Epoch is the start of ID time, 2020-01-01T00:00:00Z in Unix milliseconds.
+const Epoch int64 = 1577836800000
+
+const (
+	workerBits   = 10
+	sequenceBits = 12
+	timeShift    = workerBits + sequenceBits
+
+	// MaxWorker is the largest valid worker ID.
+	MaxWorker   = 1<<workerBits - 1
+	maxSequence = 1<<sequenceBits - 1
+)
+
+var ErrInvalid = errors.New("invalid id")
+
+// ID is a snowflake. It is a string in JSON, since JavaScript numbers cannot
+// hold 64-bit integers exactly.
+type ID int64
+
+// Parse reads an ID in its decimal string form.
+func Parse(s string) (ID, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, ErrInvalid
+	}
+	return ID(n), nil
+}
+
+// At returns the smallest ID generated at t, for comparing IDs against a
+// point in time.
+func At(t time.Time) ID {
+	ms := t.UnixMilli() - Epoch
+	switch {
+	case ms >= 1<<(63-timeShift):
+		return math.MaxInt64
+	case ms < -(1 << (63 - timeShift)):
+		return math.MinInt64
+	}
+	return ID(ms << timeShift)
+}
+
+// Time is when the ID was generated, to the millisecond.
+func (i ID) Time() time.Time {
+	return time.UnixMilli(int64(i)>>timeShift + Epoch).UTC()
+}
+
+func (i ID) String() string {
+	return strconv.FormatInt(int64(i), 10)
+}
+
+func (i ID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.String())
+}
+
+func (i *ID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return ErrInvalid
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*i = parsed
+	return nil
+}
+
+func (i *ID) Scan(src interface{}) error {
+	n, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into id", src)
+	}
+	*i = ID(n)
+	return nil
+}
+
+func (i ID) Value() (driver.Value, error) {
+	return int64(i), nil
+}
+
+// Generator hands out unique IDs for one worker. It is safe for concurrent
+// use.
+type Generator struct {
+	mu       sync.Mutex
+	worker   int64
+	last     int64
+	sequence int64
+}
+
+func NewGenerator(worker int64) (*Generator, error) {
+	if worker < 0 || worker > MaxWorker {
+		return nil, fmt.Errorf("worker id must be between 0 and %d", MaxWorker)
+	}
+	return &Generator{worker: worker}, nil
+}
+
+// Next returns a new ID, greater than any this generator returned before.
+// If the clock steps back, or more than 4096 IDs are asked for within a
+// millisecond, the generator runs slightly ahead of the clock instead of
+// waiting for it.
+func (g *Generator) Next() ID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now().UnixMilli() - Epoch
+	if now > g.last {
+		g.last, g.sequence = now, 0
+	} else {
+		g.sequence++
+		if g.sequence > maxSequence {
+			g.last, g.sequence = g.last+1, 0
+		}
+	}
+
+	return ID(g.last<<timeShift | g.worker<<sequenceBits | g.sequence)
+}
@@ -0,0 +1,139 @@
+package id
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ID
+		wantErr bool
+	}{
+		{in: "1", want: 1},
+		{in: "175928847299117063", want: 175928847299117063},
+		{in: "9223372036854775807", want: 9223372036854775807},
+		{in: "0", wantErr: true},
+		{in: "-5", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "12a", wantErr: true},
+		{in: " 12", wantErr: true},
+		{in: "9223372036854775808", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.wantErr {
+			if err != ErrInvalid {
+				t.Errorf("Parse(%q) error = %v, want ErrInvalid", tt.in, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	tests := []struct {
+		id   ID
+		want time.Time
+	}{
+		{id: 0, want: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{id: ID(1500) << timeShift, want: time.Date(2020, 1, 1, 0, 0, 1, 500e6, time.UTC)},
+		// Worker and sequence bits do not change the time.
+		{id: ID(1500)<<timeShift | MaxWorker<<sequenceBits | maxSequence, want: time.Date(2020, 1, 1, 0, 0, 1, 500e6, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		if got := tt.id.Time(); !got.Equal(tt.want) {
+			t.Errorf("ID(%d).Time() = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAtRoundTrip(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond).UTC()
+	if got := At(now).Time(); !got.Equal(now) {
+		t.Errorf("At(%v).Time() = %v", now, got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	data, err := json.Marshal(ID(175928847299117063))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `"175928847299117063"` {
+		t.Errorf("marshal = %s, want a string", data)
+	}
+
+	var got ID
+	if err := json.Unmarshal(data, &got); err != nil || got != 175928847299117063 {
+		t.Errorf("unmarshal = %d, %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(`175928847299117063`), &got); err != ErrInvalid {
+		t.Errorf("unmarshal of a number: error = %v, want ErrInvalid", err)
+	}
+}
+
+func TestNewGenerator(t *testing.T) {
+	for _, worker := range []int64{-1, MaxWorker + 1} {
+		if _, err := NewGenerator(worker); err == nil {
+			t.Errorf("NewGenerator(%d) succeeded", worker)
+		}
+	}
+}
+
+func TestNextOrder(t *testing.T) {
+	g, err := NewGenerator(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().Truncate(time.Millisecond)
+	prev := g.Next()
+	for i := 0; i < 10000; i++ {
+		next := g.Next()
+		if next <= prev {
+			t.Fatalf("Next() = %d after %d", next, prev)
+		}
+		if w := int64(next) >> sequenceBits & MaxWorker; w != 7 {
+			t.Fatalf("Next() has worker %d, want 7", w)
+		}
+		prev = next
+	}
+
+	// 10000 IDs may run a few milliseconds ahead of the clock, no more.
+	if got := prev.Time(); got.Before(before) || got.After(time.Now().Add(10*time.Millisecond)) {
+		t.Errorf("last ID is from %v, want around %v", got, before)
+	}
+}
+
+func TestNextSequenceRollover(t *testing.T) {
+	// A last millisecond in the future stands for a clock that stepped
+	// back, and keeps every call in that millisecond until it fills.
+	future := time.Now().Add(time.Hour).UnixMilli() - Epoch
+	g := &Generator{worker: 3, last: future, sequence: maxSequence - 1}
+
+	tests := []struct {
+		ms  int64
+		seq int64
+	}{
+		{ms: future, seq: maxSequence},
+		{ms: future + 1, seq: 0},
+		{ms: future + 1, seq: 1},
+	}
+
+	for _, tt := range tests {
+		got := g.Next()
+		want := ID(tt.ms<<timeShift | 3<<sequenceBits | tt.seq)
+		if got != want {
+			t.Errorf("Next() = %d (ms %d, seq %d), want ms %d, seq %d",
+				got, int64(got)>>timeShift, int64(got)&maxSequence, tt.ms, tt.seq)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package id
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// ErrNoFreeWorker is returned when every worker ID is leased.
+var ErrNoFreeWorker = errors.New("every worker id is leased by another node")
+
+// renew extends a worker ID lease, or takes it back if it lapsed while
+// Redis was unreachable and nobody else has claimed it since.
+//
+// KEYS[1] lease key
+// ARGV[1] lease token, ARGV[2] ttl (ms)
+//
+// Returns 0 if another node holds the lease.
+var renew = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// drop deletes a worker ID lease if it is still ours.
+//
+// KEYS[1] lease key
+// ARGV[1] lease token
+var drop = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Lease is a worker ID claimed in Redis, so nodes can share a config
+// without sharing a worker ID. It is renewed in the background until
+// Close. If another node ever takes it over, Lost is closed and this node
+// must stop making IDs.
+type Lease struct {
+	redis  *redis.Client
+	key    string
+	token  string
+	worker int64
+	ttl    time.Duration
+	log    *zerolog.Logger
+	lost   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// LeaseWorker claims a free worker ID for ttl and keeps renewing it. It
+// starts from a random ID so nodes starting together rarely collide.
+func LeaseWorker(ctx context.Context, rdb *redis.Client, ttl time.Duration, log *zerolog.Logger) (*Lease, error) {
+	token := uuid.NewString()
+	start := rand.Int63n(MaxWorker + 1)
+
+	for i := int64(0); i <= MaxWorker; i++ {
+		worker := (start + i) % (MaxWorker + 1)
+		key := leaseKey(worker)
+
+		ok, err := rdb.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			return nil, fmt.Errorf("lease worker id: %w", err)
+		}
+		if !ok {
+			continue
+		}
+
+		l := &Lease{
+			redis:  rdb,
+			key:    key,
+			token:  token,
+			worker: worker,
+			ttl:    ttl,
+			log:    log,
+			lost:   make(chan struct{}),
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		go l.keep()
+		return l, nil
+	}
+	return nil, ErrNoFreeWorker
+}
+
+// Worker is the leased worker ID.
+func (l *Lease) Worker() int64 {
+	return l.worker
+}
+
+// Lost is closed if another node took over the worker ID.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Close stops renewing the lease and gives the worker ID back.
+func (l *Lease) Close() error {
+	close(l.stop)
+	<-l.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := drop.Run(ctx, l.redis, []string{l.key}, l.token).Err(); err != nil {
+		return fmt.Errorf("release worker id: %w", err)
+	}
+	return nil
+}
+
+// keep renews the lease three times per ttl, so one or two failed renewals
+// do not let it lapse.
+func (l *Lease) keep() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+		held, err := renew.Run(ctx, l.redis, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+		cancel()
+		if err != nil {
+			l.log.Error().Err(err).Int64("worker", l.worker).Msg("failed to renew worker id lease")
+			continue
+		}
+		if held == 0 {
+			l.log.Error().Int64("worker", l.worker).Msg("worker id lease was taken by another node")
+			close(l.lost)
+			return
+		}
+	}
+}
+
+func leaseKey(worker int64) string {
+	return fmt.Sprintf("id:worker:%d", worker)
+}
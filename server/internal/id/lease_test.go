@@ -0,0 +1,95 @@
+package id
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+func newRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+func TestLeaseWorkerUnique(t *testing.T) {
+	_, rdb := newRedis(t)
+	log := zerolog.New(io.Discard)
+	ctx := context.Background()
+
+	seen := make(map[int64]bool)
+	for i := 0; i < 50; i++ {
+		l, err := LeaseWorker(ctx, rdb, time.Minute, &log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		if seen[l.Worker()] {
+			t.Fatalf("worker %d leased twice", l.Worker())
+		}
+		seen[l.Worker()] = true
+	}
+}
+
+func TestLeaseWorkerExhausted(t *testing.T) {
+	mr, rdb := newRedis(t)
+	log := zerolog.New(io.Discard)
+
+	for w := int64(0); w <= MaxWorker; w++ {
+		mr.Set(leaseKey(w), "other")
+	}
+	if _, err := LeaseWorker(context.Background(), rdb, time.Minute, &log); err != ErrNoFreeWorker {
+		t.Fatalf("error = %v, want ErrNoFreeWorker", err)
+	}
+}
+
+func TestLeaseClose(t *testing.T) {
+	mr, rdb := newRedis(t)
+	log := zerolog.New(io.Discard)
+
+	l, err := LeaseWorker(context.Background(), rdb, time.Minute, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists(leaseKey(l.Worker())) {
+		t.Fatal("lease not stored")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(leaseKey(l.Worker())) {
+		t.Error("lease still stored after Close")
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	mr, rdb := newRedis(t)
+	log := zerolog.New(io.Discard)
+
+	l, err := LeaseWorker(context.Background(), rdb, 60*time.Millisecond, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr.Set(leaseKey(l.Worker()), "other")
+
+	select {
+	case <-l.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lease taken by another node was not reported lost")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mr.Get(leaseKey(l.Worker())); got != "other" {
+		t.Errorf("Close left %q, want the other node's lease kept", got)
+	}
+}
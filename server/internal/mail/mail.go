@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"context"
+	"discord/internal/config"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the mailer selected by cfg.Backend.
+func New(cfg *config.MailConfig, log *zerolog.Logger) Mailer {
+	if cfg.Backend == "smtp" {
+		return &SMTPMailer{cfg: cfg}
+	}
+	return &LogMailer{log: log}
+}
+
+// LogMailer writes mail to the log instead of sending it.
+type LogMailer struct {
+	log *zerolog.Logger
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	m.log.Info().
+		Str("to", msg.To).
+		Str("subject", msg.Subject).
+		Str("body", msg.Body).
+		Msg("mail not sent: log backend")
+	return nil
+}
+
+type SMTPMailer struct {
+	cfg *config.MailConfig
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	addr := fmt.Sprintf("%s:%d", m.cfg.Host, m.cfg.Port)
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	if err := smtp.SendMail(addr, auth, m.cfg.From, []string{msg.To}, []byte(b.String())); err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package presence
+
+import (
+	"discord/internal/http/response"
+	"discord/internal/validation"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+type Handler struct {
+	svc      *Service
+	validate *validation.Validator
+	log      *zerolog.Logger
+}
+
+func NewHandler(svc *Service, validate *validation.Validator, log *zerolog.Logger) *Handler {
+	return &Handler{
+		svc:      svc,
+		validate: validate,
+		log:      log,
+	}
+}
+
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Post("/query", h.handleQuery)
+	r.Put("/status", h.handleSetStatus)
+	r.Put("/custom-status", h.handleSetCustomStatus)
+	r.Delete("/custom-status", h.handleClearCustomStatus)
+
+	return r
+}
+
+// @Summary Query presence
+// @Description Get the presence of up to 100 users, in the order requested. Users who share no friendship or conversation with the caller appear offline.
+// @Tags presence
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param request body QueryRequest true "Users to look up"
+// @Success 200 {array} Presence
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /presence/query [post]
+func (h *Handler) handleQuery(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	presences, err := h.svc.Query(r.Context(), userID, req.UserIDs)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to query presence")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presences)
+}
+
+// @Summary Set status
+// @Description Set the status shown while connected. Invisible users appear offline to everyone else.
+// @Tags presence
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param request body SetStatusRequest true "New status"
+// @Success 200 {object} Presence
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /presence/status [put]
+func (h *Handler) handleSetStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req SetStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	p, err := h.svc.SetStatus(r.Context(), userID, req.Status)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to set status")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// @Summary Set custom status
+// @Description Set a custom status text, optionally expiring at a given time
+// @Tags presence
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param request body SetCustomStatusRequest true "Custom status"
+// @Success 200 {object} Presence
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /presence/custom-status [put]
+func (h *Handler) handleSetCustomStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req SetCustomStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	p, err := h.svc.SetCustomStatus(r.Context(), userID, req)
+	if err != nil {
+		if errors.Is(err, ErrExpiryInPast) {
+			response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+			return
+		}
+		h.log.Error().Err(err).Msg("failed to set custom status")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// @Summary Clear custom status
+// @Description Remove the custom status text
+// @Tags presence
+// @Param Authorization header string true "Bearer token"
+// @Success 204 "Custom status cleared"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /presence/custom-status [delete]
+func (h *Handler) handleClearCustomStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	if err := h.svc.ClearCustomStatus(r.Context(), userID); err != nil {
+		h.log.Error().Err(err).Msg("failed to clear custom status")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,466 @@
+package presence
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/config"
+	"discord/internal/event"
+	"discord/internal/relationship"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// Statuses. Users pick one of the first four; offline is what everyone else
+// sees when they have no live connection or are invisible.
+const (
+	StatusOnline    = "online"
+	StatusIdle      = "idle"
+	StatusDND       = "dnd"
+	StatusInvisible = "invisible"
+	StatusOffline   = "offline"
+)
+
+// onlineKey indexes every online user by when their last connection lapses,
+// so any node can find users whose node died without disconnecting them.
+const onlineKey = "presence:online"
+
+// touch records a live connection until ARGV[3] (ms). The connection set
+// expires with its last member, and the user's entry in the online index
+// follows the latest expiry.
+//
+// KEYS[1] connection set, KEYS[2] online index
+// ARGV[1] connection ID, ARGV[2] now (ms), ARGV[3] expiry (ms), ARGV[4] user ID
+//
+// Returns 1 if the user just came online.
+var touch = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+redis.call("PEXPIREAT", KEYS[1], last[2])
+return redis.call("ZADD", KEYS[2], last[2], ARGV[4])
+`)
+
+// release drops a connection (none if ARGV[1] is empty) along with any that
+// have lapsed.
+//
+// KEYS[1] connection set, KEYS[2] online index
+// ARGV[1] connection ID, ARGV[2] now (ms), ARGV[3] user ID
+//
+// Returns 1 if the user just went offline. Only one caller ever sees that,
+// however many nodes race to release the same user.
+var release = redis.NewScript(`
+if ARGV[1] ~= "" then
+	redis.call("ZREM", KEYS[1], ARGV[1])
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+if #last == 0 then
+	return redis.call("ZREM", KEYS[2], ARGV[3])
+end
+redis.call("ZADD", KEYS[2], last[2], ARGV[3])
+return 0
+`)
+
+// CustomStatus is a short user-set text, optionally expiring.
+type CustomStatus struct {
+	Text      string     `json:"text"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Presence is a user's status as seen by someone else. Users see their own
+// chosen status, including invisible.
+type Presence struct {
+	UserID       string        `json:"userId"`
+	Status       string        `json:"status" enums:"online,idle,dnd,invisible,offline"`
+	CustomStatus *CustomStatus `json:"customStatus,omitempty"`
+}
+
+type SetStatusRequest struct {
+	Status string `json:"status" validate:"required,oneof=online idle dnd invisible"`
+}
+
+type SetCustomStatusRequest struct {
+	Text      string     `json:"text" validate:"required,max=128"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type QueryRequest struct {
+	UserIDs []string `json:"userIds" validate:"required,min=1,max=100,dive,uuid"`
+}
+
+var ErrExpiryInPast = errors.New("custom status expiry must be in the future")
+
+type Service struct {
+	db     *sql.DB
+	redis  *redis.Client
+	events *event.Publisher
+	cfg    *config.PresenceConfig
+	log    *zerolog.Logger
+}
+
+func NewService(db *sql.DB, redis *redis.Client, events *event.Publisher, cfg *config.PresenceConfig, log *zerolog.Logger) *Service {
+	svc := &Service{
+		db:     db,
+		redis:  redis,
+		events: events,
+		cfg:    cfg,
+		log:    log,
+	}
+
+	go svc.sweep()
+
+	return svc
+}
+
+// Connect counts a new websocket connection towards userID being online.
+func (s *Service) Connect(ctx context.Context, userID uuid.UUID, connID string) error {
+	return s.touch(ctx, userID, connID)
+}
+
+// Heartbeat keeps a connection counted for another ConnectionTTL.
+func (s *Service) Heartbeat(ctx context.Context, userID uuid.UUID, connID string) error {
+	return s.touch(ctx, userID, connID)
+}
+
+// Disconnect stops counting a connection.
+func (s *Service) Disconnect(ctx context.Context, userID uuid.UUID, connID string) error {
+	return s.release(ctx, userID.String(), connID)
+}
+
+func (s *Service) touch(ctx context.Context, userID uuid.UUID, connID string) error {
+	now := time.Now()
+	cameOnline, err := touch.Run(ctx, s.redis,
+		[]string{connsKey(userID.String()), onlineKey},
+		connID,
+		now.UnixMilli(),
+		now.Add(s.cfg.ConnectionTTL).UnixMilli(),
+		userID.String(),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("touch connection: %w", err)
+	}
+
+	if cameOnline == 1 {
+		s.broadcast(ctx, userID)
+	}
+	return nil
+}
+
+func (s *Service) release(ctx context.Context, userID, connID string) error {
+	wentOffline, err := release.Run(ctx, s.redis,
+		[]string{connsKey(userID), onlineKey},
+		connID,
+		time.Now().UnixMilli(),
+		userID,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("release connection: %w", err)
+	}
+
+	if wentOffline == 1 {
+		id, err := uuid.Parse(userID)
+		if err != nil {
+			return fmt.Errorf("parse user id: %w", err)
+		}
+		s.broadcast(ctx, id)
+	}
+	return nil
+}
+
+// sweep periodically releases users whose connections all lapsed without
+// a disconnect, so they are announced offline.
+func (s *Service) sweep() {
+	ticker := time.NewTicker(s.cfg.SweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.SweepInterval)
+
+		expired, err := s.redis.ZRangeByScore(ctx, onlineKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+			Count: 100,
+		}).Result()
+		if err != nil {
+			s.log.Error().Err(err).Msg("failed to list lapsed presences")
+		}
+
+		for _, userID := range expired {
+			if err := s.release(ctx, userID, ""); err != nil {
+				s.log.Error().Err(err).Str("userId", userID).Msg("failed to release lapsed presence")
+			}
+		}
+
+		cancel()
+	}
+}
+
+// SetStatus changes the status userID shows while connected.
+func (s *Service) SetStatus(ctx context.Context, userID uuid.UUID, status string) (*Presence, error) {
+	if err := s.redis.HSet(ctx, statusKey(userID.String()), "status", status).Err(); err != nil {
+		return nil, fmt.Errorf("set status: %w", err)
+	}
+
+	s.broadcast(ctx, userID)
+	return s.self(ctx, userID)
+}
+
+// SetCustomStatus sets userID's custom status text.
+func (s *Service) SetCustomStatus(ctx context.Context, userID uuid.UUID, req SetCustomStatusRequest) (*Presence, error) {
+	expires := ""
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			return nil, ErrExpiryInPast
+		}
+		expires = strconv.FormatInt(req.ExpiresAt.UnixMilli(), 10)
+	}
+
+	err := s.redis.HSet(ctx, statusKey(userID.String()), "text", req.Text, "expires", expires).Err()
+	if err != nil {
+		return nil, fmt.Errorf("set custom status: %w", err)
+	}
+
+	s.broadcast(ctx, userID)
+	return s.self(ctx, userID)
+}
+
+// ClearCustomStatus removes userID's custom status text.
+func (s *Service) ClearCustomStatus(ctx context.Context, userID uuid.UUID) error {
+	if err := s.redis.HDel(ctx, statusKey(userID.String()), "text", "expires").Err(); err != nil {
+		return fmt.Errorf("clear custom status: %w", err)
+	}
+
+	s.broadcast(ctx, userID)
+	return nil
+}
+
+// Query returns the presence of each of userIDs as viewerID sees it. Users
+// who share no friendship or conversation with viewerID appear offline.
+func (s *Service) Query(ctx context.Context, viewerID uuid.UUID, userIDs []string) ([]Presence, error) {
+	// Compare IDs in the canonical form Postgres returns them in.
+	for i, id := range userIDs {
+		u, err := uuid.Parse(id)
+		if err != nil {
+			return nil, fmt.Errorf("parse user id: %w", err)
+		}
+		userIDs[i] = u.String()
+	}
+
+	const q = `
+        SELECT id FROM unnest($2::uuid[]) AS id
+        WHERE id = $1
+           OR EXISTS (
+               SELECT 1 FROM relationships r
+               WHERE r.user_id = id AND r.peer_id = $1 AND r.type = $3
+           )
+           OR (
+               EXISTS (
+                   SELECT 1 FROM conversations c
+                   WHERE c.user_id = id AND c.peer_id = $1 AND c.state = 'active'
+               )
+               AND NOT EXISTS (
+                   SELECT 1 FROM relationships r
+                   WHERE r.type = $4 AND (
+                       (r.user_id = id AND r.peer_id = $1) OR
+                       (r.user_id = $1 AND r.peer_id = id)
+                   )
+               )
+           )`
+
+	rows, err := s.db.QueryContext(ctx, q, viewerID, pq.Array(userIDs), relationship.TypeFriend, relationship.TypeBlocked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query visible users: %w", err)
+	}
+	defer rows.Close()
+
+	visible := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan visible user: %w", err)
+		}
+		visible[id] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating visible users: %w", err)
+	}
+
+	var lookup []string
+	for id := range visible {
+		lookup = append(lookup, id)
+	}
+
+	found, err := s.load(ctx, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	presences := make([]Presence, 0, len(userIDs))
+	for _, id := range userIDs {
+		p, ok := found[id]
+		if !ok {
+			presences = append(presences, Presence{UserID: id, Status: StatusOffline})
+			continue
+		}
+		if id == viewerID.String() {
+			presences = append(presences, p)
+			continue
+		}
+		presences = append(presences, public(p))
+	}
+
+	return presences, nil
+}
+
+func (s *Service) self(ctx context.Context, userID uuid.UUID) (*Presence, error) {
+	found, err := s.load(ctx, []string{userID.String()})
+	if err != nil {
+		return nil, err
+	}
+	p := found[userID.String()]
+	return &p, nil
+}
+
+// load reads the presence of each user as they themselves see it.
+func (s *Service) load(ctx context.Context, userIDs []string) (map[string]Presence, error) {
+	if len(userIDs) == 0 {
+		return map[string]Presence{}, nil
+	}
+
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	pipe := s.redis.Pipeline()
+	live := make([]*redis.IntCmd, len(userIDs))
+	fields := make([]*redis.MapStringStringCmd, len(userIDs))
+	for i, id := range userIDs {
+		live[i] = pipe.ZCount(ctx, connsKey(id), "("+now, "+inf")
+		fields[i] = pipe.HGetAll(ctx, statusKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("load presence: %w", err)
+	}
+
+	found := make(map[string]Presence, len(userIDs))
+	for i, id := range userIDs {
+		f := fields[i].Val()
+
+		p := Presence{UserID: id, Status: StatusOffline}
+		if live[i].Val() > 0 {
+			p.Status = StatusOnline
+			if status := f["status"]; status != "" {
+				p.Status = status
+			}
+		}
+
+		if text := f["text"]; text != "" {
+			cs := &CustomStatus{Text: text}
+			if ms, err := strconv.ParseInt(f["expires"], 10, 64); err == nil {
+				t := time.UnixMilli(ms)
+				cs.ExpiresAt = &t
+			}
+			if cs.ExpiresAt == nil || cs.ExpiresAt.After(time.Now()) {
+				p.CustomStatus = cs
+			}
+		}
+
+		found[id] = p
+	}
+
+	return found, nil
+}
+
+// broadcast sends userID's presence to everyone who can see it, and their
+// own status to userID's other sessions. Failures are only logged; presence
+// is best effort.
+func (s *Service) broadcast(ctx context.Context, userID uuid.UUID) {
+	p, err := s.self(ctx, userID)
+	if err != nil {
+		s.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to load presence")
+		return
+	}
+
+	if err := s.events.Publish(ctx, userID, event.PresenceUpdate, p); err != nil {
+		s.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to publish presence")
+	}
+
+	audience, err := s.audience(ctx, userID)
+	if err != nil {
+		s.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to get presence audience")
+		return
+	}
+
+	seen := public(*p)
+	for _, id := range audience {
+		if err := s.events.Publish(ctx, id, event.PresenceUpdate, seen); err != nil {
+			s.log.Error().Err(err).Str("userId", id.String()).Msg("failed to publish presence")
+		}
+	}
+}
+
+// audience lists the users who see userID's presence: their friends and the
+// people they have an active conversation with, unless either side blocked
+// the other.
+func (s *Service) audience(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	const q = `
+        SELECT peer_id FROM relationships
+        WHERE user_id = $1 AND type = $2
+        UNION
+        SELECT c.peer_id FROM conversations c
+        WHERE c.user_id = $1 AND c.state = 'active'
+          AND NOT EXISTS (
+              SELECT 1 FROM relationships r
+              WHERE r.type = $3 AND (
+                  (r.user_id = $1 AND r.peer_id = c.peer_id) OR
+                  (r.user_id = c.peer_id AND r.peer_id = $1)
+              )
+          )`
+
+	rows, err := s.db.QueryContext(ctx, q, userID, relationship.TypeFriend, relationship.TypeBlocked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audience: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan audience: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating audience: %w", err)
+	}
+
+	return ids, nil
+}
+
+// public is p as other users see it: invisible users look offline, and
+// offline users show no custom status.
+func public(p Presence) Presence {
+	if p.Status == StatusInvisible {
+		p.Status = StatusOffline
+	}
+	if p.Status == StatusOffline {
+		p.CustomStatus = nil
+	}
+	return p
+}
+
+func connsKey(userID string) string {
+	return fmt.Sprintf("presence:%s:conns", userID)
+}
+
+func statusKey(userID string) string {
+	return fmt.Sprintf("presence:%s:status", userID)
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"discord/internal/http/response"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Middleware limits requests in the given route group. Authenticated requests
+// are keyed by user, anonymous ones by client IP.
+func (l *Limiter) Middleware(group string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := l.Allow(r.Context(), group, principal(r))
+			if err != nil {
+				// Fail open: a Redis outage should not take the API down with it.
+				l.log.Error().Err(err).Str("group", group).Msg("rate limit check failed")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if res.Limit > 0 {
+				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+				w.Header().Set("X-RateLimit-Reset",
+					strconv.FormatInt(time.Now().Add(res.ResetAfter).Unix(), 10))
+			}
+
+			if !res.Allowed {
+				w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(res.RetryAfter), 10))
+				response.Render(w, r, response.ErrTooManyRequests())
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func principal(r *http.Request) string {
+	if userID, ok := r.Context().Value("userID").(uuid.UUID); ok {
+		return "user:" + userID.String()
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"discord/internal/config"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// Route groups that share a bucket per principal.
+const (
+	GroupMessages  = "messages"
+	GroupSearch    = "search"
+	GroupGateway   = "gateway"
+	GroupReactions = "reactions"
+	GroupUploads   = "uploads"
+)
+
+// gcra implements the generic cell rate algorithm. The only state kept per
+// bucket is the theoretical arrival time (TAT) of the next request, stored as
+// seconds since the script epoch so it fits in a plain string key.
+//
+// KEYS[1] bucket key
+// ARGV[1] burst, ARGV[2] rate, ARGV[3] period in seconds, ARGV[4] cost
+//
+// Returns {allowed, remaining, retry_after, reset_after}; durations are in
+// seconds and returned as strings to keep their fractional part.
+var gcra = redis.NewScript(`
+local key = KEYS[1]
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local emission_interval = period / rate
+local increment = emission_interval * cost
+local burst_offset = emission_interval * burst
+
+local epoch = 1483228800
+local now = redis.call("TIME")
+now = (now[1] - epoch) + (now[2] / 1000000)
+
+local tat = redis.call("GET", key)
+if not tat then
+	tat = now
+else
+	tat = tonumber(tat)
+end
+tat = math.max(tat, now)
+
+local new_tat = tat + increment
+local allow_at = new_tat - burst_offset
+local diff = now - allow_at
+local remaining = diff / emission_interval
+
+if remaining < 0 then
+	return {0, 0, tostring(-diff), tostring(tat - now)}
+end
+
+local reset_after = new_tat - now
+if reset_after > 0 then
+	redis.call("SET", key, new_tat, "EX", math.ceil(reset_after))
+end
+
+return {1, math.floor(remaining), "-1", tostring(reset_after)}
+`)
+
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+type Limiter struct {
+	redis   *redis.Client
+	enabled bool
+	limits  map[string]config.LimitConfig
+	log     *zerolog.Logger
+}
+
+func NewLimiter(redis *redis.Client, cfg *config.RateLimitConfig, log *zerolog.Logger) *Limiter {
+	return &Limiter{
+		redis:   redis,
+		enabled: cfg.Enabled,
+		limits:  cfg.Groups,
+		log:     log,
+	}
+}
+
+// Allow takes one token from the bucket for principal in the given group.
+// Requests in groups without a configured limit are always allowed.
+func (l *Limiter) Allow(ctx context.Context, group, principal string) (*Result, error) {
+	limit, ok := l.limits[group]
+	if !l.enabled || !ok {
+		return &Result{Allowed: true}, nil
+	}
+
+	key := fmt.Sprintf("ratelimit:%s:%s", group, principal)
+	values, err := gcra.Run(ctx, l.redis, []string{key},
+		limit.Burst,
+		limit.Rate,
+		limit.Period.Seconds(),
+		1,
+	).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("run rate limit script: %w", err)
+	}
+
+	retryAfter, err := parseSeconds(values[2])
+	if err != nil {
+		return nil, err
+	}
+	resetAfter, err := parseSeconds(values[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Allowed:    values[0].(int64) == 1,
+		Limit:      limit.Burst,
+		Remaining:  int(values[1].(int64)),
+		RetryAfter: retryAfter,
+		ResetAfter: resetAfter,
+	}, nil
+}
+
+func parseSeconds(v interface{}) (time.Duration, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected rate limit value %v", v)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse rate limit value: %w", err)
+	}
+	if f < 0 {
+		return 0, nil
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// ceilSeconds rounds d up to whole seconds, as used by the HTTP headers.
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
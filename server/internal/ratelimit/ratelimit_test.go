@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"discord/internal/config"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+func newLimiter(t *testing.T, cfg *config.RateLimitConfig) (*miniredis.Miniredis, *Limiter) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	log := zerolog.Nop()
+	return mr, NewLimiter(rdb, cfg, &log)
+}
+
+func TestAllow(t *testing.T) {
+	// 2 requests per second, in bursts of up to 3.
+	cfg := &config.RateLimitConfig{
+		Enabled: true,
+		Groups: map[string]config.LimitConfig{
+			GroupMessages: {Rate: 2, Period: time.Second, Burst: 3},
+		},
+	}
+
+	// Each step runs at an offset from the start, with the clock stopped.
+	tests := []struct {
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{at: 0, allowed: true, remaining: 2},
+		{at: 0, allowed: true, remaining: 1},
+		{at: 0, allowed: true, remaining: 0},
+		{at: 0, allowed: false, retryAfter: 500 * time.Millisecond},
+		{at: 250 * time.Millisecond, allowed: false, retryAfter: 250 * time.Millisecond},
+		{at: 500 * time.Millisecond, allowed: true, remaining: 0},
+		{at: 500 * time.Millisecond, allowed: false, retryAfter: 500 * time.Millisecond},
+		// A quiet spell refills the bucket, but never past the burst.
+		{at: 10 * time.Second, allowed: true, remaining: 2},
+	}
+
+	mr, l := newLimiter(t, cfg)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, tt := range tests {
+		mr.SetTime(start.Add(tt.at))
+
+		res, err := l.Allow(context.Background(), GroupMessages, "user:1")
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if res.Allowed != tt.allowed || res.Remaining != tt.remaining {
+			t.Errorf("step %d: allowed %v, remaining %d, want %v, %d",
+				i, res.Allowed, res.Remaining, tt.allowed, tt.remaining)
+		}
+		if d := res.RetryAfter - tt.retryAfter; d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("step %d: retry after %v, want %v", i, res.RetryAfter, tt.retryAfter)
+		}
+		if res.Limit != 3 {
+			t.Errorf("step %d: limit %d, want 3", i, res.Limit)
+		}
+	}
+}
+
+func TestAllowSeparateBuckets(t *testing.T) {
+	cfg := &config.RateLimitConfig{
+		Enabled: true,
+		Groups: map[string]config.LimitConfig{
+			GroupMessages: {Rate: 1, Period: time.Minute, Burst: 1},
+			GroupSearch:   {Rate: 1, Period: time.Minute, Burst: 1},
+		},
+	}
+	mr, l := newLimiter(t, cfg)
+	mr.SetTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	tests := []struct {
+		group, principal string
+		allowed          bool
+	}{
+		{GroupMessages, "user:1", true},
+		{GroupMessages, "user:1", false},
+		{GroupMessages, "user:2", true},
+		{GroupSearch, "user:1", true},
+		{GroupSearch, "user:1", false},
+	}
+
+	for _, tt := range tests {
+		res, err := l.Allow(ctx, tt.group, tt.principal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allowed != tt.allowed {
+			t.Errorf("Allow(%s, %s) = %v, want %v", tt.group, tt.principal, res.Allowed, tt.allowed)
+		}
+	}
+}
+
+func TestAllowUnlimited(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   *config.RateLimitConfig
+		group string
+	}{
+		{
+			name: "disabled",
+			cfg: &config.RateLimitConfig{Groups: map[string]config.LimitConfig{
+				GroupMessages: {Rate: 1, Period: time.Minute, Burst: 1},
+			}},
+			group: GroupMessages,
+		},
+		{
+			name:  "group without a limit",
+			cfg:   &config.RateLimitConfig{Enabled: true},
+			group: GroupUploads,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr, l := newLimiter(t, tt.cfg)
+			for i := 0; i < 5; i++ {
+				res, err := l.Allow(context.Background(), tt.group, "user:1")
+				if err != nil || !res.Allowed {
+					t.Fatalf("request %d: %+v, %v", i, res, err)
+				}
+			}
+			if keys := mr.Keys(); len(keys) != 0 {
+				t.Errorf("stored %v, want nothing", keys)
+			}
+		})
+	}
+}
+
+func TestCeilSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int64
+	}{
+		{0, 0},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Minute, 60},
+	}
+
+	for _, tt := range tests {
+		if got := ceilSeconds(tt.d); got != tt.want {
+			t.Errorf("ceilSeconds(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
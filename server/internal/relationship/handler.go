@@ -0,0 +1,376 @@
+package relationship
+
+import (
+	"context"
+	"discord/internal/http/response"
+	"discord/internal/validation"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+type Handler struct {
+	svc      *Service
+	validate *validation.Validator
+	log      *zerolog.Logger
+}
+
+func NewHandler(svc *Service, validate *validation.Validator, log *zerolog.Logger) *Handler {
+	return &Handler{
+		svc:      svc,
+		validate: validate,
+		log:      log,
+	}
+}
+
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/friends", h.handleListFriends)
+	r.Delete("/friends/{userID}", h.handleRemoveFriend)
+	r.Get("/requests", h.handleListRequests)
+	r.Post("/requests", h.handleSendRequest)
+	r.Post("/requests/{userID}/accept", h.handleAcceptRequest)
+	r.Post("/requests/{userID}/decline", h.handleDeclineRequest)
+	r.Delete("/requests/{userID}", h.handleCancelRequest)
+	r.Get("/blocked", h.handleListBlocked)
+	r.Put("/blocked/{userID}", h.handleBlock)
+	r.Delete("/blocked/{userID}", h.handleUnblock)
+	r.Get("/{userID}/mutual-friends", h.handleMutualFriends)
+
+	return r
+}
+
+// @Summary List friends
+// @Description List the signed-in user's friends
+// @Tags relationships
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {array} Relationship
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/friends [get]
+func (h *Handler) handleListFriends(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	friends, err := h.svc.Friends(r.Context(), userID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to list friends")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(friends)
+}
+
+// @Summary Remove friend
+// @Description End a friendship. Both users are notified.
+// @Tags relationships
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Friend's user ID"
+// @Success 204 "Friend removed"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "Not friends with this user"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/friends/{userID} [delete]
+func (h *Handler) handleRemoveFriend(w http.ResponseWriter, r *http.Request) {
+	h.handleRemove(w, r, h.svc.RemoveFriend, "failed to remove friend")
+}
+
+// @Summary List friend requests
+// @Description List pending friend requests, both incoming (type 3) and outgoing (type 4)
+// @Tags relationships
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {array} Relationship
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/requests [get]
+func (h *Handler) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	requests, err := h.svc.Requests(r.Context(), userID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to list friend requests")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// @Summary Send friend request
+// @Description Send a friend request. If the other user has already sent one, it is accepted instead.
+// @Tags relationships
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param request body FriendRequest true "User to befriend"
+// @Success 200 {object} Relationship
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "User not found"
+// @Failure 409 {object} response.Problem "Already friends, request already sent, or user blocked"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/requests [post]
+func (h *Handler) handleSendRequest(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req FriendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	rel, err := h.svc.SendRequest(r.Context(), userID, uuid.MustParse(req.UserID))
+	if err != nil {
+		h.renderError(w, r, err, "failed to send friend request")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
+
+// @Summary Accept friend request
+// @Description Accept an incoming friend request
+// @Tags relationships
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User who sent the request"
+// @Success 200 {object} Relationship
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "No pending friend request"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/requests/{userID}/accept [post]
+func (h *Handler) handleAcceptRequest(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	rel, err := h.svc.AcceptRequest(r.Context(), userID, peerID)
+	if err != nil {
+		h.renderError(w, r, err, "failed to accept friend request")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
+
+// @Summary Decline friend request
+// @Description Decline an incoming friend request
+// @Tags relationships
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User who sent the request"
+// @Success 204 "Request declined"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "No pending friend request"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/requests/{userID}/decline [post]
+func (h *Handler) handleDeclineRequest(w http.ResponseWriter, r *http.Request) {
+	h.handleRemove(w, r, h.svc.DeclineRequest, "failed to decline friend request")
+}
+
+// @Summary Cancel friend request
+// @Description Withdraw an outgoing friend request
+// @Tags relationships
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User the request was sent to"
+// @Success 204 "Request cancelled"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "No pending friend request"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/requests/{userID} [delete]
+func (h *Handler) handleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	h.handleRemove(w, r, h.svc.CancelRequest, "failed to cancel friend request")
+}
+
+// @Summary List blocked users
+// @Description List the users the signed-in user has blocked
+// @Tags relationships
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {array} Relationship
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/blocked [get]
+func (h *Handler) handleListBlocked(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	blocked, err := h.svc.Blocked(r.Context(), userID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to list blocked users")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocked)
+}
+
+// @Summary Block user
+// @Description Block a user. Any friendship or pending request with them is removed, their messages are no longer delivered, and each is hidden from the other's search.
+// @Tags relationships
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User to block"
+// @Success 200 {object} Relationship
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "User not found"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/blocked/{userID} [put]
+func (h *Handler) handleBlock(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	rel, err := h.svc.Block(r.Context(), userID, peerID)
+	if err != nil {
+		h.renderError(w, r, err, "failed to block user")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
+
+// @Summary Unblock user
+// @Description Lift a block. A friend request the other user sent during the block now arrives, as RELATIONSHIP_ADD with type 3.
+// @Tags relationships
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Blocked user's ID"
+// @Success 204 "User unblocked"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "User is not blocked"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/blocked/{userID} [delete]
+func (h *Handler) handleUnblock(w http.ResponseWriter, r *http.Request) {
+	h.handleRemove(w, r, h.svc.Unblock, "failed to unblock user")
+}
+
+// @Summary Mutual friends
+// @Description List the users who are friends with both the signed-in user and the given user
+// @Tags relationships
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Other user's ID"
+// @Success 200 {array} user.Profile
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /relationships/{userID}/mutual-friends [get]
+func (h *Handler) handleMutualFriends(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	friends, err := h.svc.MutualFriends(r.Context(), userID, peerID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("failed to get mutual friends")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(friends)
+}
+
+// handleRemove serves the endpoints that delete a relationship and answer
+// with 204.
+func (h *Handler) handleRemove(w http.ResponseWriter, r *http.Request, remove func(ctx context.Context, userID, peerID uuid.UUID) error, msg string) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	peerID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	if err := remove(r.Context(), userID, peerID); err != nil {
+		h.renderError(w, r, err, msg)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) renderError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	switch {
+	case errors.Is(err, ErrSelf):
+		response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrNoRequest), errors.Is(err, ErrNotFriends),
+		errors.Is(err, ErrNotBlocked):
+		response.Render(w, r, response.ErrNotFound(err.Error()))
+	case errors.Is(err, ErrAlreadyFriends):
+		response.Render(w, r, response.ErrConflict(response.CodeAlreadyFriends, err.Error()))
+	case errors.Is(err, ErrRequestExists):
+		response.Render(w, r, response.ErrConflict(response.CodeRequestExists, err.Error()))
+	case errors.Is(err, ErrBlocked):
+		response.Render(w, r, response.ErrConflict(response.CodeUserBlocked, err.Error()))
+	default:
+		h.log.Error().Err(err).Msg(msg)
+		response.Render(w, r, response.ErrInternal())
+	}
+}
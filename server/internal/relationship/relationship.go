@@ -0,0 +1,540 @@
+package relationship
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/event"
+	"discord/internal/user"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog"
+)
+
+// Type is a relationship as seen from one side. The values match Discord's.
+type Type int
+
+const (
+	TypeFriend   Type = 1
+	TypeBlocked  Type = 2
+	TypeIncoming Type = 3
+	TypeOutgoing Type = 4
+)
+
+// Relationship is the caller's relationship with another user.
+type Relationship struct {
+	ID        string       `json:"id"`
+	Type      Type         `json:"type"`
+	User      user.Profile `json:"user"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// Removal is the payload of a RELATIONSHIP_REMOVE event.
+type Removal struct {
+	ID   string `json:"id"`
+	Type Type   `json:"type"`
+}
+
+type FriendRequest struct {
+	UserID string `json:"userId" validate:"required,uuid"`
+}
+
+type Service struct {
+	db          *sql.DB
+	userService *user.Service
+	events      *event.Publisher
+	log         *zerolog.Logger
+}
+
+var (
+	ErrSelf           = errors.New("cannot add yourself as a friend")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrAlreadyFriends = errors.New("already friends with this user")
+	ErrRequestExists  = errors.New("friend request already sent")
+	ErrNoRequest      = errors.New("no pending friend request")
+	ErrNotFriends     = errors.New("not friends with this user")
+	ErrNotBlocked     = errors.New("user is not blocked")
+	ErrBlocked        = errors.New("unblock this user first")
+)
+
+func NewService(db *sql.DB, userService *user.Service, events *event.Publisher, log *zerolog.Logger) *Service {
+	return &Service{
+		db:          db,
+		userService: userService,
+		events:      events,
+		log:         log,
+	}
+}
+
+// SendRequest sends a friend request from userID to peerID. If peerID has
+// already asked userID, the two become friends instead.
+func (s *Service) SendRequest(ctx context.Context, userID, peerID uuid.UUID) (*Relationship, error) {
+	if userID == peerID {
+		return nil, ErrSelf
+	}
+
+	peer, err := s.userService.GetProfile(ctx, peerID.String())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+
+	var accepted, hidden bool
+	err = s.withPair(ctx, userID, peerID, func(tx *sql.Tx, current, peerType Type) error {
+		switch current {
+		case TypeFriend:
+			return ErrAlreadyFriends
+		case TypeBlocked:
+			return ErrBlocked
+		case TypeOutgoing:
+			return ErrRequestExists
+		case TypeIncoming:
+			accepted = true
+			return setPair(ctx, tx, userID, peerID, TypeFriend, TypeFriend)
+		}
+
+		// Someone who blocked the caller never sees their request, but
+		// the caller is not told: it stays pending on their side only.
+		if peerType == TypeBlocked {
+			hidden = true
+			return setOne(ctx, tx, userID, peerID, TypeOutgoing)
+		}
+		return setPair(ctx, tx, userID, peerID, TypeOutgoing, TypeIncoming)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hidden {
+		rel := &Relationship{ID: peer.ID, Type: TypeOutgoing, User: *peer, CreatedAt: time.Now()}
+		s.publish(ctx, userID, event.RelationshipAdd, rel)
+		return rel, nil
+	}
+	if accepted {
+		return s.notifyAdd(ctx, userID, peerID, TypeFriend, TypeFriend)
+	}
+	return s.notifyAdd(ctx, userID, peerID, TypeOutgoing, TypeIncoming)
+}
+
+// AcceptRequest accepts peerID's pending request to userID.
+func (s *Service) AcceptRequest(ctx context.Context, userID, peerID uuid.UUID) (*Relationship, error) {
+	err := s.withPair(ctx, userID, peerID, func(tx *sql.Tx, current, _ Type) error {
+		if current != TypeIncoming {
+			return ErrNoRequest
+		}
+		return setPair(ctx, tx, userID, peerID, TypeFriend, TypeFriend)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.notifyAdd(ctx, userID, peerID, TypeFriend, TypeFriend)
+}
+
+// DeclineRequest rejects peerID's pending request to userID.
+func (s *Service) DeclineRequest(ctx context.Context, userID, peerID uuid.UUID) error {
+	return s.remove(ctx, userID, peerID, TypeIncoming, ErrNoRequest)
+}
+
+// CancelRequest withdraws userID's pending request to peerID.
+func (s *Service) CancelRequest(ctx context.Context, userID, peerID uuid.UUID) error {
+	return s.remove(ctx, userID, peerID, TypeOutgoing, ErrNoRequest)
+}
+
+// RemoveFriend ends a friendship, for both sides.
+func (s *Service) RemoveFriend(ctx context.Context, userID, peerID uuid.UUID) error {
+	return s.remove(ctx, userID, peerID, TypeFriend, ErrNotFriends)
+}
+
+// Block blocks peerID for userID, ending any friendship or pending request
+// between them. Only userID's side records the block; peerID simply loses
+// the relationship.
+func (s *Service) Block(ctx context.Context, userID, peerID uuid.UUID) (*Relationship, error) {
+	if userID == peerID {
+		return nil, ErrSelf
+	}
+
+	if _, err := s.userService.GetProfile(ctx, peerID.String()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+
+	var removed Type
+	err := s.withPair(ctx, userID, peerID, func(tx *sql.Tx, current, peerType Type) error {
+		if current == TypeBlocked {
+			return nil
+		}
+
+		// A block from the other side stays; anything else goes.
+		if peerType != 0 && peerType != TypeBlocked {
+			removed = peerType
+			_, err := tx.ExecContext(ctx,
+				`DELETE FROM relationships WHERE user_id = $1 AND peer_id = $2`,
+				peerID, userID,
+			)
+			if err != nil {
+				return fmt.Errorf("delete peer relationship: %w", err)
+			}
+		}
+
+		return setOne(ctx, tx, userID, peerID, TypeBlocked)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := s.userService.GetProfile(ctx, peerID.String())
+	if err != nil {
+		return nil, fmt.Errorf("get profile: %w", err)
+	}
+
+	rel := &Relationship{ID: profile.ID, Type: TypeBlocked, User: *profile, CreatedAt: time.Now()}
+	s.publish(ctx, userID, event.RelationshipAdd, rel)
+	if removed != 0 {
+		s.publish(ctx, peerID, event.RelationshipRemove, Removal{ID: userID.String(), Type: removed})
+	}
+
+	return rel, nil
+}
+
+// Unblock lifts userID's block on peerID. A request peerID sent during the
+// block, which only peerID could see, now reaches userID.
+func (s *Service) Unblock(ctx context.Context, userID, peerID uuid.UUID) error {
+	var pending bool
+	err := s.withPair(ctx, userID, peerID, func(tx *sql.Tx, current, peerType Type) error {
+		if current != TypeBlocked {
+			return ErrNotBlocked
+		}
+
+		if peerType == TypeOutgoing {
+			pending = true
+			return setOne(ctx, tx, userID, peerID, TypeIncoming)
+		}
+
+		_, err := tx.ExecContext(ctx,
+			`DELETE FROM relationships WHERE user_id = $1 AND peer_id = $2`,
+			userID, peerID,
+		)
+		if err != nil {
+			return fmt.Errorf("delete block: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publish(ctx, userID, event.RelationshipRemove, Removal{ID: peerID.String(), Type: TypeBlocked})
+	if pending {
+		profile, err := s.userService.GetProfile(ctx, peerID.String())
+		if err != nil {
+			return fmt.Errorf("get profile: %w", err)
+		}
+		rel := &Relationship{ID: profile.ID, Type: TypeIncoming, User: *profile, CreatedAt: time.Now()}
+		s.publish(ctx, userID, event.RelationshipAdd, rel)
+	}
+	return nil
+}
+
+// HasBlocked reports whether userID has blocked peerID.
+func (s *Service) HasBlocked(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	const q = `
+        SELECT EXISTS (
+            SELECT 1 FROM relationships
+            WHERE user_id = $1 AND peer_id = $2 AND type = $3
+        )`
+
+	var blocked bool
+	if err := s.db.QueryRowContext(ctx, q, userID, peerID, TypeBlocked).Scan(&blocked); err != nil {
+		return false, fmt.Errorf("failed to check block: %w", err)
+	}
+	return blocked, nil
+}
+
+// AreFriends reports whether userID and peerID are friends.
+func (s *Service) AreFriends(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	const q = `
+        SELECT EXISTS (
+            SELECT 1 FROM relationships
+            WHERE user_id = $1 AND peer_id = $2 AND type = $3
+        )`
+
+	var friends bool
+	if err := s.db.QueryRowContext(ctx, q, userID, peerID, TypeFriend).Scan(&friends); err != nil {
+		return false, fmt.Errorf("failed to check friendship: %w", err)
+	}
+	return friends, nil
+}
+
+// Friends lists userID's friends.
+func (s *Service) Friends(ctx context.Context, userID uuid.UUID) ([]Relationship, error) {
+	return s.list(ctx, userID, TypeFriend)
+}
+
+// Requests lists userID's pending friend requests, in both directions.
+func (s *Service) Requests(ctx context.Context, userID uuid.UUID) ([]Relationship, error) {
+	return s.list(ctx, userID, TypeIncoming, TypeOutgoing)
+}
+
+// Blocked lists the users userID has blocked.
+func (s *Service) Blocked(ctx context.Context, userID uuid.UUID) ([]Relationship, error) {
+	return s.list(ctx, userID, TypeBlocked)
+}
+
+// MutualFriends returns the users who are friends with both userID and
+// peerID.
+func (s *Service) MutualFriends(ctx context.Context, userID, peerID uuid.UUID) ([]user.Profile, error) {
+	const q = `
+        SELECT a.peer_id
+        FROM relationships a
+        JOIN relationships b ON b.peer_id = a.peer_id
+        WHERE a.user_id = $1 AND a.type = $3
+          AND b.user_id = $2 AND b.type = $3`
+
+	rows, err := s.db.QueryContext(ctx, q, userID, peerID, TypeFriend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mutual friends: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan mutual friend: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating mutual friends: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return []user.Profile{}, nil
+	}
+	return s.userService.GetProfiles(ctx, ids)
+}
+
+func (s *Service) list(ctx context.Context, userID uuid.UUID, types ...Type) ([]Relationship, error) {
+	const q = `
+        SELECT peer_id, type, created_at
+        FROM relationships
+        WHERE user_id = $1 AND type = ANY($2::smallint[])
+        ORDER BY created_at DESC`
+
+	ts := make([]int64, len(types))
+	for i, t := range types {
+		ts[i] = int64(t)
+	}
+
+	rows, err := s.db.QueryContext(ctx, q, userID, pq.Array(ts))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query relationships: %w", err)
+	}
+	defer rows.Close()
+
+	relationships := []Relationship{}
+	var ids []string
+	for rows.Next() {
+		var r Relationship
+		if err := rows.Scan(&r.ID, &r.Type, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan relationship: %w", err)
+		}
+		relationships = append(relationships, r)
+		ids = append(ids, r.ID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating relationships: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return relationships, nil
+	}
+
+	profiles, err := s.userService.GetProfiles(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("get profiles: %w", err)
+	}
+
+	byID := make(map[string]user.Profile, len(profiles))
+	for _, p := range profiles {
+		byID[p.ID] = p
+	}
+	for i := range relationships {
+		relationships[i].User = byID[relationships[i].ID]
+	}
+
+	return relationships, nil
+}
+
+// remove deletes the relationship between userID and peerID if userID's
+// side of it is want, and tells both users.
+func (s *Service) remove(ctx context.Context, userID, peerID uuid.UUID, want Type, errMissing error) error {
+	var removed Type
+	err := s.withPair(ctx, userID, peerID, func(tx *sql.Tx, current, peerType Type) error {
+		if current != want {
+			return errMissing
+		}
+		// A request to someone who blocked the caller was only stored on
+		// the caller's side, and the block stays.
+		if peerType != TypeBlocked {
+			removed = peerType
+		}
+
+		const q = `
+            DELETE FROM relationships
+            WHERE (user_id = $1 AND peer_id = $2) OR (user_id = $2 AND peer_id = $1 AND type <> $3)`
+
+		if _, err := tx.ExecContext(ctx, q, userID, peerID, TypeBlocked); err != nil {
+			return fmt.Errorf("delete relationship: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publish(ctx, userID, event.RelationshipRemove, Removal{ID: peerID.String(), Type: want})
+	if removed != 0 {
+		s.publish(ctx, peerID, event.RelationshipRemove, Removal{ID: userID.String(), Type: removed})
+	}
+	return nil
+}
+
+// withPair runs fn in a transaction that holds a lock on the pair of users,
+// passing it userID's current relationship with peerID and peerID's with
+// userID (0 where there is none). The lock serialises concurrent changes
+// from either side.
+func (s *Service) withPair(ctx context.Context, userID, peerID uuid.UUID, fn func(tx *sql.Tx, current, peerType Type) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, pairKey(userID, peerID)); err != nil {
+		return fmt.Errorf("lock relationship: %w", err)
+	}
+
+	const q = `
+        SELECT user_id = $1, type
+        FROM relationships
+        WHERE (user_id = $1 AND peer_id = $2) OR (user_id = $2 AND peer_id = $1)`
+
+	rows, err := tx.QueryContext(ctx, q, userID, peerID)
+	if err != nil {
+		return fmt.Errorf("get relationship: %w", err)
+	}
+	defer rows.Close()
+
+	var current, peerType Type
+	for rows.Next() {
+		var mine bool
+		var t Type
+		if err := rows.Scan(&mine, &t); err != nil {
+			return fmt.Errorf("scan relationship: %w", err)
+		}
+		if mine {
+			current = t
+		} else {
+			peerType = t
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating relationship: %w", err)
+	}
+	rows.Close()
+
+	if err := fn(tx, current, peerType); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// setPair writes both sides of a relationship.
+func setPair(ctx context.Context, tx *sql.Tx, userID, peerID uuid.UUID, userType, peerType Type) error {
+	const q = `
+        INSERT INTO relationships (user_id, peer_id, type, created_at)
+        VALUES ($1, $2, $3, $5), ($2, $1, $4, $5)
+        ON CONFLICT (user_id, peer_id) DO UPDATE
+        SET type = EXCLUDED.type, created_at = EXCLUDED.created_at`
+
+	if _, err := tx.ExecContext(ctx, q, userID, peerID, userType, peerType, time.Now()); err != nil {
+		return fmt.Errorf("store relationship: %w", err)
+	}
+	return nil
+}
+
+// setOne stores userID's side of a relationship and leaves peerID's as it
+// is.
+func setOne(ctx context.Context, tx *sql.Tx, userID, peerID uuid.UUID, t Type) error {
+	const q = `
+        INSERT INTO relationships (user_id, peer_id, type, created_at)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, peer_id) DO UPDATE
+        SET type = EXCLUDED.type, created_at = EXCLUDED.created_at`
+
+	if _, err := tx.ExecContext(ctx, q, userID, peerID, t, time.Now()); err != nil {
+		return fmt.Errorf("store relationship: %w", err)
+	}
+	return nil
+}
+
+// notifyAdd sends each side its view of a new or changed relationship and
+// returns userID's view.
+func (s *Service) notifyAdd(ctx context.Context, userID, peerID uuid.UUID, userType, peerType Type) (*Relationship, error) {
+	profiles, err := s.userService.GetProfiles(ctx, []string{userID.String(), peerID.String()})
+	if err != nil {
+		return nil, fmt.Errorf("get profiles: %w", err)
+	}
+
+	var self, peer user.Profile
+	for _, p := range profiles {
+		if p.ID == userID.String() {
+			self = p
+		} else {
+			peer = p
+		}
+	}
+
+	now := time.Now()
+	mine := &Relationship{ID: peer.ID, Type: userType, User: peer, CreatedAt: now}
+	theirs := &Relationship{ID: self.ID, Type: peerType, User: self, CreatedAt: now}
+
+	s.publish(ctx, userID, event.RelationshipAdd, mine)
+	s.publish(ctx, peerID, event.RelationshipAdd, theirs)
+
+	return mine, nil
+}
+
+// publish pushes a relationship event. The change is already committed, so
+// failures are only logged.
+func (s *Service) publish(ctx context.Context, userID uuid.UUID, eventType string, data interface{}) {
+	if err := s.events.Publish(ctx, userID, eventType, data); err != nil {
+		s.log.Error().Err(err).
+			Str("userId", userID.String()).
+			Str("type", eventType).
+			Msg("failed to publish relationship event")
+	}
+}
+
+// pairKey names the pair of users the same way whichever side is acting.
+func pairKey(a, b uuid.UUID) string {
+	if a.String() > b.String() {
+		a, b = b, a
+	}
+	return "relationship:" + a.String() + ":" + b.String()
+}
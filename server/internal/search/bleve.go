@@ -0,0 +1,287 @@
+package search
+
+import (
+	"context"
+	"discord/internal/id"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/registry"
+	"github.com/blevesearch/bleve/v2/search/highlight"
+	htmlformat "github.com/blevesearch/bleve/v2/search/highlight/format/html"
+	simplefragmenter "github.com/blevesearch/bleve/v2/search/highlight/fragmenter/simple"
+	simplehighlighter "github.com/blevesearch/bleve/v2/search/highlight/highlighter/simple"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/google/uuid"
+)
+
+// highlighterName is a highlighter that wraps matched words in the
+// markers splitSnippet looks for.
+const highlighterName = "discord-marks"
+
+func init() {
+	registry.RegisterHighlighter(highlighterName, func(config map[string]interface{}, cache *registry.Cache) (highlight.Highlighter, error) {
+		fragmenter, err := cache.FragmenterNamed(simplefragmenter.Name)
+		if err != nil {
+			return nil, err
+		}
+		formatter := htmlformat.NewFragmentFormatter(markStart, markEnd)
+		return simplehighlighter.NewHighlighter(fragmenter, formatter, " … "), nil
+	})
+}
+
+// Bleve keeps an index on disk, in this process. Only one process may have
+// it open at a time, so every node needs its own copy, fed through
+// Replicated, and the server must be stopped to rebuild it.
+//
+// Each message is indexed with the users who can read it, so a search
+// never needs the database to check access.
+type Bleve struct {
+	index bleve.Index
+}
+
+// OpenBleve opens the index at path, creating it if there is none.
+func OpenBleve(path string) (SearchIndex, error) {
+	index, err := bleve.Open(path)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		index, err = bleve.New(path, newMapping())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open search index: %w", err)
+	}
+	return &Bleve{index: index}, nil
+}
+
+func newMapping() mapping.IndexMapping {
+	content := mapping.NewTextFieldMapping()
+	content.Analyzer = en.AnalyzerName
+	content.Store = true // for highlighting
+	content.IncludeTermVectors = true
+
+	keyword := mapping.NewKeywordFieldMapping()
+	keyword.Store = false
+
+	flag := mapping.NewBooleanFieldMapping()
+	flag.Store = false
+
+	doc := mapping.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("content", content)
+	for _, name := range []string{"from", "readers", "conversation", "mentions", "seq"} {
+		doc.AddFieldMappingsAt(name, keyword)
+	}
+	for _, name := range []string{"has_attachment", "has_image", "has_link"} {
+		doc.AddFieldMappingsAt(name, flag)
+	}
+
+	m := mapping.NewIndexMapping()
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = en.AnalyzerName
+	return m
+}
+
+// seq is an ID as a keyword that sorts as the ID does. IDs are never
+// negative.
+func seq(i id.ID) string {
+	return fmt.Sprintf("%020d", int64(i))
+}
+
+// conversation names the conversation between two users whichever of them
+// sent the message.
+func conversation(a, b uuid.UUID) string {
+	x, y := a.String(), b.String()
+	if x > y {
+		x, y = y, x
+	}
+	return x + ":" + y
+}
+
+func (b *Bleve) Index(ctx context.Context, docs ...Document) error {
+	batch := b.index.NewBatch()
+	for _, doc := range docs {
+		readers := []string{doc.FromID.String()}
+		if !doc.Suppressed {
+			readers = append(readers, doc.ToID.String())
+		}
+
+		content := stripMarks.Replace(doc.Content)
+		err := batch.Index(doc.ID.String(), map[string]interface{}{
+			"content":        content,
+			"from":           doc.FromID.String(),
+			"readers":        readers,
+			"conversation":   conversation(doc.FromID, doc.ToID),
+			"mentions":       uuidStrings(doc.Mentions),
+			"seq":            seq(doc.ID),
+			"has_attachment": doc.HasAttachment,
+			"has_image":      doc.HasImage,
+			"has_link":       linkPattern.MatchString(content),
+		})
+		if err != nil {
+			return fmt.Errorf("index message %s: %w", doc.ID, err)
+		}
+	}
+
+	if err := b.index.Batch(batch); err != nil {
+		return fmt.Errorf("index messages: %w", err)
+	}
+	return nil
+}
+
+func (b *Bleve) Delete(ctx context.Context, ids ...id.ID) error {
+	batch := b.index.NewBatch()
+	for _, i := range ids {
+		batch.Delete(i.String())
+	}
+	if err := b.index.Batch(batch); err != nil {
+		return fmt.Errorf("delete messages: %w", err)
+	}
+	return nil
+}
+
+func (b *Bleve) Close() error {
+	return b.index.Close()
+}
+
+func (b *Bleve) Search(ctx context.Context, q Query) ([]Hit, error) {
+	if q.Before != nil && *q.Before <= 0 {
+		return nil, nil
+	}
+
+	bq := bleve.NewBooleanQuery()
+	bq.AddMust(term("readers", q.UserID.String()))
+
+	must, mustNot := termsQuery(q.Terms)
+	bq.AddMust(must...)
+	bq.AddMustNot(mustNot...)
+
+	if len(q.From) > 0 {
+		bq.AddMust(anyTerm("from", q.From))
+	}
+	if q.In != nil {
+		bq.AddMust(term("conversation", conversation(q.UserID, *q.In)))
+	}
+	if len(q.Mentions) > 0 {
+		bq.AddMust(anyTerm("mentions", q.Mentions))
+	}
+	for field, set := range map[string]bool{
+		"has_attachment": q.HasAttachment,
+		"has_image":      q.HasImage,
+		"has_link":       q.HasLink,
+	} {
+		if set {
+			flag := bleve.NewBoolFieldQuery(true)
+			flag.SetField(field)
+			bq.AddMust(flag)
+		}
+	}
+	if q.Before != nil || q.After != nil {
+		var lower, upper string
+		if q.After != nil && *q.After > 0 {
+			lower = seq(*q.After)
+		}
+		if q.Before != nil {
+			upper = seq(*q.Before)
+		}
+		if lower != "" || upper != "" {
+			r := bleve.NewTermRangeQuery(lower, upper)
+			r.SetField("seq")
+			bq.AddMust(r)
+		}
+	}
+	if len(q.ExcludeFrom) > 0 {
+		bq.AddMustNot(anyTerm("from", q.ExcludeFrom))
+	}
+
+	req := bleve.NewSearchRequestOptions(bq, q.Limit, 0, false)
+	req.SortBy([]string{"-seq"})
+	if len(must) > 0 {
+		req.Highlight = bleve.NewHighlightWithStyle(highlighterName)
+		req.Highlight.AddField("content")
+	}
+
+	res, err := b.index.SearchInContext(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+
+	hits := make([]Hit, 0, len(res.Hits))
+	for _, h := range res.Hits {
+		parsed, err := id.Parse(h.ID)
+		if err != nil {
+			return nil, fmt.Errorf("search index has a bad message id %q", h.ID)
+		}
+		hits = append(hits, Hit{
+			ID:      parsed,
+			Snippet: splitSnippet(strings.Join(h.Fragments["content"], " … ")),
+		})
+	}
+	return hits, nil
+}
+
+func term(field, value string) query.Query {
+	t := bleve.NewTermQuery(value)
+	t.SetField(field)
+	return t
+}
+
+// anyTerm matches documents with any of users in field.
+func anyTerm(field string, users []uuid.UUID) query.Query {
+	terms := make([]query.Query, len(users))
+	for i, u := range users {
+		terms[i] = term(field, u.String())
+	}
+	return bleve.NewDisjunctionQuery(terms...)
+}
+
+// termsQuery turns words in websearch_to_tsquery syntax into queries on
+// content: each word or "quoted phrase" must match, "a OR b" needs either,
+// and -word or -"phrase" must not match.
+func termsQuery(terms string) (must, mustNot []query.Query) {
+	orNext := false
+	for terms = strings.TrimSpace(terms); terms != ""; terms = strings.TrimSpace(terms) {
+		negate := strings.HasPrefix(terms, "-")
+		if negate {
+			terms = terms[1:]
+		}
+
+		var q query.Query
+		if strings.HasPrefix(terms, `"`) {
+			var phrase string
+			phrase, terms, _ = strings.Cut(terms[1:], `"`)
+			if strings.TrimSpace(phrase) == "" {
+				continue
+			}
+			p := bleve.NewMatchPhraseQuery(phrase)
+			p.SetField("content")
+			q = p
+		} else {
+			var word string
+			word, terms, _ = strings.Cut(terms, " ")
+			if word == "" {
+				continue
+			}
+			if word == "OR" && !negate && len(must) > 0 {
+				orNext = true
+				continue
+			}
+			m := bleve.NewMatchQuery(word)
+			m.SetField("content")
+			m.SetOperator(query.MatchQueryOperatorAnd)
+			q = m
+		}
+
+		switch {
+		case negate:
+			mustNot = append(mustNot, q)
+		case orNext:
+			must[len(must)-1] = bleve.NewDisjunctionQuery(must[len(must)-1], q)
+		default:
+			must = append(must, q)
+		}
+		orNext = false
+	}
+	return must, mustNot
+}
@@ -0,0 +1,214 @@
+package search
+
+import (
+	"context"
+	"discord/internal/id"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/google/uuid"
+)
+
+// describe writes a content query the way it was typed: words bare,
+// phrases quoted and alternatives in parentheses.
+func describe(q query.Query) string {
+	switch q := q.(type) {
+	case *query.MatchQuery:
+		return q.Match
+	case *query.MatchPhraseQuery:
+		return `"` + q.MatchPhrase + `"`
+	case *query.DisjunctionQuery:
+		parts := make([]string, len(q.Disjuncts))
+		for i, d := range q.Disjuncts {
+			parts[i] = describe(d)
+		}
+		return "(" + strings.Join(parts, " OR ") + ")"
+	}
+	return "?"
+}
+
+func describeAll(qs []query.Query) []string {
+	out := []string{}
+	for _, q := range qs {
+		out = append(out, describe(q))
+	}
+	return out
+}
+
+func TestTermsQuery(t *testing.T) {
+	tests := []struct {
+		terms   string
+		must    []string
+		mustNot []string
+	}{
+		{terms: "", must: []string{}, mustNot: []string{}},
+		{terms: "hello world", must: []string{"hello", "world"}, mustNot: []string{}},
+		{terms: "  spaced   out  ", must: []string{"spaced", "out"}, mustNot: []string{}},
+		{terms: `"big cat" dog`, must: []string{`"big cat"`, "dog"}, mustNot: []string{}},
+		{terms: `"unterminated phrase`, must: []string{`"unterminated phrase"`}, mustNot: []string{}},
+		{terms: `"" cat`, must: []string{"cat"}, mustNot: []string{}},
+		{terms: "cat OR dog", must: []string{"(cat OR dog)"}, mustNot: []string{}},
+		{terms: "cat OR dog OR bird", must: []string{"((cat OR dog) OR bird)"}, mustNot: []string{}},
+		{terms: `fish cat OR "big dog"`, must: []string{"fish", `(cat OR "big dog")`}, mustNot: []string{}},
+		{terms: "-cat dog", must: []string{"dog"}, mustNot: []string{"cat"}},
+		{terms: `dog -"big cat"`, must: []string{"dog"}, mustNot: []string{`"big cat"`}},
+		// OR needs a word before it, and never applies to an exclusion.
+		{terms: "OR cat", must: []string{"OR", "cat"}, mustNot: []string{}},
+		{terms: "cat OR -dog", must: []string{"cat"}, mustNot: []string{"dog"}},
+		{terms: "cat -OR dog", must: []string{"cat", "dog"}, mustNot: []string{"OR"}},
+	}
+
+	for _, tt := range tests {
+		must, mustNot := termsQuery(tt.terms)
+		if got := describeAll(must); !reflect.DeepEqual(got, tt.must) {
+			t.Errorf("termsQuery(%q) must = %q, want %q", tt.terms, got, tt.must)
+		}
+		if got := describeAll(mustNot); !reflect.DeepEqual(got, tt.mustNot) {
+			t.Errorf("termsQuery(%q) mustNot = %q, want %q", tt.terms, got, tt.mustNot)
+		}
+	}
+}
+
+func TestBleveSearch(t *testing.T) {
+	index, err := OpenBleve(filepath.Join(t.TempDir(), "search.bleve"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	ctx := context.Background()
+
+	err = index.Index(ctx,
+		Document{ID: 1, FromID: alice, ToID: bob, Content: "Have you fed the cats?"},
+		Document{ID: 2, FromID: bob, ToID: alice, Content: "The cat is fed, see https://example.com/cat", Mentions: []uuid.UUID{alice}},
+		Document{ID: 3, FromID: bob, ToID: alice, Content: "photo of the dog", HasAttachment: true, HasImage: true},
+		Document{ID: 4, FromID: carol, ToID: alice, Content: "my cat says hi", HasAttachment: true},
+		Document{ID: 5, FromID: carol, ToID: alice, Content: "cat spam", Suppressed: true},
+		Document{ID: 6, FromID: bob, ToID: carol, Content: "a secret about the cat"},
+		Document{ID: 7, FromID: alice, ToID: bob, Content: "forged " + markStart + "marks" + markEnd + " cat"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ptr := func(i id.ID) *id.ID { return &i }
+
+	tests := []struct {
+		name string
+		q    Query
+		want []id.ID
+	}{
+		{name: "words match stems, newest first", q: Query{UserID: alice, Terms: "cat"}, want: []id.ID{7, 4, 2, 1}},
+		{name: "suppressed messages only for the sender", q: Query{UserID: carol, Terms: "cat"}, want: []id.ID{6, 5, 4}},
+		{name: "other conversations are hidden", q: Query{UserID: bob, Terms: "secret"}, want: []id.ID{6}},
+		{name: "no terms, filters only", q: Query{UserID: alice, From: []uuid.UUID{bob}}, want: []id.ID{3, 2}},
+		{name: "in a conversation", q: Query{UserID: alice, Terms: "cat", In: &carol}, want: []id.ID{4}},
+		{name: "mentions", q: Query{UserID: bob, Mentions: []uuid.UUID{alice}}, want: []id.ID{2}},
+		{name: "has attachment", q: Query{UserID: alice, HasAttachment: true}, want: []id.ID{4, 3}},
+		{name: "has image", q: Query{UserID: alice, HasImage: true}, want: []id.ID{3}},
+		{name: "has link", q: Query{UserID: alice, HasLink: true}, want: []id.ID{2}},
+		{name: "phrase", q: Query{UserID: alice, Terms: `"cat is fed"`}, want: []id.ID{2}},
+		{name: "or", q: Query{UserID: alice, Terms: "dog OR cats"}, want: []id.ID{7, 4, 3, 2, 1}},
+		{name: "exclusion", q: Query{UserID: alice, Terms: "cat -fed"}, want: []id.ID{7, 4}},
+		{name: "before is exclusive", q: Query{UserID: alice, Terms: "cat", Before: ptr(4)}, want: []id.ID{2, 1}},
+		{name: "after is inclusive", q: Query{UserID: alice, Terms: "cat", After: ptr(2)}, want: []id.ID{7, 4, 2}},
+		{name: "exclude from", q: Query{UserID: alice, Terms: "cat", ExcludeFrom: []uuid.UUID{carol}}, want: []id.ID{7, 2, 1}},
+		{name: "limit", q: Query{UserID: alice, Terms: "cat", Limit: 2}, want: []id.ID{7, 4}},
+		{name: "markers are stripped", q: Query{UserID: alice, Terms: "marks"}, want: []id.ID{7}},
+		{name: "no match", q: Query{UserID: alice, Terms: "giraffe"}, want: []id.ID{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.q.Limit == 0 {
+				tt.q.Limit = 25
+			}
+			hits, err := index.Search(ctx, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []id.ID{}
+			for _, h := range hits {
+				got = append(got, h.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBleveSnippet(t *testing.T) {
+	index, err := OpenBleve(filepath.Join(t.TempDir(), "search.bleve"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	alice, bob := uuid.New(), uuid.New()
+	ctx := context.Background()
+
+	if err := index.Index(ctx, Document{ID: 1, FromID: alice, ToID: bob, Content: "the cats are asleep"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := index.Search(ctx, Query{UserID: bob, Terms: "cat", Limit: 1})
+	if err != nil || len(hits) != 1 {
+		t.Fatalf("Search = %v, %v", hits, err)
+	}
+	want := []SnippetPart{{Text: "the "}, {Text: "cats", Match: true}, {Text: " are asleep"}}
+	if !reflect.DeepEqual(hits[0].Snippet, want) {
+		t.Errorf("Snippet = %+v, want %+v", hits[0].Snippet, want)
+	}
+
+	hits, err = index.Search(ctx, Query{UserID: bob, From: []uuid.UUID{alice}, Limit: 1})
+	if err != nil || len(hits) != 1 {
+		t.Fatalf("Search = %v, %v", hits, err)
+	}
+	if hits[0].Snippet != nil {
+		t.Errorf("Snippet without terms = %+v, want none", hits[0].Snippet)
+	}
+}
+
+func TestBleveDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.bleve")
+	index, err := OpenBleve(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := uuid.New(), uuid.New()
+	ctx := context.Background()
+
+	err = index.Index(ctx,
+		Document{ID: 1, FromID: alice, ToID: bob, Content: "first cat"},
+		Document{ID: 2, FromID: alice, ToID: bob, Content: "second cat"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Delete(ctx, 1, 99); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening keeps what was indexed.
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = OpenBleve(path); err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	hits, err := index.Search(ctx, Query{UserID: alice, Terms: "cat", Limit: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ID != 2 {
+		t.Errorf("Search after delete = %v, want only 2", hits)
+	}
+}
@@ -0,0 +1,95 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/id"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// searchableTypes are the message types with searchable content: default
+// messages and replies. System messages are never indexed.
+var searchableTypes = []int64{0, 19}
+
+// Postgres searches the messages table with its full-text index, so it
+// never falls behind and there is nothing to feed it.
+type Postgres struct {
+	db *sql.DB
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Index(ctx context.Context, docs ...Document) error { return nil }
+
+func (p *Postgres) Delete(ctx context.Context, ids ...id.ID) error { return nil }
+
+func (p *Postgres) Close() error { return nil }
+
+func (p *Postgres) Search(ctx context.Context, q Query) ([]Hit, error) {
+	headline := fmt.Sprintf(`StartSel=%s, StopSel=%s, MaxWords=30, MinWords=12, MaxFragments=2, FragmentDelimiter=" … "`,
+		markStart, markEnd)
+
+	// The tsvector expression must match idx_messages_content_search for
+	// the index to be used.
+	const query = `
+        SELECT m.id,
+            CASE WHEN $2 = '' THEN ''
+                 ELSE ts_headline('english', translate(m.content, $12, ''), websearch_to_tsquery('english', $2), $13)
+            END
+        FROM messages m
+        WHERE (m.from_id = $1 OR (m.to_id = $1 AND NOT m.suppressed))
+          AND m.type = ANY($11)
+          AND ($2 = '' OR to_tsvector('english', m.content) @@ websearch_to_tsquery('english', $2))
+          AND (coalesce(cardinality($3::uuid[]), 0) = 0 OR m.from_id = ANY($3::uuid[]))
+          AND ($4::uuid IS NULL OR (m.from_id = $1 AND m.to_id = $4) OR (m.from_id = $4 AND m.to_id = $1))
+          AND (coalesce(cardinality($5::uuid[]), 0) = 0 OR m.mention_user_ids && $5::uuid[])
+          AND (NOT $6 OR EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = m.id))
+          AND (NOT $7 OR EXISTS (
+                SELECT 1 FROM attachments a JOIN blobs b ON b.checksum = a.checksum
+                WHERE a.message_id = m.id AND b.width IS NOT NULL))
+          AND (NOT $8 OR m.content ~* 'https?://')
+          AND ($9::bigint IS NULL OR m.id < $9)
+          AND ($10::bigint IS NULL OR m.id >= $10)
+          AND NOT (m.from_id = ANY($14::uuid[]))
+        ORDER BY m.id DESC
+        LIMIT $15`
+
+	rows, err := p.db.QueryContext(ctx, query,
+		q.UserID, q.Terms, pq.Array(uuidStrings(q.From)), q.In, pq.Array(uuidStrings(q.Mentions)),
+		q.HasAttachment, q.HasImage, q.HasLink, q.Before, q.After,
+		pq.Array(searchableTypes), markStart+markEnd, headline,
+		pq.Array(uuidStrings(q.ExcludeFrom)), q.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search messages: %w", err)
+	}
+	defer rows.Close()
+
+	var hits []Hit
+	for rows.Next() {
+		var hit Hit
+		var snippet string
+		if err := rows.Scan(&hit.ID, &snippet); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		hit.Snippet = splitSnippet(snippet)
+		hits = append(hits, hit)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating messages: %w", err)
+	}
+	return hits, nil
+}
+
+func uuidStrings(ids []uuid.UUID) []string {
+	out := make([]string, len(ids))
+	for i, u := range ids {
+		out[i] = u.String()
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/id"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// reindexBatch is how many messages Reindex reads and indexes at a time.
+const reindexBatch = 500
+
+// Reindex feeds every searchable message in db to index, oldest first.
+// progress, if not nil, is called with the running count after each batch.
+// It returns how many messages were indexed.
+func Reindex(ctx context.Context, db *sql.DB, index SearchIndex, progress func(n int)) (int, error) {
+	const q = `
+        SELECT m.id, m.from_id, m.to_id, m.content, m.mention_user_ids, m.created_at, m.suppressed,
+            EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = m.id),
+            EXISTS (
+                SELECT 1 FROM attachments a JOIN blobs b ON b.checksum = a.checksum
+                WHERE a.message_id = m.id AND b.width IS NOT NULL)
+        FROM messages m
+        WHERE m.id > $1 AND m.type = ANY($2)
+        ORDER BY m.id
+        LIMIT $3`
+
+	var after id.ID
+	total := 0
+	for {
+		rows, err := db.QueryContext(ctx, q, after, pq.Array(searchableTypes), reindexBatch)
+		if err != nil {
+			return total, fmt.Errorf("failed to query messages: %w", err)
+		}
+
+		var docs []Document
+		for rows.Next() {
+			var doc Document
+			var mentions []string
+			if err := rows.Scan(
+				&doc.ID,
+				&doc.FromID,
+				&doc.ToID,
+				&doc.Content,
+				pq.Array(&mentions),
+				&doc.CreatedAt,
+				&doc.Suppressed,
+				&doc.HasAttachment,
+				&doc.HasImage,
+			); err != nil {
+				rows.Close()
+				return total, fmt.Errorf("failed to scan message: %w", err)
+			}
+			for _, m := range mentions {
+				if u, err := uuid.Parse(m); err == nil {
+					doc.Mentions = append(doc.Mentions, u)
+				}
+			}
+			docs = append(docs, doc)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return total, fmt.Errorf("error iterating messages: %w", err)
+		}
+
+		if len(docs) == 0 {
+			return total, nil
+		}
+		if err := index.Index(ctx, docs...); err != nil {
+			return total, err
+		}
+
+		total += len(docs)
+		after = docs[len(docs)-1].ID
+		if progress != nil {
+			progress(total)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package search
+
+import (
+	"context"
+	"discord/internal/id"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// updatesChannel carries index changes to every node.
+const updatesChannel = "search:updates"
+
+// update is a change to the index, as sent to every node.
+type update struct {
+	Docs   []Document `json:"docs,omitempty"`
+	Delete []id.ID    `json:"delete,omitempty"`
+}
+
+// Replicated keeps a copy of an index on every node, for backends such as
+// Bleve that only index in this process. Index and Delete publish the
+// change through Redis, and every node, this one included, applies what
+// it receives to its own copy, so a message is indexed everywhere whichever
+// node sent it. Search reads the local copy.
+//
+// Redis delivers each change at most once, to the nodes subscribed at the
+// time. A node that was down or lost its connection misses changes, and
+// catches up with a reindex.
+type Replicated struct {
+	local  SearchIndex
+	redis  *redis.Client
+	pubsub *redis.PubSub
+	log    *zerolog.Logger
+	done   chan struct{}
+}
+
+// NewReplicated starts applying changes from every node to local. Changes
+// published once it returns are not missed.
+func NewReplicated(ctx context.Context, local SearchIndex, rdb *redis.Client, log *zerolog.Logger) (*Replicated, error) {
+	pubsub := rdb.Subscribe(ctx, updatesChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("subscribe to search updates: %w", err)
+	}
+
+	r := &Replicated{
+		local:  local,
+		redis:  rdb,
+		pubsub: pubsub,
+		log:    log,
+		done:   make(chan struct{}),
+	}
+	go r.apply()
+	return r, nil
+}
+
+func (r *Replicated) Index(ctx context.Context, docs ...Document) error {
+	return r.publish(ctx, update{Docs: docs})
+}
+
+func (r *Replicated) Delete(ctx context.Context, ids ...id.ID) error {
+	return r.publish(ctx, update{Delete: ids})
+}
+
+func (r *Replicated) Search(ctx context.Context, q Query) ([]Hit, error) {
+	return r.local.Search(ctx, q)
+}
+
+// Close stops taking changes, then closes the local copy.
+func (r *Replicated) Close() error {
+	r.pubsub.Close()
+	<-r.done
+	return r.local.Close()
+}
+
+func (r *Replicated) publish(ctx context.Context, u update) error {
+	payload, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("marshal search update: %w", err)
+	}
+	if err := r.redis.Publish(ctx, updatesChannel, payload).Err(); err != nil {
+		return fmt.Errorf("publish search update: %w", err)
+	}
+	return nil
+}
+
+// apply writes the changes every node publishes to the local copy, in the
+// order they arrive.
+func (r *Replicated) apply() {
+	defer close(r.done)
+
+	for msg := range r.pubsub.Channel() {
+		var u update
+		if err := json.Unmarshal([]byte(msg.Payload), &u); err != nil {
+			r.log.Error().Err(err).Msg("invalid search update")
+			continue
+		}
+
+		ctx := context.Background()
+		if len(u.Docs) > 0 {
+			if err := r.local.Index(ctx, u.Docs...); err != nil {
+				r.log.Error().Err(err).Int("messages", len(u.Docs)).Msg("failed to apply search update")
+			}
+		}
+		if len(u.Delete) > 0 {
+			if err := r.local.Delete(ctx, u.Delete...); err != nil {
+				r.log.Error().Err(err).Int("messages", len(u.Delete)).Msg("failed to apply search update")
+			}
+		}
+	}
+}
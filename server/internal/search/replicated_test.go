@@ -0,0 +1,79 @@
+package search
+
+import (
+	"context"
+	"discord/internal/id"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+func TestReplicated(t *testing.T) {
+	mr := miniredis.RunT(t)
+	log := zerolog.Nop()
+	ctx := context.Background()
+
+	// Two nodes, each with its own Redis connection and Bleve copy.
+	nodes := make([]*Replicated, 2)
+	for i := range nodes {
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+
+		local, err := OpenBleve(filepath.Join(t.TempDir(), fmt.Sprintf("node%d.bleve", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i], err = NewReplicated(ctx, local, rdb, &log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { nodes[i].Close() })
+	}
+
+	alice, bob := uuid.New(), uuid.New()
+	q := Query{UserID: bob, Terms: "cat", Limit: 25}
+
+	// waitFor polls every node until it finds want.
+	waitFor := func(want []id.ID) {
+		t.Helper()
+		for i, node := range nodes {
+			var got []id.ID
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				hits, err := node.Search(ctx, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = []id.ID{}
+				for _, h := range hits {
+					got = append(got, h.ID)
+				}
+				if reflect.DeepEqual(got, want) {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("node %d finds %v, want %v", i, got, want)
+			}
+		}
+	}
+
+	if err := nodes[0].Index(ctx, Document{ID: 1, FromID: alice, ToID: bob, Content: "first cat"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].Index(ctx, Document{ID: 2, FromID: alice, ToID: bob, Content: "second cat"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor([]id.ID{2, 1})
+
+	if err := nodes[1].Delete(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor([]id.ID{2})
+}
@@ -0,0 +1,134 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"discord/internal/config"
+	"discord/internal/id"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+// Highlight markers around matched words in snippets. They come from the
+// private use area and are removed from content before it is searched, so
+// they cannot be forged.
+const (
+	markStart = "\ue000"
+	markEnd   = "\ue001"
+)
+
+// stripMarks removes the highlight markers from content.
+var stripMarks = strings.NewReplacer(markStart, "", markEnd, "")
+
+// linkPattern matches content that has:link finds.
+var linkPattern = regexp.MustCompile(`(?i)https?://`)
+
+// SearchIndex finds messages by their content. Backends that keep their
+// own index are fed every user message as it is sent, edited or deleted;
+// one that falls behind is rebuilt with Reindex.
+type SearchIndex interface {
+	// Index adds docs, replacing any already indexed under the same IDs.
+	Index(ctx context.Context, docs ...Document) error
+	// Delete removes messages. Deleting one that is not indexed is not an
+	// error.
+	Delete(ctx context.Context, ids ...id.ID) error
+	// Search returns the messages matching q that q.UserID can read,
+	// newest first.
+	Search(ctx context.Context, q Query) ([]Hit, error)
+	Close() error
+}
+
+// Document is what is indexed about a message. Mentions are the users it
+// mentions by name. Suppressed messages were never delivered, so only
+// their sender finds them.
+type Document struct {
+	ID            id.ID
+	FromID        uuid.UUID
+	ToID          uuid.UUID
+	Content       string
+	Mentions      []uuid.UUID
+	CreatedAt     time.Time
+	Suppressed    bool
+	HasAttachment bool
+	HasImage      bool
+}
+
+// Query is a parsed search. Terms are the words to match in
+// websearch_to_tsquery syntax: quoted phrases, OR and -excluded words. The
+// other fields are filters, and every one given must match. Before is
+// exclusive and After inclusive. Messages from ExcludeFrom, such as users
+// the searcher has blocked, are left out.
+type Query struct {
+	UserID        uuid.UUID
+	Terms         string
+	From          []uuid.UUID
+	In            *uuid.UUID
+	Mentions      []uuid.UUID
+	HasAttachment bool
+	HasImage      bool
+	HasLink       bool
+	Before        *id.ID
+	After         *id.ID
+	ExcludeFrom   []uuid.UUID
+	Limit         int
+}
+
+// Hit is a message that matched a search. Snippet is the part of its
+// content around the matched words, and is empty when the query had no
+// terms.
+type Hit struct {
+	ID      id.ID
+	Snippet []SnippetPart
+}
+
+// SnippetPart is a piece of a snippet. Match is set for matched words.
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// New returns the search index selected by cfg.Backend. A Bleve index is
+// kept in step with every other node's through rdb.
+func New(ctx context.Context, cfg *config.SearchConfig, db *sql.DB, rdb *redis.Client, log *zerolog.Logger) (SearchIndex, error) {
+	if cfg.Backend != "bleve" {
+		return NewPostgres(db), nil
+	}
+
+	local, err := OpenBleve(cfg.BlevePath)
+	if err != nil {
+		return nil, err
+	}
+	index, err := NewReplicated(ctx, local, rdb, log)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// splitSnippet turns highlighted text into parts, using the markers around
+// matched words.
+func splitSnippet(s string) []SnippetPart {
+	var parts []SnippetPart
+	for s != "" {
+		before, rest, found := strings.Cut(s, markStart)
+		if before != "" {
+			parts = append(parts, SnippetPart{Text: before})
+		}
+		if !found {
+			break
+		}
+
+		match, after, _ := strings.Cut(rest, markEnd)
+		if match != "" {
+			parts = append(parts, SnippetPart{Text: match, Match: true})
+		}
+		s = after
+	}
+	return parts
+}
@@ -0,0 +1,56 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSnippet(t *testing.T) {
+	mark := func(s string) string { return markStart + s + markEnd }
+
+	tests := []struct {
+		name string
+		in   string
+		want []SnippetPart
+	}{
+		{name: "empty", in: "", want: nil},
+		{name: "no match", in: "just text", want: []SnippetPart{{Text: "just text"}}},
+		{name: "whole", in: mark("cat"), want: []SnippetPart{{Text: "cat", Match: true}}},
+		{
+			name: "middle",
+			in:   "the " + mark("cat") + " sat",
+			want: []SnippetPart{{Text: "the "}, {Text: "cat", Match: true}, {Text: " sat"}},
+		},
+		{
+			name: "adjacent",
+			in:   mark("big") + mark("cat"),
+			want: []SnippetPart{{Text: "big", Match: true}, {Text: "cat", Match: true}},
+		},
+		{
+			name: "several",
+			in:   mark("cat") + " and " + mark("dog") + " … " + mark("cat"),
+			want: []SnippetPart{
+				{Text: "cat", Match: true}, {Text: " and "}, {Text: "dog", Match: true},
+				{Text: " … "}, {Text: "cat", Match: true},
+			},
+		},
+		{name: "empty mark", in: "a" + mark("") + "b", want: []SnippetPart{{Text: "a"}, {Text: "b"}}},
+		{name: "unclosed", in: "the " + markStart + "cat", want: []SnippetPart{{Text: "the "}, {Text: "cat", Match: true}}},
+		{name: "stray end", in: "a" + markEnd + "b", want: []SnippetPart{{Text: "a" + markEnd + "b"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitSnippet(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitSnippet(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripMarks(t *testing.T) {
+	in := "a" + markStart + "b" + markEnd + "c" + markEnd
+	if got := stripMarks.Replace(in); got != "abc" {
+		t.Errorf("stripMarks(%q) = %q, want abc", in, got)
+	}
+}
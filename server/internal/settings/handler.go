@@ -0,0 +1,103 @@
+package settings
+
+import (
+	"discord/internal/http/response"
+	"discord/internal/validation"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+type Handler struct {
+	svc      *Service
+	validate *validation.Validator
+	log      *zerolog.Logger
+}
+
+func NewHandler(svc *Service, validate *validation.Validator, log *zerolog.Logger) *Handler {
+	return &Handler{
+		svc:      svc,
+		validate: validate,
+		log:      log,
+	}
+}
+
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/", h.handleGetSettings)
+	r.Patch("/", h.handleUpdateSettings)
+
+	return r
+}
+
+// @Summary Get settings
+// @Description Get the signed-in user's settings
+// @Tags settings
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {object} Settings
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /settings [get]
+func (h *Handler) handleGetSettings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	st, err := h.svc.Get(r.Context(), userID)
+	if err != nil {
+		h.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to get settings")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// @Summary Update settings
+// @Description Update the signed-in user's settings. Omitted fields are left unchanged. dmPolicy decides who may start a DM: everyone, friends, or guilds (friends and guild members). readReceipts lets DM peers see how far you have read.
+// @Tags settings
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param request body UpdateSettingsRequest true "Settings to change"
+// @Success 200 {object} Settings
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /settings [patch]
+func (h *Handler) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req UpdateSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	st, err := h.svc.Update(r.Context(), userID, req)
+	if err != nil {
+		h.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to update settings")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,97 @@
+package settings
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+// Who may open a new DM with the user.
+const (
+	DMPolicyEveryone = "everyone"
+	DMPolicyFriends  = "friends"
+	// DMPolicyGuilds admits friends and members of a guild the user is
+	// in. There are no guilds yet, so for now it admits friends only.
+	DMPolicyGuilds = "guilds"
+)
+
+// Settings are a user's private preferences.
+type Settings struct {
+	DMPolicy string `json:"dmPolicy" enums:"everyone,friends,guilds"`
+	// ReadReceipts lets DM peers see how far the user has read.
+	ReadReceipts bool      `json:"readReceipts"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// UpdateSettingsRequest changes only the fields that are present.
+type UpdateSettingsRequest struct {
+	DMPolicy     *string `json:"dmPolicy" validate:"omitempty,oneof=everyone friends guilds"`
+	ReadReceipts *bool   `json:"readReceipts"`
+}
+
+type Service struct {
+	db  *sql.DB
+	log *zerolog.Logger
+}
+
+func NewService(db *sql.DB, log *zerolog.Logger) *Service {
+	return &Service{
+		db:  db,
+		log: log,
+	}
+}
+
+// defaults apply to users who have never changed a setting.
+func defaults() *Settings {
+	return &Settings{
+		DMPolicy:     DMPolicyEveryone,
+		ReadReceipts: true,
+	}
+}
+
+// Get returns userID's settings, or the defaults if they have none stored.
+func (s *Service) Get(ctx context.Context, userID uuid.UUID) (*Settings, error) {
+	const q = `SELECT dm_policy, read_receipts, updated_at FROM user_settings WHERE user_id = $1`
+
+	st := defaults()
+	err := s.db.QueryRowContext(ctx, q, userID).Scan(&st.DMPolicy, &st.ReadReceipts, &st.UpdatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get settings: %w", err)
+	}
+
+	return st, nil
+}
+
+// Update applies the present fields of req to userID's settings.
+func (s *Service) Update(ctx context.Context, userID uuid.UUID, req UpdateSettingsRequest) (*Settings, error) {
+	d := defaults()
+
+	const q = `
+        INSERT INTO user_settings (user_id, dm_policy, read_receipts, updated_at)
+        VALUES ($1, COALESCE($2, $4), COALESCE($3, $5), $6)
+        ON CONFLICT (user_id) DO UPDATE SET
+            dm_policy = COALESCE($2, user_settings.dm_policy),
+            read_receipts = COALESCE($3, user_settings.read_receipts),
+            updated_at = EXCLUDED.updated_at
+        RETURNING dm_policy, read_receipts, updated_at`
+
+	var st Settings
+	err := s.db.QueryRowContext(ctx, q,
+		userID,
+		req.DMPolicy,
+		req.ReadReceipts,
+		d.DMPolicy,
+		d.ReadReceipts,
+		time.Now(),
+	).Scan(&st.DMPolicy, &st.ReadReceipts, &st.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update settings: %w", err)
+	}
+
+	return &st, nil
+}
@@ -1,8 +1,15 @@
 package user
 
 import (
+	"database/sql"
+	"discord/internal/attachment"
+	"discord/internal/http/response"
+	"discord/internal/ratelimit"
+	"discord/internal/validation"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -10,32 +17,61 @@ import (
 )
 
 type Handler struct {
-	svc *Service
-	log *zerolog.Logger
+	svc         *Service
+	attachments *attachment.Service
+	validate    *validation.Validator
+	limiter     *ratelimit.Limiter
+	log         *zerolog.Logger
 }
 
-func NewHandler(svc *Service, log *zerolog.Logger) *Handler {
+type SearchRequest struct {
+	Query  string `json:"q" validate:"required,max=100"`
+	Cursor string `json:"cursor" validate:"omitempty,base64rawurl"`
+	Limit  int    `json:"limit" validate:"min=1,max=25"`
+}
+
+func NewHandler(svc *Service, attachments *attachment.Service, validate *validation.Validator, limiter *ratelimit.Limiter, log *zerolog.Logger) *Handler {
 	return &Handler{
-		svc: svc,
-		log: log,
+		svc:         svc,
+		attachments: attachments,
+		validate:    validate,
+		limiter:     limiter,
+		log:         log,
 	}
 }
 
 // @Summary Search users
-// @Description Search users by username or email
+// @Description Search users by username or display name, ranked exact > prefix > similar, with people you have messaged ranked higher. Exact email matches are included for users who allow it.
 // @Tags users
 // @Accept json
 // @Produce json
 // @Param Authorization header string true "Bearer token"
 // @Param q query string true "Search query"
-// @Success 200 {array} User
-// @Failure 400 {string} string "Bad request"
-// @Failure 401 {string} string "Unauthorized"
+// @Param cursor query string false "Cursor from the previous page"
+// @Param limit query int false "Page size (1-25, default 10)"
+// @Success 200 {object} SearchPage
+// @Failure 400 {object} response.Problem "Bad request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 429 {object} response.Problem "Rate limit exceeded"
+// @Failure 500 {object} response.Problem "Internal server error"
 // @Router /users/search [get]
 func (h *Handler) handleSearch(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "search query is required", http.StatusBadRequest)
+	req := SearchRequest{
+		Query:  r.URL.Query().Get("q"),
+		Cursor: r.URL.Query().Get("cursor"),
+		Limit:  10,
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			response.Render(w, r, response.ErrInvalidRequest("limit must be a number"))
+			return
+		}
+		req.Limit = n
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
 		return
 	}
 
@@ -43,23 +79,136 @@ func (h *Handler) handleSearch(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID")
 	if userID == nil {
 		h.log.Warn().Msg("userID is missing or invalid in context")
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
 		return
 	}
 
 	parsedUserID := userID.(uuid.UUID)
 
-	users, err := h.svc.SearchUsers(r.Context(), query, parsedUserID.String())
+	page, err := h.svc.SearchUsers(r.Context(), parsedUserID.String(), req.Query, req.Cursor, req.Limit)
 	if err != nil {
+		if errors.Is(err, ErrInvalidCursor) {
+			response.Render(w, r, response.ErrInvalidRequest(err.Error()))
+			return
+		}
 		h.log.Error().Err(err).
-			Str("query", query).
+			Str("query", req.Query).
 			Msg("failed to search users")
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		h.log.Error().Err(err).Msg("failed to encode response")
+	}
+}
+
+// handleGetMe serves GET /users/@me. It is documented together with
+// handleGetUser, since swag cannot express the @me path segment.
+func (h *Handler) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	user, err := h.svc.GetByID(r.Context(), userID.String())
+	if err != nil {
+		h.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to get user")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	usage, err := h.attachments.Usage(r.Context(), userID)
+	if err != nil {
+		h.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to get storage usage")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Me{User: user, Storage: usage}); err != nil {
+		h.log.Error().Err(err).Msg("failed to encode response")
+	}
+}
+
+// @Summary Update current user's profile
+// @Description Update the signed-in user's public profile. Omitted fields are left unchanged.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "Must be @me"
+// @Param request body UpdateUserRequest true "Profile fields to change"
+// @Success 200 {object} User
+// @Failure 400 {object} response.Problem "Invalid request"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /users/{userID} [patch]
+func (h *Handler) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(uuid.UUID)
+	if !ok {
+		response.Render(w, r, response.ErrUnauthorized("missing user in request context"))
+		return
+	}
+
+	var req UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid request body"))
+		return
+	}
+
+	if p := h.validate.Check(r, req); p != nil {
+		response.Render(w, r, p)
+		return
+	}
+
+	user, err := h.svc.UpdateUser(r.Context(), userID.String(), req)
+	if err != nil {
+		h.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to update profile")
+		response.Render(w, r, response.ErrInternal())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		h.log.Error().Err(err).Msg("failed to encode response")
+	}
+}
+
+// @Summary Get user
+// @Description Get a user's public profile. Pass @me as the ID to get the signed-in user's full account, including email and attachment storage use against their quota.
+// @Tags users
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param userID path string true "User ID or @me"
+// @Success 200 {object} Profile "Public profile, or Me for @me"
+// @Failure 400 {object} response.Problem "Invalid user id"
+// @Failure 401 {object} response.Problem "Unauthorized"
+// @Failure 404 {object} response.Problem "User not found"
+// @Failure 500 {object} response.Problem "Internal server error"
+// @Router /users/{userID} [get]
+func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "userID"))
+	if err != nil {
+		response.Render(w, r, response.ErrInvalidRequest("invalid user id"))
+		return
+	}
+
+	profile, err := h.svc.GetProfile(r.Context(), userID.String())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			response.Render(w, r, response.ErrNotFound("user not found"))
+			return
+		}
+		h.log.Error().Err(err).Str("userId", userID.String()).Msg("failed to get profile")
+		response.Render(w, r, response.ErrInternal())
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(users); err != nil {
+	if err := json.NewEncoder(w).Encode(profile); err != nil {
 		h.log.Error().Err(err).Msg("failed to encode response")
 	}
 }
@@ -67,7 +216,10 @@ func (h *Handler) handleSearch(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) Routes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Get("/search", h.handleSearch)
+	r.With(h.limiter.Middleware(ratelimit.GroupSearch)).Get("/search", h.handleSearch)
+	r.Get("/@me", h.handleGetMe)
+	r.Patch("/@me", h.handleUpdateMe)
+	r.Get("/{userID}", h.handleGetUser)
 
 	return r
 }
@@ -0,0 +1,172 @@
+package user
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("invalid search cursor")
+
+// SearchPage is one page of ranked search results. NextCursor is empty on
+// the last page.
+type SearchPage struct {
+	Users      []Profile `json:"users"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+// searchCursor marks the last result of a page by its score and ID, the
+// same pair the results are ordered by.
+type searchCursor struct {
+	score float64
+	id    string
+}
+
+func (c searchCursor) encode() string {
+	raw := strconv.FormatFloat(c.score, 'g', -1, 64) + ":" + c.id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSearchCursor(s string) (*searchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	score, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &searchCursor{score: f, id: id}, nil
+}
+
+// SearchUsers ranks users by how well their username or display name matches
+// query: exact matches first, then prefix matches, then trigram similarity.
+// People the caller has already messaged get a boost within their tier. An
+// exact email match also counts, unless the user has opted out. Users who
+// have blocked the caller, or whom the caller has blocked, never appear.
+func (s *Service) SearchUsers(ctx context.Context, callerID, query, cursor string, limit int) (*SearchPage, error) {
+	q := strings.ToLower(strings.TrimSpace(query))
+
+	var after *searchCursor
+	if cursor != "" {
+		c, err := decodeSearchCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = c
+	}
+
+	// Tiers are whole numbers and similarity stays within [0, 1], so the
+	// contact boost can reorder results within a tier but never across one.
+	sqlQuery := `
+        WITH ranked AS (
+            SELECT ` + profileColumns + `, (
+                CASE
+                    WHEN lower(username) = $2 OR (discoverable_by_email AND lower(email) = $2) THEN 3
+                    WHEN lower(username) LIKE $3 OR lower(display_name) LIKE $3 THEN 2
+                    ELSE 0
+                END
+                + GREATEST(similarity(lower(username), $2), similarity(lower(display_name), $2))
+                + CASE WHEN EXISTS (
+                    SELECT 1 FROM messages m
+                    WHERE (m.from_id = $1 AND m.to_id = users.id)
+                       OR (m.from_id = users.id AND m.to_id = $1)
+                ) THEN 0.5 ELSE 0 END
+            )::float8 AS score
+            FROM users
+            WHERE
+                id != $1 AND
+                -- Neither side of a block (relationship type 2) can find
+                -- the other.
+                NOT EXISTS (
+                    SELECT 1 FROM relationships r
+                    WHERE r.type = 2 AND (
+                        (r.user_id = $1 AND r.peer_id = users.id) OR
+                        (r.user_id = users.id AND r.peer_id = $1)
+                    )
+                ) AND
+                (
+                    lower(username) % $2 OR
+                    lower(display_name) % $2 OR
+                    lower(username) LIKE $3 OR
+                    lower(display_name) LIKE $3 OR
+                    (discoverable_by_email AND lower(email) = $2)
+                )
+        )
+        SELECT ` + profileColumns + `, score
+        FROM ranked
+        WHERE $4::float8 IS NULL OR score < $4 OR (score = $4 AND id > $5::uuid)
+        ORDER BY score DESC, id ASC
+        LIMIT $6`
+
+	var afterScore, afterID interface{}
+	if after != nil {
+		afterScore, afterID = after.score, after.id
+	}
+
+	// Fetch one extra row to learn whether another page follows.
+	rows, err := s.db.QueryContext(ctx, sqlQuery,
+		callerID,
+		q,
+		escapeLike(q)+"%",
+		afterScore,
+		afterID,
+		limit+1,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	defer rows.Close()
+
+	page := &SearchPage{Users: []Profile{}}
+	var last searchCursor
+	for rows.Next() {
+		var p Profile
+		var score float64
+		if err := rows.Scan(
+			&p.ID,
+			&p.Username,
+			&p.DisplayName,
+			&p.Avatar,
+			&p.Bio,
+			&p.Pronouns,
+			&p.BannerColor,
+			&p.CreatedAt,
+			&score,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+
+		if len(page.Users) == limit {
+			page.NextCursor = last.encode()
+			break
+		}
+		page.Users = append(page.Users, p)
+		last = searchCursor{score: score, id: p.ID}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating users: %w", err)
+	}
+
+	return page, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
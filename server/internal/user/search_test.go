@@ -0,0 +1,45 @@
+package user
+
+import (
+	"encoding/base64"
+	"math"
+	"testing"
+)
+
+func TestSearchCursorRoundTrip(t *testing.T) {
+	const id = "6f1c1b52-8a5e-4a4e-9d43-0d8a7b1f2c3e"
+
+	for _, score := range []float64{0, 1, 0.333333333333, 2.5e-8, 1e12, -1, math.MaxFloat64} {
+		c := searchCursor{score: score, id: id}
+		got, err := decodeSearchCursor(c.encode())
+		if err != nil {
+			t.Errorf("decode(encode(%v)): %v", score, err)
+			continue
+		}
+		if *got != c {
+			t.Errorf("decode(encode(%v)) = %+v", score, *got)
+		}
+	}
+}
+
+func TestDecodeSearchCursorInvalid(t *testing.T) {
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name, cursor string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("1:6f1c1b52-8a5e-4a4e-9d43-0d8a7b1f2c3e"))},
+		{"no separator", enc("1")},
+		{"bad score", enc("high:6f1c1b52-8a5e-4a4e-9d43-0d8a7b1f2c3e")},
+		{"bad id", enc("1:alice")},
+		{"no id", enc("1:")},
+	}
+
+	for _, tt := range tests {
+		if _, err := decodeSearchCursor(tt.cursor); err != ErrInvalidCursor {
+			t.Errorf("%s: error = %v, want ErrInvalidCursor", tt.name, err)
+		}
+	}
+}
@@ -3,18 +3,65 @@ package user
 import (
 	"context"
 	"database/sql"
+	"discord/internal/attachment"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/rs/zerolog"
 )
 
+// User is the full account, only ever returned to the user themselves.
 type User struct {
 	ID           string    `json:"id" db:"id"`
 	Email        string    `json:"email" db:"email"`
 	Username     string    `json:"username" db:"username"`
+	DisplayName  string    `json:"displayName" db:"display_name"`
+	Avatar       string    `json:"avatar" db:"avatar"`
+	Bio          string    `json:"bio" db:"bio"`
+	Pronouns     string    `json:"pronouns" db:"pronouns"`
+	BannerColor  string    `json:"bannerColor" db:"banner_color"`
 	PasswordHash string    `json:"-" db:"password_hash"`
 	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
 	UpdatedAt    time.Time `json:"updatedAt" db:"updated_at"`
+
+	UsernameChangedAt   *time.Time `json:"usernameChangedAt,omitempty" db:"username_changed_at"`
+	DiscoverableByEmail bool       `json:"discoverableByEmail" db:"discoverable_by_email"`
+}
+
+// Me is the signed-in user's account as GET /users/@me returns it, with
+// how much of their attachment storage they use.
+type Me struct {
+	*User
+	Storage *attachment.Usage `json:"storage"`
+}
+
+// Profile is the public view of a user. It is what every other user sees,
+// and must never carry the email address or other private fields.
+type Profile struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"displayName"`
+	Avatar      string    `json:"avatar"`
+	Bio         string    `json:"bio"`
+	Pronouns    string    `json:"pronouns"`
+	BannerColor string    `json:"bannerColor"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// UpdateUserRequest changes only the fields that are present; an empty
+// string clears a field. BannerColor is #RRGGBB, without alpha.
+type UpdateUserRequest struct {
+	DisplayName *string `json:"displayName" validate:"omitempty,max=32"`
+	Avatar      *string `json:"avatar" validate:"omitempty,max=255"`
+	Bio         *string `json:"bio" validate:"omitempty,max=190"`
+	Pronouns    *string `json:"pronouns" validate:"omitempty,max=40"`
+	BannerColor *string `json:"bannerColor" validate:"omitempty,len=7,hexcolor"`
+
+	// DiscoverableByEmail controls whether others can find the user by
+	// searching for their exact email address.
+	DiscoverableByEmail *bool `json:"discoverableByEmail"`
 }
 
 type Service struct {
@@ -22,6 +69,18 @@ type Service struct {
 	log *zerolog.Logger
 }
 
+var (
+	ErrEmailTaken    = errors.New("user with this email already exists")
+	ErrUsernameTaken = errors.New("user with this username already exists")
+)
+
+const userColumns = `id, email, username, display_name, avatar, bio, pronouns,
+        banner_color, password_hash, created_at, updated_at, username_changed_at,
+        discoverable_by_email`
+
+const profileColumns = `id, username, display_name, avatar, bio, pronouns,
+        banner_color, created_at`
+
 func NewService(db *sql.DB, log *zerolog.Logger) *Service {
 	return &Service{
 		db:  db,
@@ -31,24 +90,53 @@ func NewService(db *sql.DB, log *zerolog.Logger) *Service {
 
 // GetByEmail used by auth service
 func (s *Service) GetByEmail(ctx context.Context, email string) (*User, error) {
-	var user User
-	const q = `
-        SELECT id, email, username, password_hash, created_at, updated_at
-        FROM users
-        WHERE email = $1`
+	q := `SELECT ` + userColumns + ` FROM users WHERE email = $1`
+	return scanUser(s.db.QueryRowContext(ctx, q, email))
+}
 
-	err := s.db.QueryRowContext(ctx, q, email).Scan(
-		&user.ID,
-		&user.Email,
-		&user.Username,
-		&user.PasswordHash,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+func (s *Service) GetByID(ctx context.Context, id string) (*User, error) {
+	q := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(s.db.QueryRowContext(ctx, q, id))
+}
+
+// GetProfile returns the public profile of the given user.
+func (s *Service) GetProfile(ctx context.Context, id string) (*Profile, error) {
+	q := `SELECT ` + profileColumns + ` FROM users WHERE id = $1`
+	return scanProfile(s.db.QueryRowContext(ctx, q, id))
+}
+
+// GetProfileByUsername returns the public profile of the user with
+// username, ignoring case.
+func (s *Service) GetProfileByUsername(ctx context.Context, username string) (*Profile, error) {
+	q := `SELECT ` + profileColumns + ` FROM users WHERE lower(username) = lower($1)`
+	return scanProfile(s.db.QueryRowContext(ctx, q, username))
+}
+
+// GetProfiles returns the public profiles of the given users, in no
+// particular order. Unknown IDs are skipped.
+func (s *Service) GetProfiles(ctx context.Context, ids []string) ([]Profile, error) {
+	q := `SELECT ` + profileColumns + ` FROM users WHERE id = ANY($1::uuid[])`
+
+	rows, err := s.db.QueryContext(ctx, q, pq.Array(ids))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to query profiles: %w", err)
 	}
-	return &user, nil
+	defer rows.Close()
+
+	profiles := []Profile{}
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan profile: %w", err)
+		}
+		profiles = append(profiles, *p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating profiles: %w", err)
+	}
+
+	return profiles, nil
 }
 
 // Create used by auth service during registration
@@ -58,7 +146,7 @@ func (s *Service) Create(ctx context.Context, user *User) error {
         VALUES ($1, $2, $3, $4, $5, $6)
         RETURNING id, email, username, created_at, updated_at`
 
-	return s.db.QueryRowContext(ctx, q,
+	err := s.db.QueryRowContext(ctx, q,
 		user.ID,
 		user.Email,
 		user.Username,
@@ -72,41 +160,127 @@ func (s *Service) Create(ctx context.Context, user *User) error {
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
+	return mapUniqueViolation(err)
 }
 
-// SearchUsers for the chat feature
-func (s *Service) SearchUsers(ctx context.Context, query string, excludeUserID string) ([]User, error) {
-	const q = `
-        SELECT id, email, username, created_at, updated_at
-        FROM users 
-        WHERE 
-            id != $1 AND
-            (
-                username ILIKE $2 OR 
-                email ILIKE $2
-            )
-        LIMIT 10`
-
-	rows, err := s.db.QueryContext(ctx, q, excludeUserID, "%"+query+"%")
+func (s *Service) UpdatePasswordHash(ctx context.Context, id, hash string) error {
+	const q = `UPDATE users SET password_hash = $2, updated_at = $3 WHERE id = $1`
+
+	_, err := s.db.ExecContext(ctx, q, id, hash, time.Now())
+	return err
+}
+
+func (s *Service) UpdateEmail(ctx context.Context, id, email string) (*User, error) {
+	q := `
+        UPDATE users SET email = $2, updated_at = $3
+        WHERE id = $1
+        RETURNING ` + userColumns
+
+	user, err := scanUser(s.db.QueryRowContext(ctx, q, id, email, time.Now()))
+	return user, mapUniqueViolation(err)
+}
+
+// UpdateUsername renames the user and records when, for the rename cooldown.
+// Setting the username it already has records nothing. The rename only
+// happens if the previous one was no later than changedBefore; otherwise it
+// returns sql.ErrNoRows.
+func (s *Service) UpdateUsername(ctx context.Context, id, username string, changedBefore time.Time) (*User, error) {
+	q := `
+        UPDATE users SET
+            username = $2,
+            username_changed_at = CASE WHEN username = $2 THEN username_changed_at ELSE $3 END,
+            updated_at = CASE WHEN username = $2 THEN updated_at ELSE $3 END
+        WHERE id = $1 AND (username_changed_at IS NULL OR username_changed_at <= $4)
+        RETURNING ` + userColumns
+
+	user, err := scanUser(s.db.QueryRowContext(ctx, q, id, username, time.Now(), changedBefore))
+	return user, mapUniqueViolation(err)
+}
+
+// UpdateUser applies the present fields of req to the user.
+func (s *Service) UpdateUser(ctx context.Context, id string, req UpdateUserRequest) (*User, error) {
+	q := `
+        UPDATE users SET
+            display_name = COALESCE($2, display_name),
+            avatar = COALESCE($3, avatar),
+            bio = COALESCE($4, bio),
+            pronouns = COALESCE($5, pronouns),
+            banner_color = COALESCE($6, banner_color),
+            discoverable_by_email = COALESCE($7, discoverable_by_email),
+            updated_at = $8
+        WHERE id = $1
+        RETURNING ` + userColumns
+
+	return scanUser(s.db.QueryRowContext(ctx, q,
+		id,
+		req.DisplayName,
+		req.Avatar,
+		req.Bio,
+		req.Pronouns,
+		req.BannerColor,
+		req.DiscoverableByEmail,
+		time.Now(),
+	))
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row scanner) (*User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.Username,
+		&user.DisplayName,
+		&user.Avatar,
+		&user.Bio,
+		&user.Pronouns,
+		&user.BannerColor,
+		&user.PasswordHash,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.UsernameChangedAt,
+		&user.DiscoverableByEmail,
+	)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return &user, nil
+}
 
-	var users []User
-	for rows.Next() {
-		var user User
-		if err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.Username,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-		); err != nil {
-			return nil, err
-		}
-		users = append(users, user)
+func scanProfile(row scanner) (*Profile, error) {
+	var p Profile
+	err := row.Scan(
+		&p.ID,
+		&p.Username,
+		&p.DisplayName,
+		&p.Avatar,
+		&p.Bio,
+		&p.Pronouns,
+		&p.BannerColor,
+		&p.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// mapUniqueViolation turns unique violations on email or username into
+// ErrEmailTaken or ErrUsernameTaken.
+func mapUniqueViolation(err error) error {
+	pgErr, ok := err.(*pq.Error)
+	if !ok || pgErr.Code != "23505" { // unique_violation
+		return err
 	}
 
-	return users, nil
+	switch pgErr.Constraint {
+	case "users_email_key":
+		return ErrEmailTaken
+	case "users_username_key":
+		return ErrUsernameTaken
+	}
+	return err
 }
@@ -0,0 +1,47 @@
+package validation
+
+import (
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+)
+
+// Messages for the custom rules; {0} is the field name. Built-in rules use
+// the validator's own translations.
+var enMessages = map[string]string{
+	tagUsernameChars:      "{0} may only contain letters, digits, underscores and single dots",
+	tagUsernameConfusable: "{0} must not mix alphabets or use look-alike characters",
+	tagUsernameReserved:   "{0} is reserved",
+	tagPasswordBytes:      "{0} must be at most 72 bytes long",
+	tagPasswordMix:        "{0} must mix letters with digits or symbols and not repeat the same few characters",
+	tagPasswordCommon:     "{0} is too common",
+}
+
+var esMessages = map[string]string{
+	tagUsernameChars:      "{0} solo puede contener letras, dígitos, guiones bajos y puntos sueltos",
+	tagUsernameConfusable: "{0} no debe mezclar alfabetos ni usar caracteres parecidos",
+	tagUsernameReserved:   "{0} está reservado",
+	tagPasswordBytes:      "{0} debe tener como máximo 72 bytes",
+	tagPasswordMix:        "{0} debe combinar letras con dígitos o símbolos y no repetir los mismos caracteres",
+	tagPasswordCommon:     "{0} es demasiado común",
+}
+
+func registerMessages(v *validator.Validate, trans ut.Translator, messages map[string]string) error {
+	for tag, text := range messages {
+		err := v.RegisterTranslation(tag, trans,
+			func(ut ut.Translator) error {
+				return ut.Add(tag, text, true)
+			},
+			func(ut ut.Translator, fe validator.FieldError) string {
+				msg, err := ut.T(fe.ActualTag(), fe.Field())
+				if err != nil {
+					return fe.Error()
+				}
+				return msg
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The "username" and "password" tags are aliases for the rules below. Each
+// rule reports under its own tag so clients can tell the failures apart.
+const (
+	tagUsernameChars      = "username_chars"
+	tagUsernameConfusable = "username_confusable"
+	tagUsernameReserved   = "username_reserved"
+
+	tagPasswordBytes  = "password_bytes"
+	tagPasswordMix    = "password_mix"
+	tagPasswordCommon = "password_common"
+)
+
+// bcrypt ignores everything past the first 72 bytes of a password.
+const maxPasswordBytes = 72
+
+var reservedUsernames = []string{
+	"admin", "administrator", "api", "discord", "everyone", "help", "here",
+	"mod", "moderator", "null", "official", "root", "security", "staff",
+	"support", "system", "undefined",
+}
+
+var commonPasswords = map[string]bool{
+	"00000000": true, "11111111": true, "12345678": true, "123456789": true,
+	"1234567890": true, "1q2w3e4r": true, "1qaz2wsx": true, "abc12345": true,
+	"asdfghjk": true, "baseball": true, "discord1": true, "dragon12": true,
+	"football": true, "iloveyou": true, "letmein1": true, "monkey12": true,
+	"passw0rd": true, "password": true, "password1": true, "password123": true,
+	"princess": true, "qwerty12": true, "qwerty123": true, "qwertyuiop": true,
+	"starwars": true, "sunshine": true, "superman": true, "trustno1": true,
+	"welcome1": true, "zaq12wsx": true,
+}
+
+// homoglyphs folds characters that render like a Latin letter onto it, so
+// reserved names cannot be dodged with look-alikes such as "аdmin" (Cyrillic
+// а) or "adm1n".
+var homoglyphs = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'һ': 'h', 'і': 'l', 'ј': 'j', 'к': 'k',
+	'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'ѕ': 's', 'т': 't',
+	'у': 'y', 'х': 'x', 'ԁ': 'd',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	// Latin and digits
+	'i': 'l', '1': 'l', '0': 'o', '3': 'e', '5': 's', '8': 'b',
+}
+
+var reservedSkeletons = func() map[string]bool {
+	m := make(map[string]bool, len(reservedUsernames))
+	for _, name := range reservedUsernames {
+		m[skeleton(name)] = true
+	}
+	return m
+}()
+
+func registerRules(v *validator.Validate) error {
+	rules := map[string]validator.Func{
+		tagUsernameChars:      usernameChars,
+		tagUsernameConfusable: usernameConfusable,
+		tagUsernameReserved:   usernameReserved,
+		tagPasswordBytes:      passwordBytes,
+		tagPasswordMix:        passwordMix,
+		tagPasswordCommon:     passwordCommon,
+	}
+	for tag, fn := range rules {
+		if err := v.RegisterValidation(tag, fn); err != nil {
+			return fmt.Errorf("register %s: %w", tag, err)
+		}
+	}
+
+	v.RegisterAlias("username", strings.Join([]string{
+		tagUsernameChars, tagUsernameConfusable, tagUsernameReserved,
+	}, ","))
+	v.RegisterAlias("password", strings.Join([]string{
+		tagPasswordBytes, tagPasswordMix, tagPasswordCommon,
+	}, ","))
+
+	return nil
+}
+
+// usernameChars allows letters from any script, ASCII digits, underscores
+// and single dots that neither start nor end the name.
+func usernameChars(fl validator.FieldLevel) bool {
+	s := fl.Field().String()
+	if strings.HasPrefix(s, ".") || strings.HasSuffix(s, ".") || strings.Contains(s, "..") {
+		return false
+	}
+
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r):
+		case r >= '0' && r <= '9':
+		case r == '_' || r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// usernameConfusable rejects names that are not in NFKC form (fullwidth
+// letters, ligatures and the like) or that mix scripts, e.g. Latin with
+// Cyrillic.
+func usernameConfusable(fl validator.FieldLevel) bool {
+	s := fl.Field().String()
+	if !norm.NFKC.IsNormalString(s) {
+		return false
+	}
+
+	var script *unicode.RangeTable
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		rs := scriptOf(r)
+		if script == nil {
+			script = rs
+		} else if rs != script {
+			return false
+		}
+	}
+	return true
+}
+
+func usernameReserved(fl validator.FieldLevel) bool {
+	return !reservedSkeletons[skeleton(fl.Field().String())]
+}
+
+func passwordBytes(fl validator.FieldLevel) bool {
+	return len(fl.Field().String()) <= maxPasswordBytes
+}
+
+// passwordMix requires at least two of letters, digits and symbols, and at
+// least five distinct characters.
+func passwordMix(fl validator.FieldLevel) bool {
+	s := fl.Field().String()
+
+	var letters, digits, symbols bool
+	distinct := make(map[rune]bool)
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r):
+			letters = true
+		case unicode.IsDigit(r):
+			digits = true
+		default:
+			symbols = true
+		}
+		distinct[r] = true
+	}
+
+	classes := 0
+	for _, ok := range []bool{letters, digits, symbols} {
+		if ok {
+			classes++
+		}
+	}
+	return classes >= 2 && len(distinct) >= 5
+}
+
+func passwordCommon(fl validator.FieldLevel) bool {
+	return !commonPasswords[strings.ToLower(fl.Field().String())]
+}
+
+// skeleton reduces a name to a canonical form for look-alike comparison:
+// case-folded, homoglyphs mapped to Latin, separators dropped.
+func skeleton(s string) string {
+	var b strings.Builder
+	b.Grow(utf8.RuneCountInString(s))
+
+	for _, r := range norm.NFKC.String(s) {
+		r = unicode.ToLower(r)
+		if r == '_' || r == '.' {
+			continue
+		}
+		if m, ok := homoglyphs[r]; ok {
+			r = m
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// scriptOf returns the script table r belongs to. Han, Hiragana and Katakana
+// count as one script since Japanese mixes all three.
+func scriptOf(r rune) *unicode.RangeTable {
+	for _, t := range []*unicode.RangeTable{
+		unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Armenian,
+		unicode.Arabic, unicode.Hebrew, unicode.Thai, unicode.Devanagari,
+		unicode.Hangul, unicode.Han, unicode.Hiragana, unicode.Katakana,
+	} {
+		if unicode.Is(t, r) {
+			if t == unicode.Hiragana || t == unicode.Katakana {
+				return unicode.Han
+			}
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package validation
+
+import (
+	"discord/internal/http/response"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/es"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	es_translations "github.com/go-playground/validator/v10/translations/es"
+	"golang.org/x/text/language"
+)
+
+// Validator validates request DTOs and reports failures per field in the
+// caller's preferred language. One instance is shared by every handler so
+// the custom rules apply consistently.
+type Validator struct {
+	validate *validator.Validate
+	uni      *ut.UniversalTranslator
+}
+
+func New() (*Validator, error) {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+
+	// Report field errors under their JSON names.
+	validate.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	if err := registerRules(validate); err != nil {
+		return nil, err
+	}
+
+	english := en.New()
+	uni := ut.New(english, english, es.New())
+
+	enTrans, _ := uni.GetTranslator("en")
+	if err := en_translations.RegisterDefaultTranslations(validate, enTrans); err != nil {
+		return nil, fmt.Errorf("register en translations: %w", err)
+	}
+	esTrans, _ := uni.GetTranslator("es")
+	if err := es_translations.RegisterDefaultTranslations(validate, esTrans); err != nil {
+		return nil, fmt.Errorf("register es translations: %w", err)
+	}
+
+	if err := registerMessages(validate, enTrans, enMessages); err != nil {
+		return nil, fmt.Errorf("register en messages: %w", err)
+	}
+	if err := registerMessages(validate, esTrans, esMessages); err != nil {
+		return nil, fmt.Errorf("register es messages: %w", err)
+	}
+
+	return &Validator{
+		validate: validate,
+		uni:      uni,
+	}, nil
+}
+
+// Check validates s and, when it is invalid, returns a validation problem
+// with one field/rule/message entry per invalid field, translated for the
+// request's Accept-Language.
+func (v *Validator) Check(r *http.Request, s interface{}) *response.Problem {
+	err := v.validate.Struct(s)
+	if err == nil {
+		return nil
+	}
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return response.ErrInvalidRequest(err.Error())
+	}
+
+	trans := v.translator(r)
+	fields := make(map[string]response.FieldError, len(verrs))
+	for _, fe := range verrs {
+		fields[fe.Field()] = response.FieldError{
+			Rule:    fe.ActualTag(),
+			Message: fe.Translate(trans),
+		}
+	}
+
+	return response.ErrValidation(fields)
+}
+
+// Err validates s outside of an HTTP request, such as a websocket command,
+// and returns the first failure as an English message, or nil.
+func (v *Validator) Err(s interface{}) error {
+	err := v.validate.Struct(s)
+	if err == nil {
+		return nil
+	}
+
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return err
+	}
+
+	trans, _ := v.uni.GetTranslator("en")
+	return errors.New(verrs[0].Translate(trans))
+}
+
+func (v *Validator) translator(r *http.Request) ut.Translator {
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+
+	locales := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		base, _ := tag.Base()
+		locales = append(locales, base.String())
+	}
+
+	trans, _ := v.uni.FindTranslator(locales...)
+	return trans
+}
@@ -0,0 +1,165 @@
+package validation
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSkeleton(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"admin", "admln"},
+		{"Admin", "admln"},
+		{"ADM1N", "admln"},
+		{"аdmin", "admln"}, // Cyrillic а
+		{"a.d_m.i_n", "admln"},
+		{"ａｄｍｉｎ", "admln"}, // fullwidth
+		{"r00t", "root"},
+		{"ѕуѕtеm", "system"}, // Cyrillic ѕ у ѕ е
+		{"héllo", "héllo"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := skeleton(tt.in); got != tt.want {
+			t.Errorf("skeleton(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+type usernameForm struct {
+	Username string `json:"username" validate:"username"`
+}
+
+type passwordForm struct {
+	Password string `json:"password" validate:"password"`
+}
+
+func TestUsername(t *testing.T) {
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		rule string // empty when valid
+	}{
+		{"alice", ""},
+		{"alice.smith", ""},
+		{"alice_99", ""},
+		{"Ålesund", ""},
+		{"用户名", ""},
+		{"ひらがなカタカナ漢字", ""},
+		{".alice", tagUsernameChars},
+		{"alice.", tagUsernameChars},
+		{"al..ice", tagUsernameChars},
+		{"alice smith", tagUsernameChars},
+		{"alice-smith", tagUsernameChars},
+		{"alice١", tagUsernameChars}, // Arabic-Indic digit
+		{"ａlice", tagUsernameConfusable},
+		{"pаypal", tagUsernameConfusable}, // Cyrillic а among Latin
+		{"admin", tagUsernameReserved},
+		{"Adm1n", tagUsernameReserved},
+		{"s.u.p.p.o.r.t", tagUsernameReserved},
+		{"еveryone", tagUsernameConfusable}, // Cyrillic е
+		{"аdmin", tagUsernameConfusable},
+		{"администратор", ""},
+	}
+
+	for _, tt := range tests {
+		p := v.Check(httptest.NewRequest("POST", "/", nil), usernameForm{Username: tt.name})
+		switch {
+		case tt.rule == "" && p != nil:
+			t.Errorf("%q refused: %+v", tt.name, p.Errors)
+		case tt.rule != "" && p == nil:
+			t.Errorf("%q accepted, want %s", tt.name, tt.rule)
+		case tt.rule != "" && p.Errors["username"].Rule != tt.rule:
+			t.Errorf("%q refused by %s, want %s", tt.name, p.Errors["username"].Rule, tt.rule)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		rule     string // empty when valid
+	}{
+		{"correct horse", ""},
+		{"tr0ub4dor", ""},
+		{"12345!", ""},
+		{strings.Repeat("abcd1234", 9), ""},
+		{strings.Repeat("abcd1234", 9) + "x", tagPasswordBytes},
+		{strings.Repeat("é1", 25), tagPasswordBytes},
+		{"onlyletters", tagPasswordMix},
+		{"1234567890", tagPasswordMix},
+		{"ab12ab12ab12", tagPasswordMix},
+		{"Password1", tagPasswordCommon},
+		{"QWERTY123", tagPasswordCommon},
+	}
+
+	for _, tt := range tests {
+		p := v.Check(httptest.NewRequest("POST", "/", nil), passwordForm{Password: tt.password})
+		switch {
+		case tt.rule == "" && p != nil:
+			t.Errorf("%q refused: %+v", tt.password, p.Errors)
+		case tt.rule != "" && p == nil:
+			t.Errorf("%q accepted, want %s", tt.password, tt.rule)
+		case tt.rule != "" && p.Errors["password"].Rule != tt.rule:
+			t.Errorf("%q refused by %s, want %s", tt.password, p.Errors["password"].Rule, tt.rule)
+		}
+	}
+}
+
+func TestCheckLanguage(t *testing.T) {
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "username is reserved"},
+		{"en-GB", "username is reserved"},
+		{"es-ES,es;q=0.9", "username está reservado"},
+		{"fr-FR, es;q=0.5", "username está reservado"},
+		{"fr-FR", "username is reserved"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		if tt.acceptLanguage != "" {
+			r.Header.Set("Accept-Language", tt.acceptLanguage)
+		}
+		p := v.Check(r, usernameForm{Username: "admin"})
+		if p == nil {
+			t.Fatal("admin accepted")
+		}
+		if got := p.Errors["username"].Message; got != tt.want {
+			t.Errorf("Accept-Language %q: %q, want %q", tt.acceptLanguage, got, tt.want)
+		}
+	}
+}
+
+func TestErr(t *testing.T) {
+	v, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.Err(usernameForm{Username: "alice"}); err != nil {
+		t.Errorf("valid form: %v", err)
+	}
+	if err := v.Err(usernameForm{Username: "admin"}); err == nil || err.Error() != "username is reserved" {
+		t.Errorf("reserved name: %v", err)
+	}
+}
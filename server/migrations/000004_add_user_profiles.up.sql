@@ -0,0 +1,6 @@
+ALTER TABLE users
+    ADD COLUMN display_name VARCHAR(32) NOT NULL DEFAULT '',
+    ADD COLUMN avatar TEXT NOT NULL DEFAULT '',
+    ADD COLUMN bio VARCHAR(190) NOT NULL DEFAULT '',
+    ADD COLUMN pronouns VARCHAR(40) NOT NULL DEFAULT '',
+    ADD COLUMN banner_color VARCHAR(7) NOT NULL DEFAULT '';
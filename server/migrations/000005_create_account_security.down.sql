@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS account_security_events;
+ALTER TABLE users DROP COLUMN IF EXISTS username_changed_at;
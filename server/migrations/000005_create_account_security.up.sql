@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN username_changed_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS account_security_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_account_security_events_user ON account_security_events(user_id, created_at DESC);
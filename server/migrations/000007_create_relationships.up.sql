@@ -0,0 +1,15 @@
+-- Every relationship is stored as a pair of rows, one from each side, so a
+-- user's friends and pending requests are a single indexed lookup.
+-- Types follow Discord's numbering: 1 friend, 3 incoming request, 4 outgoing
+-- request.
+CREATE TABLE IF NOT EXISTS relationships (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    peer_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type SMALLINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, peer_id),
+    CONSTRAINT relationships_not_self CHECK (user_id <> peer_id),
+    CONSTRAINT relationships_type_check CHECK (type IN (1, 3, 4))
+);
+
+CREATE INDEX IF NOT EXISTS idx_relationships_user_type ON relationships(user_id, type);
@@ -0,0 +1,5 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS suppressed;
+
+DELETE FROM relationships WHERE type = 2;
+ALTER TABLE relationships DROP CONSTRAINT IF EXISTS relationships_type_check;
+ALTER TABLE relationships ADD CONSTRAINT relationships_type_check CHECK (type IN (1, 3, 4));
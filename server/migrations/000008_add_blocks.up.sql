@@ -0,0 +1,7 @@
+-- A block (type 2) is recorded only on the blocker's side.
+ALTER TABLE relationships DROP CONSTRAINT IF EXISTS relationships_type_check;
+ALTER TABLE relationships ADD CONSTRAINT relationships_type_check CHECK (type IN (1, 2, 3, 4));
+
+-- Messages sent to someone who has blocked the sender are kept for the
+-- sender's history but never shown to the recipient.
+ALTER TABLE messages ADD COLUMN suppressed BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS user_settings (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    dm_policy VARCHAR(16) NOT NULL DEFAULT 'everyone'
+        CHECK (dm_policy IN ('everyone', 'friends', 'guilds')),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- One row per side of a DM. The state decides where the conversation is
+-- listed for user_id: in the main list (active), among message requests
+-- (request), or nowhere (ignored).
+CREATE TABLE IF NOT EXISTS conversations (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    peer_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    state VARCHAR(16) NOT NULL CHECK (state IN ('active', 'request', 'ignored')),
+    last_message_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, peer_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversations_user_state ON conversations(user_id, state, last_message_at DESC);
+
+-- Conversations that already have messages stay in everyone's main list.
+INSERT INTO conversations (user_id, peer_id, state, last_message_at)
+SELECT user_id, peer_id, 'active', MAX(created_at)
+FROM (
+    SELECT from_id AS user_id, to_id AS peer_id, created_at FROM messages
+    UNION ALL
+    SELECT to_id, from_id, created_at FROM messages WHERE NOT suppressed
+) m
+GROUP BY user_id, peer_id
+ON CONFLICT DO NOTHING;
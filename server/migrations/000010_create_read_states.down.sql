@@ -0,0 +1,2 @@
+ALTER TABLE user_settings DROP COLUMN IF EXISTS read_receipts;
+DROP TABLE IF EXISTS read_states;
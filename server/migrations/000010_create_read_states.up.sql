@@ -0,0 +1,27 @@
+-- How far user_id has read their conversation with peer_id. Messages from
+-- peer_id created after last_read_at are unread.
+CREATE TABLE IF NOT EXISTS read_states (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    peer_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    last_read_message_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+    last_read_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    mention_count INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, peer_id)
+);
+
+ALTER TABLE user_settings ADD COLUMN read_receipts BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Start everyone off with their existing conversations read.
+INSERT INTO read_states (user_id, peer_id, last_read_message_id, last_read_at)
+SELECT c.user_id, c.peer_id, m.id, m.created_at
+FROM conversations c
+JOIN LATERAL (
+    SELECT id, created_at
+    FROM messages
+    WHERE ((from_id = c.user_id AND to_id = c.peer_id) OR (from_id = c.peer_id AND to_id = c.user_id))
+      AND NOT (suppressed AND to_id = c.user_id)
+    ORDER BY created_at DESC
+    LIMIT 1
+) m ON TRUE
+ON CONFLICT DO NOTHING;
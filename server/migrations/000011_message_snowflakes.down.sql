@@ -0,0 +1,21 @@
+DROP INDEX IF EXISTS idx_messages_from_to_id;
+CREATE INDEX IF NOT EXISTS idx_messages_from_to ON messages(from_id, to_id);
+CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at DESC);
+
+ALTER TABLE messages ADD COLUMN uuid UUID NOT NULL DEFAULT gen_random_uuid();
+
+ALTER TABLE read_states ADD COLUMN last_read_uuid UUID;
+
+UPDATE read_states rs SET last_read_uuid = m.uuid
+FROM messages m
+WHERE m.id = rs.last_read_message_id;
+
+ALTER TABLE read_states DROP COLUMN last_read_message_id;
+ALTER TABLE read_states RENAME COLUMN last_read_uuid TO last_read_message_id;
+
+ALTER TABLE messages DROP COLUMN id;
+ALTER TABLE messages RENAME COLUMN uuid TO id;
+ALTER TABLE messages ADD PRIMARY KEY (id);
+
+ALTER TABLE read_states ADD CONSTRAINT read_states_last_read_message_id_fkey
+    FOREIGN KEY (last_read_message_id) REFERENCES messages(id) ON DELETE SET NULL;
@@ -0,0 +1,38 @@
+-- Message IDs become snowflakes: milliseconds since 2020-01-01 UTC in the
+-- top 41 bits, the worker ID in the next 10 and a sequence in the low 12.
+-- Existing messages get worker 0 and a sequence within their millisecond,
+-- so they keep their order.
+ALTER TABLE messages ADD COLUMN snowflake BIGINT;
+
+UPDATE messages m SET snowflake = s.snowflake
+FROM (
+    SELECT id,
+        ((floor(extract(epoch FROM created_at) * 1000)::bigint - 1577836800000) << 22)
+        | (row_number() OVER (
+            PARTITION BY floor(extract(epoch FROM created_at) * 1000)
+            ORDER BY id
+        ) - 1)
+        AS snowflake
+    FROM messages
+) s
+WHERE m.id = s.id;
+
+-- Read states point at message IDs without a foreign key, since an ID
+-- still marks a position in the conversation once its message is gone.
+ALTER TABLE read_states ADD COLUMN last_read_snowflake BIGINT;
+
+UPDATE read_states rs SET last_read_snowflake = m.snowflake
+FROM messages m
+WHERE m.id = rs.last_read_message_id;
+
+ALTER TABLE read_states DROP COLUMN last_read_message_id;
+ALTER TABLE read_states RENAME COLUMN last_read_snowflake TO last_read_message_id;
+
+ALTER TABLE messages DROP COLUMN id;
+ALTER TABLE messages RENAME COLUMN snowflake TO id;
+ALTER TABLE messages ALTER COLUMN id SET NOT NULL;
+ALTER TABLE messages ADD PRIMARY KEY (id);
+
+DROP INDEX IF EXISTS idx_messages_from_to;
+DROP INDEX IF EXISTS idx_messages_created_at;
+CREATE INDEX IF NOT EXISTS idx_messages_from_to_id ON messages(from_id, to_id, id DESC);
@@ -0,0 +1 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS referenced_message_id;
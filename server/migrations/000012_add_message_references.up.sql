@@ -0,0 +1,3 @@
+-- A reply keeps the ID of the message it answers even after that message
+-- is gone, so there is no foreign key.
+ALTER TABLE messages ADD COLUMN referenced_message_id BIGINT;
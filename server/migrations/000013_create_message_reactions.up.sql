@@ -0,0 +1,9 @@
+-- One row per user, emoji and message. Counts are aggregated from these
+-- rows when read, so concurrent reactions cannot leave them out of step.
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    emoji VARCHAR(64) NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, emoji, user_id)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS message_pins;
+ALTER TABLE messages DROP COLUMN IF EXISTS type;
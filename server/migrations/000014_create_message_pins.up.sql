@@ -0,0 +1,9 @@
+-- Messages are user content (0) or system messages such as pin notices (6).
+ALTER TABLE messages ADD COLUMN type SMALLINT NOT NULL DEFAULT 0;
+
+-- Pins belong to the conversation of their message, shared by both users.
+CREATE TABLE IF NOT EXISTS message_pins (
+    message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    pinned_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    pinned_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_type_check;
+UPDATE messages SET type = 0 WHERE type = 19;
+ALTER TABLE messages DROP COLUMN IF EXISTS payload;
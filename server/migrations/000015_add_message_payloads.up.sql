@@ -0,0 +1,10 @@
+-- System messages carry a payload whose shape depends on their type.
+ALTER TABLE messages ADD COLUMN payload JSONB;
+
+-- Replies get their own type, as they do when sent from now on.
+UPDATE messages SET type = 19 WHERE type = 0 AND referenced_message_id IS NOT NULL;
+
+UPDATE messages m SET payload = jsonb_build_object('messageId', m.referenced_message_id::text)
+WHERE m.type = 6 AND m.payload IS NULL AND m.referenced_message_id IS NOT NULL;
+
+ALTER TABLE messages ADD CONSTRAINT messages_type_check CHECK (type IN (0, 1, 2, 3, 6, 7, 18, 19));
@@ -0,0 +1,15 @@
+-- Uploaded files. An attachment without a message is an upload its
+-- uploader has not sent yet.
+CREATE TABLE IF NOT EXISTS attachments (
+    id BIGINT PRIMARY KEY,
+    uploader_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message_id BIGINT REFERENCES messages(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL CHECK (size >= 0),
+    content_type VARCHAR(255) NOT NULL,
+    checksum CHAR(64) NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id) WHERE message_id IS NOT NULL;
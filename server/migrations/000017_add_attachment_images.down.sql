@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_attachments_unprocessed;
+
+ALTER TABLE attachments
+    DROP COLUMN IF EXISTS thumbnail_sizes,
+    DROP COLUMN IF EXISTS height,
+    DROP COLUMN IF EXISTS width;
@@ -0,0 +1,9 @@
+-- Width and height are set for images at upload, and thumbnail_sizes once
+-- their thumbnails are made. An empty array means none were needed.
+ALTER TABLE attachments
+    ADD COLUMN IF NOT EXISTS width INT,
+    ADD COLUMN IF NOT EXISTS height INT,
+    ADD COLUMN IF NOT EXISTS thumbnail_sizes INT[];
+
+CREATE INDEX IF NOT EXISTS idx_attachments_unprocessed ON attachments(id)
+    WHERE width IS NOT NULL AND thumbnail_sizes IS NULL;
@@ -0,0 +1,34 @@
+DROP TRIGGER IF EXISTS attachments_blob_refs ON attachments;
+DROP FUNCTION IF EXISTS count_blob_refs();
+
+DROP INDEX IF EXISTS idx_attachments_uploader;
+DROP INDEX IF EXISTS idx_attachments_unsent;
+
+ALTER TABLE attachments
+    DROP CONSTRAINT IF EXISTS attachments_checksum_fkey,
+    ADD COLUMN IF NOT EXISTS size BIGINT,
+    ADD COLUMN IF NOT EXISTS content_type VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS storage_key VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS width INT,
+    ADD COLUMN IF NOT EXISTS height INT,
+    ADD COLUMN IF NOT EXISTS thumbnail_sizes INT[];
+
+UPDATE attachments a
+SET size = b.size,
+    content_type = b.content_type,
+    storage_key = b.storage_key,
+    width = b.width,
+    height = b.height
+FROM blobs b
+WHERE b.checksum = a.checksum;
+
+ALTER TABLE attachments
+    ALTER COLUMN size SET NOT NULL,
+    ALTER COLUMN content_type SET NOT NULL,
+    ALTER COLUMN storage_key SET NOT NULL,
+    ADD CONSTRAINT attachments_size_check CHECK (size >= 0);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_unprocessed ON attachments(id)
+    WHERE width IS NOT NULL AND thumbnail_sizes IS NULL;
+
+DROP TABLE IF EXISTS blobs;
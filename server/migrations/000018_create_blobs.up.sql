@@ -0,0 +1,57 @@
+-- Files are stored once per distinct content, keyed by SHA-256. ref_count
+-- is how many attachments use a blob; the trigger below keeps it, and the
+-- server deletes blobs it drops to zero for.
+CREATE TABLE IF NOT EXISTS blobs (
+    checksum CHAR(64) PRIMARY KEY,
+    size BIGINT NOT NULL CHECK (size >= 0),
+    content_type VARCHAR(255) NOT NULL,
+    storage_key VARCHAR(255) NOT NULL,
+    width INT,
+    height INT,
+    thumbnail_sizes INT[],
+    ref_count INT NOT NULL DEFAULT 0 CHECK (ref_count >= 0),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- Existing files keep the key of their first upload; copies stored for
+-- later duplicates are left behind. Thumbnails are made again under the
+-- new keys.
+INSERT INTO blobs (checksum, size, content_type, storage_key, width, height, ref_count, created_at)
+SELECT DISTINCT ON (checksum)
+       checksum, size, content_type, storage_key, width, height,
+       COUNT(*) OVER (PARTITION BY checksum), created_at
+FROM attachments
+ORDER BY checksum, id
+ON CONFLICT DO NOTHING;
+
+DROP INDEX IF EXISTS idx_attachments_unprocessed;
+
+ALTER TABLE attachments
+    DROP COLUMN IF EXISTS size,
+    DROP COLUMN IF EXISTS content_type,
+    DROP COLUMN IF EXISTS storage_key,
+    DROP COLUMN IF EXISTS width,
+    DROP COLUMN IF EXISTS height,
+    DROP COLUMN IF EXISTS thumbnail_sizes,
+    ADD CONSTRAINT attachments_checksum_fkey FOREIGN KEY (checksum) REFERENCES blobs(checksum);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_uploader ON attachments(uploader_id, checksum);
+CREATE INDEX IF NOT EXISTS idx_attachments_unsent ON attachments(created_at) WHERE message_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_blobs_unreferenced ON blobs(checksum) WHERE ref_count = 0;
+CREATE INDEX IF NOT EXISTS idx_blobs_unprocessed ON blobs(checksum)
+    WHERE width IS NOT NULL AND thumbnail_sizes IS NULL;
+
+CREATE OR REPLACE FUNCTION count_blob_refs() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        UPDATE blobs SET ref_count = ref_count + 1 WHERE checksum = NEW.checksum;
+    ELSE
+        UPDATE blobs SET ref_count = ref_count - 1 WHERE checksum = OLD.checksum;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER attachments_blob_refs
+    AFTER INSERT OR DELETE ON attachments
+    FOR EACH ROW EXECUTE FUNCTION count_blob_refs();
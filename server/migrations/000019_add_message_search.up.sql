@@ -0,0 +1,4 @@
+-- Full-text search over message content. Queries must use this exact
+-- expression for the index to apply.
+CREATE INDEX IF NOT EXISTS idx_messages_content_search ON messages
+    USING GIN (to_tsvector('english', content));
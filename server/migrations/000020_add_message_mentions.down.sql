@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_messages_mentions;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS mentions_recipient,
+    DROP COLUMN IF EXISTS mention_everyone,
+    DROP COLUMN IF EXISTS mention_role_ids,
+    DROP COLUMN IF EXISTS mention_user_ids;
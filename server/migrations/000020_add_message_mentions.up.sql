@@ -0,0 +1,43 @@
+-- What each message mentions, parsed from its content when it is sent.
+-- mention_everyone is set by both @everyone and @here. mentions_recipient
+-- is set when the message counted as a mention for its recipient: it
+-- mentions them, reached them, and they were not ignoring the sender.
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS mention_user_ids UUID[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS mention_role_ids BIGINT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS mention_everyone BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS mentions_recipient BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Parse earlier user messages the same way, skipping code and keeping only
+-- users that exist. Code blocks and inline code are stripped in separate
+-- passes, as the server does: in one pattern with both, Postgres would
+-- make the block match greedy.
+UPDATE messages m SET
+    mention_user_ids = ARRAY(
+        SELECT DISTINCT u.id
+        FROM regexp_matches(p.content,
+            '<@!?([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})>', 'g') AS r(match)
+        JOIN users u ON u.id = r.match[1]::uuid),
+    mention_role_ids = ARRAY(
+        SELECT DISTINCT r.match[1]::bigint
+        FROM regexp_matches(p.content, '<@&([0-9]{1,19})>', 'g') AS r(match)
+        WHERE r.match[1]::numeric <= 9223372036854775807),
+    mention_everyone = p.content ~ '(^|[^[:alnum:]_@])@(everyone|here)\M'
+FROM (
+    SELECT id, regexp_replace(regexp_replace(content, '```.*?```', ' ', 'g'), '`[^`]*`', ' ', 'g') AS content
+    FROM messages
+    WHERE type IN (0, 19) AND content LIKE '%@%'
+) p
+WHERE p.id = m.id;
+
+-- Whether a conversation was ignored when an earlier message was sent is
+-- not recorded, so its state now stands in.
+UPDATE messages m SET mentions_recipient = TRUE
+WHERE NOT m.suppressed
+  AND (m.mention_everyone OR m.to_id = ANY(m.mention_user_ids))
+  AND NOT EXISTS (
+      SELECT 1 FROM conversations c
+      WHERE c.user_id = m.to_id AND c.peer_id = m.from_id AND c.state = 'ignored');
+
+-- For the search filter on mentioned users.
+CREATE INDEX IF NOT EXISTS idx_messages_mentions ON messages USING GIN (mention_user_ids);